@@ -15,7 +15,7 @@ func (rumor *RumourMessage) GetID() uint32 {
 }
 
 func (rumor *RumourMessage) GetValue() interface{} {
-	return rumor.Text
+	return rumor
 }
 
 func (tlc *TLCMessage) GetOrigin() string {
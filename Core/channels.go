@@ -0,0 +1,82 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//ChannelKey derives the key of an encrypted channel from its name and the passphrase shared by its members
+func ChannelKey(channel, passphrase string) ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, []byte(passphrase), []byte(channel), []byte("peerster channel"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//ChannelSealer encrypts one channel rumour with the channel key. Creating it does all that can fail, so that a rumour whose ID
+//was already handed out is always sealed.
+type ChannelSealer struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+//NewChannelSealer prepares the encryption of a channel rumour with the channel key and a fresh nonce
+func NewChannelSealer(key []byte) (*ChannelSealer, error) {
+	aead, err := channelCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &ChannelSealer{aead: aead, nonce: nonce}, nil
+}
+
+//Seal encrypts the text of a channel rumour. Must be called once, before the rumour is signed.
+func (sealer *ChannelSealer) Seal(rumour *RumourMessage) {
+	rumour.Sealed = sealer.aead.Seal(sealer.nonce, sealer.nonce, []byte(rumour.Text), rumour.channelAssociatedData())
+	rumour.Text = ""
+}
+
+//OpenChannelRumour decrypts the text of a sealed channel rumour
+func OpenChannelRumour(rumour *RumourMessage, key []byte) (string, error) {
+	aead, err := channelCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(rumour.Sealed) < aead.NonceSize() {
+		return "", errors.New("Sealed channel rumour too short")
+	}
+	nonce, ciphertext := rumour.Sealed[:aead.NonceSize()], rumour.Sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, rumour.channelAssociatedData())
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func channelCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (rumour *RumourMessage) channelAssociatedData() []byte {
+	h := sha256.New()
+	writeField(h, []byte(rumour.Origin))
+	binary.Write(h, binary.LittleEndian, rumour.ID)
+	writeField(h, []byte(rumour.Channel))
+	return h.Sum(nil)
+}
@@ -16,125 +16,148 @@ import (
 //Context carrying contextual information on the state of the gossiper
 type Context struct {
 	Address           *net.UDPAddr
-	conn              *net.UDPConn
+	transport         Transport
 	UIport            string
 	Name              string
 	connLocker        sync.RWMutex
-	peerLocker        sync.RWMutex
-	Peers             []string
+	PeerManager       *PeerManager
 	GUImessageChannel chan *GUIPacket
 	VectorClock       VectorClock
 	SimpleMode        bool
-	dsdvLocker        sync.RWMutex
-	DSDVector         map[string]string
+	Routes            *RoutingTable
 	hopLimit          uint32
 	hw3Flags          [2]bool
+	Registry          *PacketRegistry
+	Identity          *Identity
+	KeyRing           *KeyRing
+	Store             *Store
+	keyFile           *loadedKeyFile
+	done              chan struct{}
+	stopOnce          sync.Once
 }
 
-//CreateContext creates a new Context
+//CreateContext creates a new Context communicating over UDP
 func CreateContext(Address, name, UIp string, simple, hw3ex2, hw3ex3 bool, hopLim uint32) *Context {
-	udpAddr, err := net.ResolveUDPAddr("udp4", Address)
-	udpConn, err := net.ListenUDP("udp4", udpAddr)
+	transport, err := NewUDPTransport(Address)
 	if err != nil {
 		log.Fatal(err)
 	}
+	ctx, err := CreateContextWithTransport(transport, name, UIp, simple, hw3ex2, hw3ex3, hopLim)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ctx
+}
+
+//CreateContextWithTransport creates a new Context on top of an existing transport, whose local address must be in IP:Port form.
+//Packets larger than a single datagram are fragmented on the given transport.
+func CreateContextWithTransport(transport Transport, name, UIp string, simple, hw3ex2, hw3ex3 bool, hopLim uint32) (*Context, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", transport.LocalAddress())
+	if err != nil {
+		return nil, err
+	}
+	identity, err := NewIdentity(name)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx := &Context{
 		Address:           udpAddr,
-		conn:              udpConn,
+		transport:         NewFramedTransport(transport),
 		Name:              name,
 		UIport:            UIp,
 		GUImessageChannel: make(chan *GUIPacket, 50),
 		SimpleMode:        simple,
-		DSDVector:         make(map[string]string),
+		Routes:            NewRoutingTable(),
+		PeerManager:       NewPeerManager(PEER_SUSPECT_TIMEOUT, PEER_DEAD_TIMEOUT),
 		hopLimit:          hopLim,
+		Registry:          NewPacketRegistry(),
+		Identity:          identity,
+		KeyRing:           NewKeyRing(identity),
+		done:              make(chan struct{}),
 	}
+	ctx.Registry.Limiter = NewRateLimiter(DefaultRateLimits)
 	ctx.hw3Flags[0] = hw3ex2 || hw3ex3
 	ctx.hw3Flags[1] = hw3ex3
 	ctx.VectorClock = *NewVectorClock()
-	return ctx
+	return ctx, nil
 }
 
-//AddPeer to gossiper
-func (ctx *Context) AddPeer(pAddr string) {
-	ctx.peerLocker.Lock()
-	ctx.peerLocker.Unlock()
+//Stop tells every background loop running on the context to return. It can be called more than once.
+func (ctx *Context) Stop() {
+	ctx.stopOnce.Do(func() { close(ctx.done) })
+}
 
-	if len(pAddr) > 0 {
-		ctx.Peers = append(ctx.Peers, pAddr)
-	}
+//Done returns a channel closed once the context is stopped
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.done
 }
 
-//GetPeers safley locking
-func (ctx *Context) GetPeers() []string {
-	ctx.peerLocker.RLock()
-	defer ctx.peerLocker.RUnlock()
+//AddPeer to gossiper, ignoring peers that are already known
+func (ctx *Context) AddPeer(pAddr string) {
+	ctx.PeerManager.Add(pAddr)
+}
 
-	return ctx.Peers
+//GetPeers returns the peers that are not quarantined as dead
+func (ctx *Context) GetPeers() []string {
+	return ctx.PeerManager.Live()
 }
 
-//GetConnection returns the connection of our context
-func (ctx *Context) GetConnection() *net.UDPConn {
+//GetTransport returns the transport of our context
+func (ctx *Context) GetTransport() Transport {
 	ctx.connLocker.RLock()
 	defer ctx.connLocker.RUnlock()
-	return ctx.conn
+	return ctx.transport
 }
 
 //SendPacketToPeer sends a gossipPacket to a specified peer
 func (ctx *Context) SendPacketToPeer(gossipPacket GossipPacket, peer string) error {
 	ctx.connLocker.RLock()
 	defer ctx.connLocker.RUnlock()
-	peerAddress, err := net.ResolveUDPAddr("udp", peer)
-	if err != nil {
-		return err
-	}
 
 	packetBytes, err := protobuf.Encode(&gossipPacket)
+	if err == nil {
+		err = ctx.transport.Send(peer, packetBytes)
+	}
 	if err != nil {
-		return err
+		log.Println("Could not send packet to", peer, ":", err)
 	}
-
-	ctx.conn.WriteToUDP(packetBytes, peerAddress)
-	return nil
+	return err
 }
 
 //SendPacketToPeerViaRouting accepts a gossip packet and attempts to send it to a given origin. If the route to the given origin is not found an error is returned.
 func (ctx *Context) SendPacketToPeerViaRouting(gossipePacket GossipPacket, peer string) error {
 	found, destination := ctx.RetrieveDestinationRoute(peer)
 	if found == 1 {
-		ctx.SendPacketToPeer(gossipePacket, destination)
-		return nil
+		return ctx.SendPacketToPeer(gossipePacket, destination)
 	}
 	return errors.New("Unable to retrieve route for given origin")
 }
 
-//ForwardToPeers forwards a message to all known peers
+//ForwardToPeers forwards a message to all known peers but the one it was relayed by
 func (ctx *Context) ForwardToPeers(message SimpleMessage) error {
+	relay := message.RelayPeerAddr
+	message.RelayPeerAddr = ctx.Address.String()
 	for _, knwonPeer := range ctx.GetPeers() {
-		if strings.Compare(knwonPeer, message.RelayPeerAddr) == 0 {
+		if strings.Compare(knwonPeer, relay) == 0 {
 			continue
 		}
-		message.RelayPeerAddr = ctx.Address.String()
 		gossipPacket := GossipPacket{Simple: &message}
 
-		peerAddress, err1 := net.ResolveUDPAddr("udp", knwonPeer)
-		if err1 != nil {
-			return err1
-		}
-
-		packetBytes, err := protobuf.Encode(&gossipPacket)
-		if err != nil {
+		if err := ctx.SendPacketToPeer(gossipPacket, knwonPeer); err != nil {
 			fmt.Println(err)
 		}
-		ctx.conn.WriteToUDP(packetBytes, peerAddress)
 	}
 	return nil
 }
 
-//RandomPeer to be generated
+//RandomPeer to be generated. Returns an empty string when no peer is alive.
 func RandomPeer(ctx *Context, sender string) string {
 	peerList := ctx.GetPeers()
 	totalPeers := len(peerList) //Preventing infinite loop in case of only one peer
+	if totalPeers == 0 {
+		return ""
+	}
 	randPeer := peerList[rand.Intn(totalPeers)]
 	for keepSearching := true; keepSearching; keepSearching = (strings.Compare(randPeer, sender) == 0 && totalPeers != 1) {
 		randPeer = peerList[rand.Intn(totalPeers)]
@@ -154,25 +177,30 @@ func RandomPeers(n int, peerList []string) []string {
 	return randomPeers
 }
 
-//UpdateDSDV updates the routing table based on route messages
-func (ctx *Context) UpdateDSDV(origin, latestIP string, isRouteMessage bool) {
-	if strings.Compare(latestIP, ctx.Address.String()) == 0 {
+//UpdateRoute offers a route to origin through latestIP, learnt from route announcement seqNum after hopCount hops
+func (ctx *Context) UpdateRoute(origin, latestIP string, seqNum, hopCount uint32) {
+	if strings.Compare(latestIP, ctx.Address.String()) == 0 || strings.Compare(origin, ctx.Name) == 0 {
 		return
 	}
-	ctx.dsdvLocker.Lock()
-	ctx.DSDVector[origin] = latestIP
-	ctx.dsdvLocker.Unlock()
-	if !isRouteMessage {
-		// fmt.Println("DSDV", origin, latestIP)
+	if ctx.Routes.Update(origin, latestIP, seqNum, hopCount) {
+		fmt.Println("DSDV", origin, latestIP)
+	}
+}
+
+//UpdateRouteFromMessage offers a route to origin through latestIP, learnt from the message with the given ID after hopCount hops.
+//Such routes only reach origins that send no route announcements, as peers predating them do.
+func (ctx *Context) UpdateRouteFromMessage(origin, latestIP string, id, hopCount uint32) {
+	if strings.Compare(latestIP, ctx.Address.String()) == 0 || strings.Compare(origin, ctx.Name) == 0 {
+		return
+	}
+	if ctx.Routes.UpdateFromMessage(origin, latestIP, id, hopCount) {
+		fmt.Println("DSDV", origin, latestIP)
 	}
 }
 
 //RemoveInactiveDestination deletes a destination from the routing table
 func (ctx *Context) RemoveInactiveDestination(origin string) {
-	ctx.dsdvLocker.Lock()
-	defer ctx.dsdvLocker.Unlock()
-
-	delete(ctx.DSDVector, origin)
+	ctx.Routes.Remove(origin)
 }
 
 //RetrieveDestinationRoute finds the next hop to follow given a destination
@@ -180,25 +208,16 @@ func (ctx *Context) RetrieveDestinationRoute(destination string) (int, string) {
 	if strings.Compare(destination, ctx.Name) == 0 {
 		return 0, ""
 	}
-	ctx.dsdvLocker.RLock()
-	defer ctx.dsdvLocker.RUnlock()
-	destinationIP, ok := ctx.DSDVector[destination]
+	route, ok := ctx.Routes.Lookup(destination)
 	if !ok {
 		return -1, ""
 	}
-	return 1, destinationIP
+	return 1, route.NextHop
 }
 
-//GetPeerOrigins returns list of all stored peer origins
+//GetPeerOrigins returns list of all origins with a live route
 func (ctx *Context) GetPeerOrigins() []string {
-	ctx.dsdvLocker.RLock()
-	defer ctx.dsdvLocker.RUnlock()
-
-	origins := make([]string, 0, len(ctx.DSDVector))
-	for k := range ctx.DSDVector {
-		origins = append(origins, k)
-	}
-	return origins
+	return ctx.Routes.Origins()
 }
 
 //GetHopLimit retrieves the common hopLimit from the context
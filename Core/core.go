@@ -3,7 +3,6 @@ package core
 import (
 	"crypto/sha256"
 	"encoding/binary"
-	"errors"
 )
 
 const (
@@ -22,29 +21,45 @@ const (
 	PASSWORD_RETRIEVE  = 13
 	PASSWORD_OP_RESULT = 14
 	PASSWORD_DELETE    = 15
+	ENCRYPTED_PRIVATE  = 16
+	PEER_EVENT         = 17
+	PEER_EXCHANGE      = 18
+	MESSAGE_BATCH      = 19
+	MESSAGE_GAP        = 20
+	CHANNEL_JOIN       = 21
+	CHANNEL_LEAVE      = 22
+	PRIVATE_ACK        = 23
+	MAILBOX_DEPOSIT    = 24
+	ROUTE_ANNOUNCEMENT = 25
 	UNKNOWN            = -1
 )
 
 //Message struct for client-gossiper communicaiton
 type Message struct {
-	Text        string
-	Destination *string
-	File        *string
-	Request     *[]byte
-	KeyWords    *string
-	Budget      *uint64
-	MasterKey   *string
-	NewPassword *string
-	AccountURL  *string
-	UserName    *string
-	DeleteUser  *string
-}
-
-//SimpleMessage structure
+	Text         string
+	Destination  *string
+	File         *string
+	Request      *[]byte
+	KeyWords     *string
+	Budget       *uint64
+	MasterKey    *string
+	NewPassword  *string
+	AccountURL   *string
+	UserName     *string
+	DeleteUser   *string
+	Channel      *string
+	JoinChannel  *string
+	LeaveChannel *string
+	ChannelKey   *string
+}
+
+//SimpleMessage structure. OriginalName and Nonce identify a message to suppress duplicates, HopLimit bounds how far it is flooded.
 type SimpleMessage struct {
 	OriginalName  string
 	RelayPeerAddr string
 	Contents      string
+	Nonce         uint64
+	HopLimit      uint32
 }
 
 //GossipPacket for building on at a later point
@@ -61,6 +76,28 @@ type GossipPacket struct {
 	Ack               *TLCAck
 	PublicSecretShare *PublicShare
 	ShareRequest      *ShareRequest
+	EncryptedPrivate  *EncryptedPrivateMessage
+	PeerExchange      *PeerExchange
+	Batch             *MessageBatch
+	PrivateAck        *PrivateAck
+	Deposit           *MailboxDeposit
+	Route             *RouteAnnouncement
+}
+
+//RouteAnnouncement is the routing heartbeat of Origin, flooded to every node. SeqNum grows with every announcement, even across restarts.
+type RouteAnnouncement struct {
+	Origin        string
+	SeqNum        uint32
+	Hops          uint32
+	EncryptionKey []byte
+	PublicKey     []byte
+	Signature     []byte
+}
+
+//PeerExchange carries a sample of the peer addresses known to its sender. Requests expect a sample back.
+type PeerExchange struct {
+	Peers   []string
+	Request bool
 }
 
 //PrivateMessage struct for point to point messaging
@@ -70,6 +107,43 @@ type PrivateMessage struct {
 	Text        string
 	Destination string
 	HopLimit    uint32
+	PublicKey   []byte
+	Signature   []byte
+}
+
+//PrivateAck confirms to Destination that the private message ID it sent reached Origin. It is routed back like a private message.
+type PrivateAck struct {
+	Origin      string
+	ID          uint32
+	Destination string
+	HopLimit    uint32
+	PublicKey   []byte
+	Signature   []byte
+}
+
+//PrivateReceipt reports to the GUI the delivery status of a private message we sent
+type PrivateReceipt struct {
+	Destination string
+	ID          uint32
+	Text        string
+	Status      string
+}
+
+const (
+	PRIVATE_SENT      = "sent"
+	PRIVATE_DELIVERED = "delivered"
+	PRIVATE_STORED    = "stored"
+	PRIVATE_FAILED    = "failed"
+)
+
+//MailboxDeposit asks Destination to hold a private message until its recipient is back online. It is routed like a private message.
+//A deposit carrying the recipient's Ack instead of a Message tells the holder that the message it held was delivered.
+type MailboxDeposit struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Message     *EncryptedPrivateMessage
+	Ack         *PrivateAck
 }
 
 //NewPrivateMessage creates a new privateMessage message
@@ -84,11 +158,17 @@ func NewPrivateMessage(id, hopLimit uint32, txt, origin, destination string) *Pr
 	return privateMessage
 }
 
-//RumourMessage struct definition
+//RumourMessage struct definition. Channel rumours are only shown to the channel members, Sealed carries their text when the channel is encrypted.
 type RumourMessage struct {
-	Origin string `json:"origin"`
-	ID     uint32
-	Text   string `json:"text"`
+	Origin        string `json:"origin"`
+	ID            uint32
+	Text          string `json:"text"`
+	EncryptionKey []byte
+	Hops          uint32
+	PublicKey     []byte
+	Signature     []byte
+	Channel       string `json:"channel"`
+	Sealed        []byte
 }
 
 //NewRumourMessage creates a new rumour message
@@ -101,15 +181,30 @@ func NewRumourMessage(id uint32, txt, origin string) *RumourMessage {
 	return rumour
 }
 
+//IsRouteRumour reports whether a rumour only announces its origin, as peers predating route announcements send them
+func (rumor *RumourMessage) IsRouteRumour() bool {
+	return len(rumor.Text) == 0 && len(rumor.Channel) == 0 && len(rumor.Sealed) == 0
+}
+
 //PeerStatus struct used to regulate inter-peer communication
 type PeerStatus struct {
 	Identifier string
 	NextID     uint32
 }
 
-//StatusPacket struct
+//StatusPacket struct. A status carrying only a Digest of the sender's vector clock asks for the full status if the clocks differ.
 type StatusPacket struct {
-	Want []PeerStatus
+	Want   []PeerStatus
+	Digest []byte
+}
+
+//MessageBatch streams several rumours and TLC messages a peer is missing in a single anti-entropy exchange.
+//Pruned tells the peer, for each origin, the ID it should skip to because the sender no longer holds the messages before it.
+//Rumours then include the highest signed rumour of each of these origins, the proof that the skipped IDs were published.
+type MessageBatch struct {
+	Rumours []*RumourMessage
+	TLCs    []*TLCMessage
+	Pruned  []PeerStatus
 }
 
 //DataRequest for chunk and metafile requests
@@ -173,6 +268,7 @@ type TLCMessage struct {
 	TxBlock     BlockPublish
 	VectorClock *StatusPacket
 	Fitness     float32
+	Hops        uint32
 }
 
 //TLCAck for ackonledgements
@@ -192,6 +288,18 @@ type GUIPacket struct {
 	SearchResult     *SearchResult
 	Password         *string
 	PasswordOpResult *string
+	PeerEvent        *PeerEvent
+	Gap              *MessageGap
+	Late             bool
+	Receipt          *PrivateReceipt
+	Simple           *SimpleMessage
+}
+
+//MessageGap reports rumours from Origin, FromID to ToID included, that were given up on for in order delivery
+type MessageGap struct {
+	Origin string
+	FromID uint32
+	ToID   uint32
 }
 
 /*PublicShare represents the actual data structure to be transmitted inside a gossip packet
@@ -216,37 +324,6 @@ type ShareRequest struct {
 	RequestUID string
 }
 
-//GetType used to determine contents of a given GossiperPacket
-func (gp *GossipPacket) GetType(allowSimple bool) (int, error) {
-	if gp.Simple != nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && allowSimple {
-		return SIMPLE_MESSAGE, nil
-	} else if gp.Simple == nil && gp.Rumor != nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return RUMOUR_MESSAGE, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status != nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return STATUS_PACKET, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private != nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return PRIVATE_MESSAGE, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply != nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return DATA_REPLY, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest != nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return DATA_REQUEST, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest != nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return SEARCH_REQUEST, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply != nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return SEARCH_REPLY, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage != nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return TLC_MESSAGE, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack != nil && gp.PublicSecretShare == nil && gp.ShareRequest == nil && !allowSimple {
-		return TLC_ACK, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare != nil && gp.ShareRequest == nil && !allowSimple {
-		return PASSWORD_INSERT, nil
-	} else if gp.Simple == nil && gp.Rumor == nil && gp.Status == nil && gp.Private == nil && gp.DataReply == nil && gp.DataRequest == nil && gp.SearchRequest == nil && gp.SearchReply == nil && gp.TLCMessage == nil && gp.Ack == nil && gp.PublicSecretShare == nil && gp.ShareRequest != nil && !allowSimple {
-		return PASSWORD_RETRIEVE, nil
-	} else {
-		return 0, errors.New("Corrupt Gossip Packet received: Multiple content packet received, or faulty broadcasting mode (SimpleMode set to true)")
-	}
-}
-
 //GetType of Client Message
 func (m *Message) GetType(simpleMode bool) int {
 	if simpleMode {
@@ -263,6 +340,10 @@ func (m *Message) GetType(simpleMode bool) int {
 		return PASSWORD_RETRIEVE
 	} else if m.MasterKey != nil && m.NewPassword == nil && m.DeleteUser != nil {
 		return PASSWORD_DELETE
+	} else if m.JoinChannel != nil {
+		return CHANNEL_JOIN
+	} else if m.LeaveChannel != nil {
+		return CHANNEL_LEAVE
 	} else if m.Destination != nil {
 		return PRIVATE_MESSAGE
 	} else {
@@ -298,6 +379,18 @@ func (gp *GUIPacket) GetType() int {
 	if gp.PasswordOpResult != nil {
 		return PASSWORD_OP_RESULT
 	}
+	if gp.PeerEvent != nil {
+		return PEER_EVENT
+	}
+	if gp.Gap != nil {
+		return MESSAGE_GAP
+	}
+	if gp.Receipt != nil {
+		return PRIVATE_ACK
+	}
+	if gp.Simple != nil {
+		return SIMPLE_MESSAGE
+	}
 	return UNKNOWN
 }
 
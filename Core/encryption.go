@@ -0,0 +1,137 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//ErrUnknownEncryptionKey is returned when no encryption key has been announced for a peer
+var ErrUnknownEncryptionKey = errors.New("No encryption key known for destination")
+
+//EncryptedPrivateMessage carries an AEAD-sealed private message. Relays can only read its routing fields.
+type EncryptedPrivateMessage struct {
+	Origin      string
+	ID          uint32
+	Destination string
+	HopLimit    uint32
+	Nonce       []byte
+	Ciphertext  []byte
+	PublicKey   []byte
+	Signature   []byte
+	//Holder is the mailbox delivering the message, which the recipient acknowledges it to as well. It is not signed.
+	Holder string
+}
+
+//EncryptionPublicKey returns the X25519 public key peers use to encrypt messages to this identity
+func (identity *Identity) EncryptionPublicKey() []byte {
+	return identity.encryptionKey.PublicKey().Bytes()
+}
+
+//SealPrivate encrypts a private message to the holder of recipientKey and signs the result
+func (identity *Identity) SealPrivate(private *PrivateMessage, recipientKey []byte) (*EncryptedPrivateMessage, error) {
+	aead, err := identity.sharedCipher(recipientKey, private.Origin, private.Destination)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := &EncryptedPrivateMessage{
+		Origin:      private.Origin,
+		ID:          private.ID,
+		Destination: private.Destination,
+		HopLimit:    private.HopLimit,
+		Nonce:       nonce,
+	}
+	sealed.Ciphertext = aead.Seal(nil, nonce, []byte(private.Text), sealed.associatedData())
+	sealed.PublicKey = identity.PublicKey
+	sealed.Signature = ed25519.Sign(identity.privateKey, sealed.signedBytes())
+	return sealed, nil
+}
+
+//OpenPrivate decrypts a private message sent by the holder of senderKey
+func (identity *Identity) OpenPrivate(sealed *EncryptedPrivateMessage, senderKey []byte) (*PrivateMessage, error) {
+	aead, err := identity.sharedCipher(senderKey, sealed.Origin, sealed.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errors.New("Invalid nonce size")
+	}
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, sealed.associatedData())
+	if err != nil {
+		return nil, err
+	}
+	return NewPrivateMessage(sealed.ID, sealed.HopLimit, string(plaintext), sealed.Origin, sealed.Destination), nil
+}
+
+func (identity *Identity) sharedCipher(peerKey []byte, origin, destination string) (cipher.AEAD, error) {
+	publicKey, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := identity.encryptionKey.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, secret, nil, []byte("peerster private "+origin+" -> "+destination))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//BindEncryptionKey records the encryption key announced by a peer in one of its authenticated rumours
+func (keyRing *KeyRing) BindEncryptionKey(name string, key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	keyRing.keyLocker.Lock()
+	defer keyRing.keyLocker.Unlock()
+	keyRing.encryptionKeys[name] = key
+}
+
+//GetEncryptionKey returns the encryption key announced by a peer
+func (keyRing *KeyRing) GetEncryptionKey(name string) ([]byte, bool) {
+	keyRing.keyLocker.RLock()
+	defer keyRing.keyLocker.RUnlock()
+	key, ok := keyRing.encryptionKeys[name]
+	return key, ok
+}
+
+//VerifyEncryptedPrivate checks the signature over the routing fields and ciphertext of an encrypted private message
+func (keyRing *KeyRing) VerifyEncryptedPrivate(sealed *EncryptedPrivateMessage) error {
+	return keyRing.verify(sealed.Origin, sealed.PublicKey, sealed.Signature, sealed.signedBytes())
+}
+
+func (sealed *EncryptedPrivateMessage) associatedData() []byte {
+	h := sha256.New()
+	writeField(h, []byte(sealed.Origin))
+	binary.Write(h, binary.LittleEndian, sealed.ID)
+	writeField(h, []byte(sealed.Destination))
+	return h.Sum(nil)
+}
+
+func (sealed *EncryptedPrivateMessage) signedBytes() []byte {
+	h := sha256.New()
+	h.Write([]byte("encrypted private"))
+	h.Write(sealed.associatedData())
+	writeField(h, sealed.Nonce)
+	writeField(h, sealed.Ciphertext)
+	return h.Sum(nil)
+}
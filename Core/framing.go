@@ -0,0 +1,284 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_DATAGRAM_SIZE  = 12288
+	MAX_PACKET_SIZE    = 16 * 1024 * 1024
+	REASSEMBLY_MEMORY  = 64 * 1024 * 1024
+	REASSEMBLY_TIMEOUT = 5 * time.Second
+	//MAX_PENDING_PER_SENDER bounds the packets a single sender may have in reassembly at once
+	MAX_PENDING_PER_SENDER = 16
+	//MAX_REPORTED_ERRORS bounds the reassembly errors queued until Receive reports them, later ones are dropped
+	MAX_REPORTED_ERRORS = 64
+	//ENTRY_OVERHEAD and FRAGMENT_OVERHEAD are charged against the reassembly memory cap on top of the payloads,
+	//so that packets of empty or tiny fragments cannot pile up unaccounted
+	ENTRY_OVERHEAD       = 256
+	FRAGMENT_OVERHEAD    = 64
+	fragmentHeaderLength = 4 + 8 + 4 + 4 + 4
+)
+
+//fragmentMagic prefixes every fragment. An encoded GossipPacket never starts with it, so unfragmented packets keep today's wire format.
+var fragmentMagic = []byte("PSTF")
+
+var (
+	//ErrPacketTooLarge is returned when an encoded packet exceeds MAX_PACKET_SIZE
+	ErrPacketTooLarge = errors.New("Packet exceeds maximum packet size")
+	//ErrMalformedFragment is returned for fragments with an inconsistent header
+	ErrMalformedFragment = errors.New("Malformed fragment received")
+	//ErrReassemblyMemory is returned when buffering a fragment would exceed the reassembly memory cap
+	ErrReassemblyMemory = errors.New("Reassembly memory exhausted, dropping fragment")
+	//ErrTooManyPending is returned when a sender already has MAX_PENDING_PER_SENDER packets in reassembly
+	ErrTooManyPending = errors.New("Too many packets in reassembly from sender, dropping fragment")
+)
+
+//ReassemblyError reports a packet that could not be reassembled
+type ReassemblyError struct {
+	Sender     string
+	PacketID   uint64
+	Received   uint32
+	Total      uint32
+	Underlying error
+}
+
+func (e *ReassemblyError) Error() string {
+	return fmt.Sprintf("Could not reassemble packet %d from %s (%d/%d fragments): %v", e.PacketID, e.Sender, e.Received, e.Total, e.Underlying)
+}
+
+//ErrReassemblyTimeout is wrapped by ReassemblyErrors for packets whose fragments did not all arrive in time
+var ErrReassemblyTimeout = errors.New("fragments timed out")
+
+type reassembly struct {
+	sender    string
+	id        uint64
+	total     uint32
+	size      uint32
+	fragments map[uint32][]byte
+	buffered  int
+	timer     *time.Timer
+}
+
+//FramedTransport wraps a Transport, splitting packets larger than a datagram into numbered fragments and reassembling them on receipt
+type FramedTransport struct {
+	inner          Transport
+	maxDatagram    int
+	maxPacket      int
+	memoryCap      int
+	timeout        time.Duration
+	framingLocker  sync.Mutex
+	nextID         uint64
+	pending        map[string]*reassembly
+	pendingCounts  map[string]int
+	bufferedBytes  int
+	reportedErrors []*ReassemblyError
+}
+
+//NewFramedTransport wraps inner with fragmentation and reassembly using the default limits
+func NewFramedTransport(inner Transport) *FramedTransport {
+	return NewFramedTransportWithLimits(inner, MAX_DATAGRAM_SIZE, MAX_PACKET_SIZE, REASSEMBLY_MEMORY, REASSEMBLY_TIMEOUT)
+}
+
+//NewFramedTransportWithLimits wraps inner with fragmentation and reassembly using custom limits
+func NewFramedTransportWithLimits(inner Transport, maxDatagram, maxPacket, memoryCap int, timeout time.Duration) *FramedTransport {
+	return &FramedTransport{
+		inner:         inner,
+		maxDatagram:   maxDatagram,
+		maxPacket:     maxPacket,
+		memoryCap:     memoryCap,
+		timeout:       timeout,
+		nextID:        rand.Uint64(),
+		pending:       make(map[string]*reassembly),
+		pendingCounts: make(map[string]int),
+	}
+}
+
+//Send transmits data as a single datagram when it fits, or as a sequence of fragments otherwise
+func (t *FramedTransport) Send(address string, data []byte) error {
+	if len(data) > t.maxPacket {
+		return ErrPacketTooLarge
+	}
+	if len(data) <= t.maxDatagram && !bytes.HasPrefix(data, fragmentMagic) {
+		return t.inner.Send(address, data)
+	}
+	for _, fragment := range t.split(data) {
+		if err := t.inner.Send(address, fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *FramedTransport) split(data []byte) [][]byte {
+	t.framingLocker.Lock()
+	t.nextID++
+	id := t.nextID
+	t.framingLocker.Unlock()
+
+	payloadSize := t.maxDatagram - fragmentHeaderLength
+	total := (len(data) + payloadSize - 1) / payloadSize
+	fragments := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fragment := make([]byte, fragmentHeaderLength, fragmentHeaderLength+end-i*payloadSize)
+		copy(fragment, fragmentMagic)
+		binary.BigEndian.PutUint64(fragment[4:], id)
+		binary.BigEndian.PutUint32(fragment[12:], uint32(i))
+		binary.BigEndian.PutUint32(fragment[16:], uint32(total))
+		binary.BigEndian.PutUint32(fragment[20:], uint32(len(data)))
+		fragments = append(fragments, append(fragment, data[i*payloadSize:end]...))
+	}
+	return fragments
+}
+
+//Receive returns the next complete packet. Packets that could not be reassembled are reported as errors of type *ReassemblyError.
+func (t *FramedTransport) Receive() ([]byte, string, error) {
+	for {
+		if err := t.popReportedError(); err != nil {
+			return nil, err.Sender, err
+		}
+		data, sender, err := t.inner.Receive()
+		if err != nil {
+			return nil, sender, err
+		}
+		if !bytes.HasPrefix(data, fragmentMagic) {
+			return data, sender, nil
+		}
+		packet, complete, err := t.reassemble(data, sender)
+		if err != nil {
+			return nil, sender, err
+		}
+		if complete {
+			return packet, sender, nil
+		}
+	}
+}
+
+//reassemble buffers a fragment and returns the packet once all its fragments arrived. Packets that do not complete within the timeout
+//are dropped by a timer, so that nothing is left buffered when their sender goes quiet.
+func (t *FramedTransport) reassemble(fragment []byte, sender string) ([]byte, bool, error) {
+	if len(fragment) < fragmentHeaderLength {
+		return nil, false, ErrMalformedFragment
+	}
+	id := binary.BigEndian.Uint64(fragment[4:])
+	index := binary.BigEndian.Uint32(fragment[12:])
+	total := binary.BigEndian.Uint32(fragment[16:])
+	size := binary.BigEndian.Uint32(fragment[20:])
+	payload := fragment[fragmentHeaderLength:]
+	if total == 0 || index >= total || int(size) > t.maxPacket || len(payload) > int(size) {
+		return nil, false, ErrMalformedFragment
+	}
+	//Only the single fragment of an empty packet may be empty, every other fragment carries at least a byte
+	if size == 0 && total != 1 || size > 0 && (len(payload) == 0 || total > size) {
+		return nil, false, ErrMalformedFragment
+	}
+
+	t.framingLocker.Lock()
+	defer t.framingLocker.Unlock()
+
+	key := fmt.Sprintf("%s/%d", sender, id)
+	entry, exists := t.pending[key]
+	if !exists {
+		if t.pendingCounts[sender] >= MAX_PENDING_PER_SENDER {
+			return nil, false, &ReassemblyError{Sender: sender, PacketID: id, Total: total, Underlying: ErrTooManyPending}
+		}
+		if t.bufferedBytes+ENTRY_OVERHEAD > t.memoryCap {
+			return nil, false, &ReassemblyError{Sender: sender, PacketID: id, Total: total, Underlying: ErrReassemblyMemory}
+		}
+		entry = &reassembly{
+			sender:    sender,
+			id:        id,
+			total:     total,
+			size:      size,
+			fragments: make(map[uint32][]byte),
+			buffered:  ENTRY_OVERHEAD,
+		}
+		entry.timer = time.AfterFunc(t.timeout, func() { t.expire(key, entry) })
+		t.pending[key] = entry
+		t.pendingCounts[sender]++
+		t.bufferedBytes += ENTRY_OVERHEAD
+	}
+	if entry.total != total || entry.size != size {
+		t.discard(key, entry)
+		return nil, false, ErrMalformedFragment
+	}
+	if _, duplicate := entry.fragments[index]; duplicate {
+		return nil, false, nil
+	}
+	cost := len(payload) + FRAGMENT_OVERHEAD
+	if t.bufferedBytes+cost > t.memoryCap {
+		t.discard(key, entry)
+		return nil, false, &ReassemblyError{Sender: sender, PacketID: id, Received: uint32(len(entry.fragments)), Total: total, Underlying: ErrReassemblyMemory}
+	}
+	entry.fragments[index] = payload
+	entry.buffered += cost
+	t.bufferedBytes += cost
+	if uint32(len(entry.fragments)) < total {
+		return nil, false, nil
+	}
+
+	t.discard(key, entry)
+	packet := make([]byte, 0, size)
+	for i := uint32(0); i < total; i++ {
+		packet = append(packet, entry.fragments[i]...)
+	}
+	if len(packet) != int(size) {
+		return nil, false, ErrMalformedFragment
+	}
+	return packet, true, nil
+}
+
+//discard drops a packet in reassembly. Must be called with the lock held.
+func (t *FramedTransport) discard(key string, entry *reassembly) {
+	entry.timer.Stop()
+	t.bufferedBytes -= entry.buffered
+	delete(t.pending, key)
+	if t.pendingCounts[entry.sender]--; t.pendingCounts[entry.sender] <= 0 {
+		delete(t.pendingCounts, entry.sender)
+	}
+}
+
+//expire drops a packet whose fragments did not all arrive in time, and queues the error for Receive to report
+func (t *FramedTransport) expire(key string, entry *reassembly) {
+	t.framingLocker.Lock()
+	defer t.framingLocker.Unlock()
+	if t.pending[key] != entry {
+		//Completed or discarded just as the timer fired
+		return
+	}
+	t.discard(key, entry)
+	if len(t.reportedErrors) < MAX_REPORTED_ERRORS {
+		t.reportedErrors = append(t.reportedErrors, &ReassemblyError{Sender: entry.sender, PacketID: entry.id, Received: uint32(len(entry.fragments)), Total: entry.total, Underlying: ErrReassemblyTimeout})
+	}
+}
+
+func (t *FramedTransport) popReportedError() *ReassemblyError {
+	t.framingLocker.Lock()
+	defer t.framingLocker.Unlock()
+	if len(t.reportedErrors) == 0 {
+		return nil
+	}
+	err := t.reportedErrors[0]
+	t.reportedErrors = t.reportedErrors[1:]
+	return err
+}
+
+//LocalAddress returns the address of the wrapped transport
+func (t *FramedTransport) LocalAddress() string {
+	return t.inner.LocalAddress()
+}
+
+//Close closes the wrapped transport
+func (t *FramedTransport) Close() error {
+	return t.inner.Close()
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+//fragment builds a fragment with the given header fields, whether or not they are consistent
+func fragment(id uint64, index, total, size uint32, payload []byte) []byte {
+	header := make([]byte, fragmentHeaderLength)
+	copy(header, fragmentMagic)
+	binary.BigEndian.PutUint64(header[4:], id)
+	binary.BigEndian.PutUint32(header[12:], index)
+	binary.BigEndian.PutUint32(header[16:], total)
+	binary.BigEndian.PutUint32(header[20:], size)
+	return append(header, payload...)
+}
+
+func TestReassemble(t *testing.T) {
+	cases := []struct {
+		name      string
+		memoryCap int
+		fragments [][]byte
+		packet    []byte
+		err       error
+	}{
+		{
+			name:      "in order",
+			fragments: [][]byte{fragment(1, 0, 2, 6, []byte("abc")), fragment(1, 1, 2, 6, []byte("def"))},
+			packet:    []byte("abcdef"),
+		},
+		{
+			name:      "out of order with a duplicate",
+			fragments: [][]byte{fragment(1, 1, 2, 6, []byte("def")), fragment(1, 1, 2, 6, []byte("def")), fragment(1, 0, 2, 6, []byte("abc"))},
+			packet:    []byte("abcdef"),
+		},
+		{
+			name:      "empty packet",
+			fragments: [][]byte{fragment(1, 0, 1, 0, nil)},
+			packet:    []byte{},
+		},
+		{
+			name:      "truncated header",
+			fragments: [][]byte{fragment(1, 0, 1, 3, []byte("abc"))[:fragmentHeaderLength-1]},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "index beyond total",
+			fragments: [][]byte{fragment(1, 2, 2, 6, []byte("abc"))},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "empty fragment of a non empty packet",
+			fragments: [][]byte{fragment(1, 0, 2, 6, nil)},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "empty packet in several fragments",
+			fragments: [][]byte{fragment(1, 0, 2, 0, nil)},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "more fragments than bytes",
+			fragments: [][]byte{fragment(1, 0, 7, 6, []byte("a"))},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "payload larger than the packet",
+			fragments: [][]byte{fragment(1, 0, 1, 2, []byte("abc"))},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "inconsistent total",
+			fragments: [][]byte{fragment(1, 0, 2, 6, []byte("abc")), fragment(1, 1, 3, 6, []byte("d"))},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "wrong reassembled size",
+			fragments: [][]byte{fragment(1, 0, 2, 6, []byte("abc")), fragment(1, 1, 2, 6, []byte("d"))},
+			err:       ErrMalformedFragment,
+		},
+		{
+			name:      "memory cap counts the entry overhead",
+			memoryCap: ENTRY_OVERHEAD - 1,
+			fragments: [][]byte{fragment(1, 0, 2, 2, []byte("a"))},
+			err:       ErrReassemblyMemory,
+		},
+		{
+			name:      "memory cap counts the fragment overhead",
+			memoryCap: ENTRY_OVERHEAD + FRAGMENT_OVERHEAD,
+			fragments: [][]byte{fragment(1, 0, 2, 2, []byte("a"))},
+			err:       ErrReassemblyMemory,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			memoryCap := c.memoryCap
+			if memoryCap == 0 {
+				memoryCap = REASSEMBLY_MEMORY
+			}
+			framed := NewFramedTransportWithLimits(nil, MAX_DATAGRAM_SIZE, MAX_PACKET_SIZE, memoryCap, time.Minute)
+			var packet []byte
+			var complete bool
+			var err error
+			for _, f := range c.fragments {
+				if packet, complete, err = framed.reassemble(f, "peer"); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, c.err) && !isReassemblyError(err, c.err) {
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+			if c.err == nil && (!complete || !bytes.Equal(packet, c.packet)) {
+				t.Fatalf("got packet %q complete %v, want %q", packet, complete, c.packet)
+			}
+			if c.err != nil && complete {
+				t.Fatal("packet completed despite the error")
+			}
+			if c.err == nil && (len(framed.pending) != 0 || framed.bufferedBytes != 0) {
+				t.Fatalf("%d packets and %d bytes left buffered", len(framed.pending), framed.bufferedBytes)
+			}
+		})
+	}
+}
+
+func TestReassemblePendingPerSender(t *testing.T) {
+	framed := NewFramedTransportWithLimits(nil, MAX_DATAGRAM_SIZE, MAX_PACKET_SIZE, REASSEMBLY_MEMORY, time.Minute)
+	for id := uint64(0); id < MAX_PENDING_PER_SENDER; id++ {
+		if _, _, err := framed.reassemble(fragment(id, 0, 2, 2, []byte("a")), "flooder"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := framed.reassemble(fragment(MAX_PENDING_PER_SENDER, 0, 2, 2, []byte("a")), "flooder"); !isReassemblyError(err, ErrTooManyPending) {
+		t.Fatalf("got error %v, want %v", err, ErrTooManyPending)
+	}
+	//Other senders are not held back by the flooder, and completing a packet makes room again
+	if _, _, err := framed.reassemble(fragment(0, 0, 2, 2, []byte("a")), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, complete, err := framed.reassemble(fragment(0, 1, 2, 2, []byte("b")), "flooder"); err != nil || !complete {
+		t.Fatalf("got complete %v error %v", complete, err)
+	}
+	if _, _, err := framed.reassemble(fragment(MAX_PENDING_PER_SENDER, 0, 2, 2, []byte("a")), "flooder"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReassembleExpiry(t *testing.T) {
+	framed := NewFramedTransportWithLimits(nil, MAX_DATAGRAM_SIZE, MAX_PACKET_SIZE, REASSEMBLY_MEMORY, 20*time.Millisecond)
+	if _, _, err := framed.reassemble(fragment(7, 0, 2, 2, []byte("a")), "peer"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	err := framed.popReportedError()
+	if err == nil || err.PacketID != 7 || err.Received != 1 || !errors.Is(err.Underlying, ErrReassemblyTimeout) {
+		t.Fatalf("got error %v, want a timeout of packet 7", err)
+	}
+	framed.framingLocker.Lock()
+	defer framed.framingLocker.Unlock()
+	if len(framed.pending) != 0 || len(framed.pendingCounts) != 0 || framed.bufferedBytes != 0 {
+		t.Fatalf("%d packets and %d bytes left buffered", len(framed.pending), framed.bufferedBytes)
+	}
+}
+
+func TestFramedTransportRoundTrip(t *testing.T) {
+	network := NewChannelNetwork()
+	inner, err := network.NewTransport("10.0.0.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := NewFramedTransport(inner)
+	data := make([]byte, 5*MAX_DATAGRAM_SIZE+17)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := framed.Send(framed.LocalAddress(), data); err != nil {
+		t.Fatal(err)
+	}
+	received, sender, err := framed.Receive()
+	if err != nil || sender != framed.LocalAddress() || !bytes.Equal(received, data) {
+		t.Fatalf("got %d bytes from %s, error %v", len(received), sender, err)
+	}
+}
+
+func isReassemblyError(err, underlying error) bool {
+	reassemblyErr, ok := err.(*ReassemblyError)
+	return ok && reassemblyErr.Underlying == underlying
+}
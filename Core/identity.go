@@ -0,0 +1,196 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	//ErrMissingSignature is returned for packets that carry no signature or public key
+	ErrMissingSignature = errors.New("Packet is not signed")
+	//ErrInvalidSignature is returned for packets whose signature does not match their contents
+	ErrInvalidSignature = errors.New("Invalid packet signature")
+	//ErrKeyMismatch is returned for packets signed with a key other than the one bound to their origin
+	ErrKeyMismatch = errors.New("Packet signed with a key not bound to its origin")
+)
+
+//Identity holds the keypair a gossiper uses to sign the packets it originates
+type Identity struct {
+	Name          string
+	PublicKey     ed25519.PublicKey
+	privateKey    ed25519.PrivateKey
+	encryptionKey *ecdh.PrivateKey
+}
+
+//NewIdentity generates a fresh Ed25519 signing keypair and X25519 encryption keypair for the given name
+func NewIdentity(name string) (*Identity, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Name: name, PublicKey: publicKey, privateKey: privateKey, encryptionKey: encryptionKey}, nil
+}
+
+//SignRumour attaches the identity's public key and a signature to a rumour it originated
+func (identity *Identity) SignRumour(rumour *RumourMessage) {
+	rumour.PublicKey = identity.PublicKey
+	rumour.Signature = ed25519.Sign(identity.privateKey, rumour.signedBytes())
+}
+
+//SignPrivate attaches the identity's public key and a signature to a private message it originated
+func (identity *Identity) SignPrivate(private *PrivateMessage) {
+	private.PublicKey = identity.PublicKey
+	private.Signature = ed25519.Sign(identity.privateKey, private.signedBytes())
+}
+
+//SignPrivateAck attaches the identity's public key and a signature to a delivery acknowledgement it issued
+func (identity *Identity) SignPrivateAck(ack *PrivateAck) {
+	ack.PublicKey = identity.PublicKey
+	ack.Signature = ed25519.Sign(identity.privateKey, ack.signedBytes())
+}
+
+//SignRouteAnnouncement attaches the identity's public key and a signature to a route announcement it originated
+func (identity *Identity) SignRouteAnnouncement(announcement *RouteAnnouncement) {
+	announcement.PublicKey = identity.PublicKey
+	announcement.Signature = ed25519.Sign(identity.privateKey, announcement.signedBytes())
+}
+
+//KeyRing binds peer names to the first public key that produced a valid signature for them
+type KeyRing struct {
+	keyLocker      sync.RWMutex
+	keys           map[string]ed25519.PublicKey
+	encryptionKeys map[string][]byte
+	forgedCount    uint64
+}
+
+//NewKeyRing creates a key ring where the local identity is already bound
+func NewKeyRing(local *Identity) *KeyRing {
+	keyRing := &KeyRing{
+		keys:           make(map[string]ed25519.PublicKey),
+		encryptionKeys: make(map[string][]byte),
+	}
+	keyRing.keys[local.Name] = local.PublicKey
+	keyRing.encryptionKeys[local.Name] = local.EncryptionPublicKey()
+	return keyRing
+}
+
+//VerifyRumour checks the signature of a rumour against the key bound to its origin
+func (keyRing *KeyRing) VerifyRumour(rumour *RumourMessage) error {
+	return keyRing.verify(rumour.Origin, rumour.PublicKey, rumour.Signature, rumour.signedBytes())
+}
+
+//VerifyPrivate checks the signature of a private message against the key bound to its origin
+func (keyRing *KeyRing) VerifyPrivate(private *PrivateMessage) error {
+	return keyRing.verify(private.Origin, private.PublicKey, private.Signature, private.signedBytes())
+}
+
+//VerifyPrivateAck checks the signature of a delivery acknowledgement against the key bound to its origin
+func (keyRing *KeyRing) VerifyPrivateAck(ack *PrivateAck) error {
+	return keyRing.verify(ack.Origin, ack.PublicKey, ack.Signature, ack.signedBytes())
+}
+
+//VerifyRouteAnnouncement checks the signature of a route announcement against the key bound to its origin
+func (keyRing *KeyRing) VerifyRouteAnnouncement(announcement *RouteAnnouncement) error {
+	return keyRing.verify(announcement.Origin, announcement.PublicKey, announcement.Signature, announcement.signedBytes())
+}
+
+//GetKey returns the public key bound to a name
+func (keyRing *KeyRing) GetKey(name string) (ed25519.PublicKey, bool) {
+	keyRing.keyLocker.RLock()
+	defer keyRing.keyLocker.RUnlock()
+	key, ok := keyRing.keys[name]
+	return key, ok
+}
+
+//GetForgedCount returns the number of packets rejected for a missing, invalid or mismatching signature
+func (keyRing *KeyRing) GetForgedCount() uint64 {
+	keyRing.keyLocker.RLock()
+	defer keyRing.keyLocker.RUnlock()
+	return keyRing.forgedCount
+}
+
+func (keyRing *KeyRing) verify(origin string, publicKey, signature, payload []byte) error {
+	err := checkSignature(publicKey, signature, payload)
+	keyRing.keyLocker.Lock()
+	defer keyRing.keyLocker.Unlock()
+	if err == nil {
+		boundKey, bound := keyRing.keys[origin]
+		if !bound {
+			keyRing.keys[origin] = ed25519.PublicKey(publicKey)
+		} else if !bytes.Equal(boundKey, publicKey) {
+			err = ErrKeyMismatch
+		}
+	}
+	if err != nil {
+		keyRing.forgedCount++
+	}
+	return err
+}
+
+func checkSignature(publicKey, signature, payload []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize || len(signature) != ed25519.SignatureSize {
+		return ErrMissingSignature
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), payload, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (rumor *RumourMessage) signedBytes() []byte {
+	h := sha256.New()
+	h.Write([]byte("rumour"))
+	writeField(h, []byte(rumor.Origin))
+	binary.Write(h, binary.LittleEndian, rumor.ID)
+	writeField(h, []byte(rumor.Text))
+	writeField(h, rumor.EncryptionKey)
+	if len(rumor.Channel) > 0 || len(rumor.Sealed) > 0 {
+		writeField(h, []byte(rumor.Channel))
+		writeField(h, rumor.Sealed)
+	}
+	return h.Sum(nil)
+}
+
+func (private *PrivateMessage) signedBytes() []byte {
+	h := sha256.New()
+	h.Write([]byte("private"))
+	writeField(h, []byte(private.Origin))
+	binary.Write(h, binary.LittleEndian, private.ID)
+	writeField(h, []byte(private.Text))
+	writeField(h, []byte(private.Destination))
+	return h.Sum(nil)
+}
+
+func (ack *PrivateAck) signedBytes() []byte {
+	h := sha256.New()
+	h.Write([]byte("private ack"))
+	writeField(h, []byte(ack.Origin))
+	binary.Write(h, binary.LittleEndian, ack.ID)
+	writeField(h, []byte(ack.Destination))
+	return h.Sum(nil)
+}
+
+func (announcement *RouteAnnouncement) signedBytes() []byte {
+	h := sha256.New()
+	h.Write([]byte("route"))
+	writeField(h, []byte(announcement.Origin))
+	binary.Write(h, binary.LittleEndian, announcement.SeqNum)
+	writeField(h, announcement.EncryptionKey)
+	return h.Sum(nil)
+}
+
+func writeField(w io.Writer, field []byte) {
+	binary.Write(w, binary.LittleEndian, uint32(len(field)))
+	w.Write(field)
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type storedBody struct {
+	content Stackable
+	stored  time.Time
+}
+
+//MessageStore keeps the bodies of rumours and TLC messages by origin and ID.
+//Bodies older than the retention window are pruned, the vector clock still remembers that they were received.
+type MessageStore struct {
+	bodyLocker sync.RWMutex
+	bodies     map[string]map[uint32]*storedBody
+	retention  time.Duration
+}
+
+//NewMessageStore creates a store keeping bodies forever
+func NewMessageStore() *MessageStore {
+	return &MessageStore{bodies: make(map[string]map[uint32]*storedBody)}
+}
+
+//SetRetention sets how long bodies are kept. Zero keeps them forever.
+func (store *MessageStore) SetRetention(retention time.Duration) {
+	store.bodyLocker.Lock()
+	defer store.bodyLocker.Unlock()
+	store.retention = retention
+}
+
+//Put stores the body of a message received now
+func (store *MessageStore) Put(content Stackable) {
+	store.PutAt(content, time.Now())
+}
+
+//PutAt stores the body of a message received at the given time, which starts its retention window
+func (store *MessageStore) PutAt(content Stackable, stored time.Time) {
+	store.bodyLocker.Lock()
+	defer store.bodyLocker.Unlock()
+	messages, ok := store.bodies[content.GetOrigin()]
+	if !ok {
+		messages = make(map[uint32]*storedBody)
+		store.bodies[content.GetOrigin()] = messages
+	}
+	messages[content.GetID()] = &storedBody{content: content, stored: stored}
+}
+
+//Get returns the body of a message if it is still retained
+func (store *MessageStore) Get(origin string, id uint32) (Stackable, bool) {
+	store.bodyLocker.RLock()
+	defer store.bodyLocker.RUnlock()
+	body, ok := store.bodies[origin][id]
+	if !ok {
+		return nil, false
+	}
+	return body.content, true
+}
+
+//FirstRetained returns the lowest retained ID from origin that is at least from
+func (store *MessageStore) FirstRetained(origin string, from uint32) (uint32, bool) {
+	store.bodyLocker.RLock()
+	defer store.bodyLocker.RUnlock()
+	messages := store.bodies[origin]
+	if _, ok := messages[from]; ok {
+		return from, true
+	}
+	first, found := uint32(0), false
+	for id := range messages {
+		if id >= from && (!found || id < first) {
+			first, found = id, true
+		}
+	}
+	return first, found
+}
+
+//Prune drops the bodies stored for longer than the retention window and returns how many were dropped
+func (store *MessageStore) Prune(now time.Time) int {
+	store.bodyLocker.Lock()
+	defer store.bodyLocker.Unlock()
+	if store.retention <= 0 {
+		return 0
+	}
+	pruned := 0
+	for origin, messages := range store.bodies {
+		for id, body := range messages {
+			if now.Sub(body.stored) > store.retention {
+				delete(messages, id)
+				pruned++
+			}
+		}
+		if len(messages) == 0 {
+			delete(store.bodies, origin)
+		}
+	}
+	return pruned
+}
+
+//all returns every retained body with the time it was stored, sorted by origin and ID
+func (store *MessageStore) all() []storedBody {
+	store.bodyLocker.RLock()
+	defer store.bodyLocker.RUnlock()
+	all := []storedBody{}
+	for _, messages := range store.bodies {
+		for _, body := range messages {
+			all = append(all, *body)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].content.GetOrigin() != all[j].content.GetOrigin() {
+			return all[i].content.GetOrigin() < all[j].content.GetOrigin()
+		}
+		return all[i].content.GetID() < all[j].content.GetID()
+	})
+	return all
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	PEER_ALIVE = iota
+	PEER_SUSPECT
+	PEER_DEAD
+	PEER_REMOVED
+)
+
+const (
+	PEER_SUSPECT_TIMEOUT = 30 * time.Second
+	PEER_DEAD_TIMEOUT    = 60 * time.Second
+	PEER_EVENT_BUFFER    = 100
+)
+
+//PeerEvent reports a peer changing liveness state
+type PeerEvent struct {
+	Address string
+	State   int
+}
+
+//StateName returns a human readable name for the event state
+func (event PeerEvent) StateName() string {
+	switch event.State {
+	case PEER_ALIVE:
+		return "up"
+	case PEER_SUSPECT:
+		return "suspect"
+	case PEER_REMOVED:
+		return "removed"
+	default:
+		return "down"
+	}
+}
+
+type peerInfo struct {
+	lastHeard time.Time
+	state     int
+	pinned    bool
+}
+
+//PeerManager tracks when each peer was last heard from. Peers silent for too long become suspect and then dead.
+//Dead peers are quarantined: they are no longer handed out for gossiping until they are heard from again.
+//Configured peers stay quarantined for good, peers learned from the network are removed once dead for as long again.
+type PeerManager struct {
+	peerLocker   sync.RWMutex
+	peers        map[string]*peerInfo
+	order        []string
+	suspectAfter time.Duration
+	deadAfter    time.Duration
+	Events       chan PeerEvent
+}
+
+//NewPeerManager creates a peer manager with the given suspicion and death timeouts
+func NewPeerManager(suspectAfter, deadAfter time.Duration) *PeerManager {
+	return &PeerManager{
+		peers:        make(map[string]*peerInfo),
+		order:        []string{},
+		suspectAfter: suspectAfter,
+		deadAfter:    deadAfter,
+		Events:       make(chan PeerEvent, PEER_EVENT_BUFFER),
+	}
+}
+
+//SetTimeouts changes the suspicion and death timeouts
+func (manager *PeerManager) SetTimeouts(suspectAfter, deadAfter time.Duration) {
+	manager.peerLocker.Lock()
+	defer manager.peerLocker.Unlock()
+	manager.suspectAfter = suspectAfter
+	manager.deadAfter = deadAfter
+}
+
+//Add registers a configured peer as alive unless it is already known, in which case it is only kept for good. Returns true for new peers.
+func (manager *PeerManager) Add(address string) bool {
+	return manager.add(address, true, 0)
+}
+
+//Learn registers a peer learned from the network as alive unless it is already known. Returns true for new peers.
+func (manager *PeerManager) Learn(address string) bool {
+	return manager.add(address, false, 0)
+}
+
+//LearnWithin registers a peer learned from the network like Learn, as long as fewer than limit peers are known
+func (manager *PeerManager) LearnWithin(address string, limit int) bool {
+	return manager.add(address, false, limit)
+}
+
+//add registers a new peer, unless limit is positive and that many peers are already known
+func (manager *PeerManager) add(address string, pinned bool, limit int) bool {
+	if len(address) == 0 {
+		return false
+	}
+	manager.peerLocker.Lock()
+	defer manager.peerLocker.Unlock()
+	if peer, known := manager.peers[address]; known {
+		peer.pinned = peer.pinned || pinned
+		return false
+	}
+	if limit > 0 && len(manager.order) >= limit {
+		return false
+	}
+	manager.peers[address] = &peerInfo{lastHeard: time.Now(), state: PEER_ALIVE, pinned: pinned}
+	manager.order = append(manager.order, address)
+	manager.publish(address, PEER_ALIVE)
+	return true
+}
+
+//Heard records that a packet was just received from address, adding or reviving the peer
+func (manager *PeerManager) Heard(address string) {
+	if manager.Learn(address) {
+		return
+	}
+	manager.peerLocker.Lock()
+	defer manager.peerLocker.Unlock()
+	peer := manager.peers[address]
+	peer.lastHeard = time.Now()
+	if peer.state != PEER_ALIVE {
+		peer.state = PEER_ALIVE
+		manager.publish(address, PEER_ALIVE)
+	}
+}
+
+//Check demotes peers that have been silent for too long, removes the learned ones dead for as long again, and returns the state changes it made
+func (manager *PeerManager) Check(now time.Time) []PeerEvent {
+	manager.peerLocker.Lock()
+	defer manager.peerLocker.Unlock()
+	events := []PeerEvent{}
+	kept := manager.order[:0]
+	for _, address := range manager.order {
+		peer := manager.peers[address]
+		silence := now.Sub(peer.lastHeard)
+		if !peer.pinned && silence > 2*manager.deadAfter {
+			delete(manager.peers, address)
+			manager.publish(address, PEER_REMOVED)
+			events = append(events, PeerEvent{Address: address, State: PEER_REMOVED})
+			continue
+		}
+		kept = append(kept, address)
+		newState := peer.state
+		if silence > manager.deadAfter {
+			newState = PEER_DEAD
+		} else if silence > manager.suspectAfter && peer.state == PEER_ALIVE {
+			newState = PEER_SUSPECT
+		}
+		if newState != peer.state {
+			peer.state = newState
+			manager.publish(address, newState)
+			events = append(events, PeerEvent{Address: address, State: newState})
+		}
+	}
+	manager.order = kept
+	return events
+}
+
+//Live returns the peers that are not quarantined, in the order they were added
+func (manager *PeerManager) Live() []string {
+	return manager.filter(func(peer *peerInfo) bool { return peer.state != PEER_DEAD })
+}
+
+//Quarantined returns the peers currently considered dead
+func (manager *PeerManager) Quarantined() []string {
+	return manager.filter(func(peer *peerInfo) bool { return peer.state == PEER_DEAD })
+}
+
+//All returns every known peer, including quarantined ones
+func (manager *PeerManager) All() []string {
+	return manager.filter(func(peer *peerInfo) bool { return true })
+}
+
+//GetState returns the liveness state of a peer
+func (manager *PeerManager) GetState(address string) (int, bool) {
+	manager.peerLocker.RLock()
+	defer manager.peerLocker.RUnlock()
+	peer, known := manager.peers[address]
+	if !known {
+		return PEER_DEAD, false
+	}
+	return peer.state, true
+}
+
+func (manager *PeerManager) filter(keep func(peer *peerInfo) bool) []string {
+	manager.peerLocker.RLock()
+	defer manager.peerLocker.RUnlock()
+	peers := []string{}
+	for _, address := range manager.order {
+		if keep(manager.peers[address]) {
+			peers = append(peers, address)
+		}
+	}
+	return peers
+}
+
+//publish hands an event to the listener without ever blocking the caller
+func (manager *PeerManager) publish(address string, state int) {
+	select {
+	case manager.Events <- PeerEvent{Address: address, State: state}:
+	default:
+	}
+}
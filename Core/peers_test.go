@@ -0,0 +1,47 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckRemovesOnlyLearnedPeers(t *testing.T) {
+	manager := NewPeerManager(time.Second, 2*time.Second)
+	manager.Add("10.0.0.1:5000")
+	manager.Learn("10.0.0.2:5000")
+	manager.Heard("10.0.0.3:5000")
+	now := time.Now()
+
+	manager.Check(now.Add(3 * time.Second))
+	if quarantined := manager.Quarantined(); len(quarantined) != 3 {
+		t.Fatalf("got quarantined peers %v, want all three", quarantined)
+	}
+	//Configuring a learned peer keeps it for good
+	manager.Add("10.0.0.3:5000")
+	events := manager.Check(now.Add(5 * time.Second))
+	want := []PeerEvent{{Address: "10.0.0.2:5000", State: PEER_REMOVED}}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+	if all := manager.All(); !reflect.DeepEqual(all, []string{"10.0.0.1:5000", "10.0.0.3:5000"}) {
+		t.Fatalf("got peers %v", all)
+	}
+	if _, known := manager.GetState("10.0.0.2:5000"); known {
+		t.Fatal("removed peer still known")
+	}
+}
+
+func TestLearnWithinCapsPeers(t *testing.T) {
+	manager := NewPeerManager(time.Second, 2*time.Second)
+	manager.Add("10.0.0.1:5000")
+	if !manager.LearnWithin("10.0.0.2:5000", 2) {
+		t.Fatal("peer refused below the limit")
+	}
+	if manager.LearnWithin("10.0.0.3:5000", 2) {
+		t.Fatal("peer accepted past the limit")
+	}
+	if !manager.Add("10.0.0.3:5000") {
+		t.Fatal("configured peer refused past the limit")
+	}
+}
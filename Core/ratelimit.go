@@ -0,0 +1,235 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	ANY_PACKET        = 0
+	MAX_BUDGET        = 256
+	MAX_HOP_LIMIT     = 32
+	MAX_BUCKETS       = 4096
+	BUCKET_IDLE_AFTER = time.Minute
+	//MAX_TRACKED_SENDERS bounds the senders whose dropped packets are counted one by one
+	MAX_TRACKED_SENDERS = 256
+)
+
+//ErrRateLimited is returned for packets dropped because their sender exceeded its quota
+var ErrRateLimited = errors.New("Sender exceeded its rate limit")
+
+//RateLimit is a token bucket configuration: Rate tokens per second refilling a bucket of Burst tokens
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+//DefaultRateLimits are the per sender quotas for every packet type. ANY_PACKET bounds all packets of a sender before decoding.
+var DefaultRateLimits = map[int]RateLimit{
+	ANY_PACKET:        {Rate: 500, Burst: 1000},
+	SEARCH_REQUEST:    {Rate: 5, Burst: 10},
+	PASSWORD_RETRIEVE: {Rate: 5, Burst: 10},
+	PASSWORD_INSERT:   {Rate: 20, Burst: 50},
+	PEER_EXCHANGE:     {Rate: 1, Burst: 5},
+}
+
+//defaultRateLimit applies to packet types without a specific quota
+var defaultRateLimit = RateLimit{Rate: 100, Burst: 200}
+
+type bucketKey struct {
+	sender     string
+	packetType int
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+func (bucket *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.lastFill).Seconds() * limit.Rate
+	if bucket.tokens > limit.Burst {
+		bucket.tokens = limit.Burst
+	}
+	bucket.lastFill = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+//TrafficStats is a snapshot of the traffic dropped or altered by a RateLimiter
+type TrafficStats struct {
+	RateLimitedByType   map[int]uint64    `json:"rateLimitedByType"`
+	RateLimitedBySender map[string]uint64 `json:"rateLimitedBySender"`
+	QueueDrops          uint64            `json:"queueDrops"`
+	ClampedBudgets      uint64            `json:"clampedBudgets"`
+	ClampedHopLimits    uint64            `json:"clampedHopLimits"`
+}
+
+//RateLimiter keeps one token bucket per sender and packet type, and counts what it drops
+type RateLimiter struct {
+	limiterLocker sync.Mutex
+	limits        map[int]RateLimit
+	buckets       map[bucketKey]*tokenBucket
+	stats         TrafficStats
+}
+
+//NewRateLimiter creates a limiter enforcing the given per type quotas
+func NewRateLimiter(limits map[int]RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		buckets: make(map[bucketKey]*tokenBucket),
+		stats: TrafficStats{
+			RateLimitedByType:   make(map[int]uint64),
+			RateLimitedBySender: make(map[string]uint64),
+		},
+	}
+}
+
+//Allow takes a token from the bucket of sender for packetType, returning false when the bucket is empty
+func (limiter *RateLimiter) Allow(sender string, packetType int) bool {
+	limit, ok := limiter.limits[packetType]
+	if !ok {
+		limit = defaultRateLimit
+	}
+	now := time.Now()
+	key := bucketKey{sender: sender, packetType: packetType}
+
+	limiter.limiterLocker.Lock()
+	defer limiter.limiterLocker.Unlock()
+	bucket, exists := limiter.buckets[key]
+	if !exists {
+		if len(limiter.buckets) >= MAX_BUCKETS {
+			limiter.evictIdle(now)
+		}
+		bucket = &tokenBucket{tokens: limit.Burst, lastFill: now}
+		limiter.buckets[key] = bucket
+	}
+	if bucket.take(limit, now) {
+		return true
+	}
+	limiter.stats.RateLimitedByType[packetType]++
+	limiter.countSenderDrop(sender)
+	return false
+}
+
+//countSenderDrop counts a packet dropped from sender, keeping only the MAX_TRACKED_SENDERS heaviest senders. A new sender replaces
+//the one with the fewest drops and takes over its count, so the senders dropping the most stay tracked whatever the source addresses spoofed.
+func (limiter *RateLimiter) countSenderDrop(sender string) {
+	counts := limiter.stats.RateLimitedBySender
+	if _, tracked := counts[sender]; !tracked && len(counts) >= MAX_TRACKED_SENDERS {
+		lightest, fewest := "", uint64(0)
+		for candidate, count := range counts {
+			if len(lightest) == 0 || count < fewest {
+				lightest, fewest = candidate, count
+			}
+		}
+		delete(counts, lightest)
+		counts[sender] = fewest
+	}
+	counts[sender]++
+}
+
+//CountQueueDrop records a packet dropped because the incoming queue was full
+func (limiter *RateLimiter) CountQueueDrop() {
+	limiter.limiterLocker.Lock()
+	defer limiter.limiterLocker.Unlock()
+	limiter.stats.QueueDrops++
+}
+
+//ApplyQuotas caps the budget and hop limit a packet claims, so a peer cannot make us amplify its requests
+func (limiter *RateLimiter) ApplyQuotas(packet *GossipPacket) {
+	clampedBudget := false
+	clampedHops := false
+	if packet.SearchRequest != nil && packet.SearchRequest.Budget > MAX_BUDGET {
+		packet.SearchRequest.Budget = MAX_BUDGET
+		clampedBudget = true
+	}
+	if packet.ShareRequest != nil && packet.ShareRequest.Budget > MAX_BUDGET {
+		packet.ShareRequest.Budget = MAX_BUDGET
+		clampedBudget = true
+	}
+	for _, hopLimit := range hopLimitsOf(packet) {
+		if *hopLimit > MAX_HOP_LIMIT {
+			*hopLimit = MAX_HOP_LIMIT
+			clampedHops = true
+		}
+	}
+	if !clampedBudget && !clampedHops {
+		return
+	}
+	limiter.limiterLocker.Lock()
+	defer limiter.limiterLocker.Unlock()
+	if clampedBudget {
+		limiter.stats.ClampedBudgets++
+	}
+	if clampedHops {
+		limiter.stats.ClampedHopLimits++
+	}
+}
+
+//GetStats returns a copy of the traffic counters
+func (limiter *RateLimiter) GetStats() TrafficStats {
+	limiter.limiterLocker.Lock()
+	defer limiter.limiterLocker.Unlock()
+	stats := limiter.stats
+	stats.RateLimitedByType = make(map[int]uint64)
+	stats.RateLimitedBySender = make(map[string]uint64)
+	for packetType, count := range limiter.stats.RateLimitedByType {
+		stats.RateLimitedByType[packetType] = count
+	}
+	for sender, count := range limiter.stats.RateLimitedBySender {
+		stats.RateLimitedBySender[sender] = count
+	}
+	return stats
+}
+
+func (limiter *RateLimiter) evictIdle(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.lastFill) > BUCKET_IDLE_AFTER {
+			delete(limiter.buckets, key)
+		}
+	}
+	if len(limiter.buckets) >= MAX_BUCKETS {
+		//Too many active senders to track: start over rather than grow without bound
+		limiter.buckets = make(map[bucketKey]*tokenBucket)
+	}
+}
+
+func hopLimitsOf(packet *GossipPacket) []*uint32 {
+	hopLimits := []*uint32{}
+	if packet.Private != nil {
+		hopLimits = append(hopLimits, &packet.Private.HopLimit)
+	}
+	if packet.EncryptedPrivate != nil {
+		hopLimits = append(hopLimits, &packet.EncryptedPrivate.HopLimit)
+	}
+	if packet.DataRequest != nil {
+		hopLimits = append(hopLimits, &packet.DataRequest.HopLimit)
+	}
+	if packet.DataReply != nil {
+		hopLimits = append(hopLimits, &packet.DataReply.HopLimit)
+	}
+	if packet.SearchReply != nil {
+		hopLimits = append(hopLimits, &packet.SearchReply.HopLimit)
+	}
+	if packet.Ack != nil {
+		hopLimits = append(hopLimits, &packet.Ack.HopLimit)
+	}
+	if packet.PublicSecretShare != nil {
+		hopLimits = append(hopLimits, &packet.PublicSecretShare.HopLimit)
+	}
+	if packet.PrivateAck != nil {
+		hopLimits = append(hopLimits, &packet.PrivateAck.HopLimit)
+	}
+	if packet.Deposit != nil {
+		hopLimits = append(hopLimits, &packet.Deposit.HopLimit)
+	}
+	if packet.Simple != nil {
+		hopLimits = append(hopLimits, &packet.Simple.HopLimit)
+	}
+	return hopLimits
+}
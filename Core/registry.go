@@ -0,0 +1,149 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//PacketKind describes one type of content a GossipPacket can carry and how to process it
+type PacketKind struct {
+	Type       int
+	Name       string
+	SimpleMode bool
+	Present    func(packet *GossipPacket) bool
+	Validate   func(packet *GossipPacket) error
+	Handle     func(packet GossipPacket, sender string)
+}
+
+//PacketRegistry classifies incoming GossipPackets and dispatches them to the subsystem that registered their kind
+type PacketRegistry struct {
+	Limiter        *RateLimiter
+	registryLocker sync.RWMutex
+	kinds          []*PacketKind
+	corruptPackets uint64
+	rejectedByType map[int]uint64
+}
+
+//NewPacketRegistry creates an empty registry
+func NewPacketRegistry() *PacketRegistry {
+	return &PacketRegistry{
+		kinds:          []*PacketKind{},
+		rejectedByType: make(map[int]uint64),
+	}
+}
+
+//Register adds a new packet kind to the registry
+func (registry *PacketRegistry) Register(kind PacketKind) error {
+	if kind.Present == nil || kind.Handle == nil {
+		return errors.New("Packet kind " + kind.Name + " is missing a presence check or a handler")
+	}
+	registry.registryLocker.Lock()
+	defer registry.registryLocker.Unlock()
+	for _, registered := range registry.kinds {
+		if registered.Type == kind.Type {
+			return fmt.Errorf("Packet kind %d already registered as %s", kind.Type, registered.Name)
+		}
+	}
+	registry.kinds = append(registry.kinds, &kind)
+	return nil
+}
+
+//Classify returns the kind of a packet carrying exactly one registered content allowed in the given mode
+func (registry *PacketRegistry) Classify(packet *GossipPacket, simpleMode bool) (*PacketKind, error) {
+	registry.registryLocker.RLock()
+	defer registry.registryLocker.RUnlock()
+	var match *PacketKind
+	for _, kind := range registry.kinds {
+		if !kind.Present(packet) {
+			continue
+		}
+		if match != nil {
+			return nil, errors.New("Corrupt Gossip Packet received: Multiple content packet received")
+		}
+		match = kind
+	}
+	if match == nil {
+		return nil, errors.New("Corrupt Gossip Packet received: No known content found")
+	}
+	if match.SimpleMode != simpleMode {
+		return nil, errors.New("Corrupt Gossip Packet received: " + match.Name + " not allowed in current broadcasting mode")
+	}
+	return match, nil
+}
+
+//Dispatch classifies and validates a packet and hands it to its handler. Packets failing either step are counted and dropped.
+//When a Limiter is set, packets over their sender's quota are dropped with ErrRateLimited and claimed budgets and hop limits are capped.
+func (registry *PacketRegistry) Dispatch(packet GossipPacket, sender string, simpleMode bool) error {
+	kind, err := registry.Classify(&packet, simpleMode)
+	if err != nil {
+		registry.registryLocker.Lock()
+		registry.corruptPackets++
+		registry.registryLocker.Unlock()
+		return err
+	}
+	if registry.Limiter != nil && !registry.Limiter.Allow(sender, kind.Type) {
+		return ErrRateLimited
+	}
+	if err = registry.validate(kind, &packet, sender); err != nil {
+		return err
+	}
+	go kind.Handle(packet, sender)
+	return nil
+}
+
+//Admit classifies and validates a packet carried inside another packet, which already counted against its sender's quota.
+//The caller handles the admitted packet itself.
+func (registry *PacketRegistry) Admit(packet *GossipPacket, sender string, simpleMode bool) (*PacketKind, error) {
+	kind, err := registry.Classify(packet, simpleMode)
+	if err != nil {
+		registry.registryLocker.Lock()
+		registry.corruptPackets++
+		registry.registryLocker.Unlock()
+		return nil, err
+	}
+	if err = registry.validate(kind, packet, sender); err != nil {
+		return nil, err
+	}
+	return kind, nil
+}
+
+func (registry *PacketRegistry) validate(kind *PacketKind, packet *GossipPacket, sender string) error {
+	if kind.Validate != nil {
+		if err := kind.Validate(packet); err != nil {
+			registry.registryLocker.Lock()
+			registry.rejectedByType[kind.Type]++
+			registry.registryLocker.Unlock()
+			return fmt.Errorf("Invalid %s from %s: %v", kind.Name, sender, err)
+		}
+	}
+	if registry.Limiter != nil {
+		registry.Limiter.ApplyQuotas(packet)
+	}
+	return nil
+}
+
+//GetCorruptPacketCount returns the number of packets dropped because they could not be classified
+func (registry *PacketRegistry) GetCorruptPacketCount() uint64 {
+	registry.registryLocker.RLock()
+	defer registry.registryLocker.RUnlock()
+	return registry.corruptPackets
+}
+
+//GetRejectedCount returns the number of packets of a given type dropped by validation
+func (registry *PacketRegistry) GetRejectedCount(packetType int) uint64 {
+	registry.registryLocker.RLock()
+	defer registry.registryLocker.RUnlock()
+	return registry.rejectedByType[packetType]
+}
+
+//GetKindNames maps every registered packet type to its name
+func (registry *PacketRegistry) GetKindNames() map[int]string {
+	registry.registryLocker.RLock()
+	defer registry.registryLocker.RUnlock()
+	names := make(map[int]string)
+	for _, kind := range registry.kinds {
+		names[kind.Type] = kind.Name
+	}
+	return names
+}
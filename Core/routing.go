@@ -0,0 +1,152 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ROUTE_EXPIRY_FACTOR is the number of missed route rumour periods after which a route is considered dead
+const ROUTE_EXPIRY_FACTOR = 5
+
+//Route is a distance vector entry: how to reach an origin, how far it is and how fresh that knowledge is.
+//Announced routes were learnt from route announcements, whose sequence numbers follow the clock of the origin. The others were learnt
+//from rumours and TLC messages, whose sequence numbers are message IDs, and only serve for origins that do not announce themselves.
+type Route struct {
+	Origin    string    `json:"origin"`
+	NextHop   string    `json:"nextHop"`
+	HopCount  uint32    `json:"hopCount"`
+	SeqNum    uint32    `json:"seqNum"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Announced bool      `json:"announced"`
+}
+
+//RoutingTable keeps one route per origin, preferring fresher sequence numbers and then shorter paths
+type RoutingTable struct {
+	routeLocker sync.RWMutex
+	routes      map[string]*Route
+	expiry      time.Duration
+}
+
+//NewRoutingTable creates an empty table whose routes never expire
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{routes: make(map[string]*Route)}
+}
+
+//SetExpiry sets how long a route stays valid without being refreshed. Zero disables expiry.
+func (table *RoutingTable) SetExpiry(expiry time.Duration) {
+	table.routeLocker.Lock()
+	defer table.routeLocker.Unlock()
+	table.expiry = expiry
+}
+
+//Update offers a route to origin learnt from a route announcement with the given sequence number and hop count.
+//It is accepted if there is no live announced route yet, if it is fresher, or if it is as fresh but shorter. Returns true if the next hop changed.
+func (table *RoutingTable) Update(origin, nextHop string, seqNum, hopCount uint32) bool {
+	return table.update(origin, nextHop, seqNum, hopCount, true)
+}
+
+//UpdateFromMessage offers a route to origin learnt from a message with the given ID and hop count, as Update does.
+//It is ignored while origin has a live announced route, message IDs and announcement sequence numbers cannot be compared.
+func (table *RoutingTable) UpdateFromMessage(origin, nextHop string, id, hopCount uint32) bool {
+	return table.update(origin, nextHop, id, hopCount, false)
+}
+
+func (table *RoutingTable) update(origin, nextHop string, seqNum, hopCount uint32, announced bool) bool {
+	now := time.Now()
+	table.routeLocker.Lock()
+	defer table.routeLocker.Unlock()
+
+	current, exists := table.routes[origin]
+	if exists && !table.isExpired(current, now) && current.Announced && !announced {
+		return false
+	}
+	//An announcement replaces a route learnt from messages whatever their sequence numbers
+	if exists && !table.isExpired(current, now) && current.Announced == announced {
+		sameHop := strings.Compare(current.NextHop, nextHop) == 0
+		switch {
+		case seqNum > current.SeqNum:
+		case seqNum == current.SeqNum && hopCount < current.HopCount:
+		case seqNum == current.SeqNum && sameHop:
+			current.LastSeen = now
+			return false
+		default:
+			return false
+		}
+	}
+	changed := !exists || strings.Compare(current.NextHop, nextHop) != 0
+	table.routes[origin] = &Route{Origin: origin, NextHop: nextHop, HopCount: hopCount, SeqNum: seqNum, LastSeen: now, Announced: announced}
+	return changed
+}
+
+//Lookup returns the live route to origin
+func (table *RoutingTable) Lookup(origin string) (Route, bool) {
+	table.routeLocker.RLock()
+	defer table.routeLocker.RUnlock()
+	route, ok := table.routes[origin]
+	if !ok || table.isExpired(route, time.Now()) {
+		return Route{}, false
+	}
+	return *route, true
+}
+
+//Remove deletes the route to origin
+func (table *RoutingTable) Remove(origin string) {
+	table.routeLocker.Lock()
+	defer table.routeLocker.Unlock()
+	delete(table.routes, origin)
+}
+
+//Expire drops every route that has not been refreshed within the expiry and returns their origins
+func (table *RoutingTable) Expire(now time.Time) []string {
+	table.routeLocker.Lock()
+	defer table.routeLocker.Unlock()
+	expired := []string{}
+	for origin, route := range table.routes {
+		if table.isExpired(route, now) {
+			delete(table.routes, origin)
+			expired = append(expired, origin)
+		}
+	}
+	return expired
+}
+
+//Origins lists every origin with a live route
+func (table *RoutingTable) Origins() []string {
+	routes := table.Routes()
+	origins := make([]string, 0, len(routes))
+	for _, route := range routes {
+		origins = append(origins, route.Origin)
+	}
+	return origins
+}
+
+//Routes returns a copy of every live route sorted by origin
+func (table *RoutingTable) Routes() []Route {
+	now := time.Now()
+	table.routeLocker.RLock()
+	defer table.routeLocker.RUnlock()
+	routes := make([]Route, 0, len(table.routes))
+	for _, route := range table.routes {
+		if !table.isExpired(route, now) {
+			routes = append(routes, *route)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Origin < routes[j].Origin })
+	return routes
+}
+
+//restore inserts saved routes as they were, keeping their original last seen time
+func (table *RoutingTable) restore(routes []Route) {
+	table.routeLocker.Lock()
+	defer table.routeLocker.Unlock()
+	for i := range routes {
+		route := routes[i]
+		table.routes[route.Origin] = &route
+	}
+}
+
+func (table *RoutingTable) isExpired(route *Route, now time.Time) bool {
+	return table.expiry > 0 && now.Sub(route.LastSeen) > table.expiry
+}
@@ -0,0 +1,28 @@
+package core
+
+import "testing"
+
+func TestMessagesDoNotOverrideAnnouncedRoutes(t *testing.T) {
+	table := NewRoutingTable()
+	table.UpdateFromMessage("A", "10.0.0.1:5000", 3, 1)
+	//Announcement sequence numbers follow the clock and replace any route learnt from messages
+	if !table.Update("A", "10.0.0.2:5000", 1700000000, 2) {
+		t.Fatal("announcement did not replace the route learnt from a rumour")
+	}
+	if table.UpdateFromMessage("A", "10.0.0.3:5000", 4, 0) {
+		t.Fatal("rumour replaced an announced route")
+	}
+	if table.Update("A", "10.0.0.3:5000", 5, 0) {
+		t.Fatal("stale announcement replaced a fresher one")
+	}
+	route, ok := table.Lookup("A")
+	if !ok || route.NextHop != "10.0.0.2:5000" || !route.Announced {
+		t.Fatalf("got route %v, want the announced one through 10.0.0.2:5000", route)
+	}
+
+	//Origins that do not announce themselves stay reachable through their rumours
+	table.UpdateFromMessage("B", "10.0.0.1:5000", 2, 1)
+	if !table.UpdateFromMessage("B", "10.0.0.2:5000", 3, 1) {
+		t.Fatal("fresher rumour did not replace the route")
+	}
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	IDENTITY_SNAPSHOT = "identity"
+	CONTEXT_SNAPSHOT  = "context"
+	//DEFAULT_KEY_DIRECTORY keeps the key file of every gossiper started from the working directory
+	DEFAULT_KEY_DIRECTORY = "_Keys/"
+)
+
+type identitySnapshot struct {
+	Name          string
+	SigningSeed   []byte
+	EncryptionKey []byte
+}
+
+//loadedKeyFile is the key file the identity of a gossiper was loaded from, or saved to when it did not exist yet
+type loadedKeyFile struct {
+	store *Store
+	name  string
+	found bool
+}
+
+//storedMessage holds one entry of the vector clock stack. Exactly one of Rumour and TLC is set.
+//Stored is when the body was first stored, snapshots taken before it was recorded restore bodies as stored at startup.
+type storedMessage struct {
+	Rumour *RumourMessage `json:",omitempty"`
+	TLC    *TLCMessage    `json:",omitempty"`
+	Stored time.Time
+}
+
+type contextSnapshot struct {
+	Peers          []string
+	Routes         []Route
+	Messages       []storedMessage
+	Clock          map[string]originSnapshot
+	Keys           map[string][]byte
+	EncryptionKeys map[string][]byte
+}
+
+//Save snapshots the gossiper identity, known peers, routes, bound keys and message history
+func (ctx *Context) Save(store *Store) error {
+	if err := store.Put(IDENTITY_SNAPSHOT, snapshotIdentity(ctx.Identity)); err != nil {
+		return err
+	}
+
+	snapshot := contextSnapshot{
+		Peers:          ctx.PeerManager.All(),
+		Routes:         ctx.Routes.Routes(),
+		Keys:           make(map[string][]byte),
+		EncryptionKeys: make(map[string][]byte),
+		Clock:          ctx.VectorClock.snapshot(),
+	}
+	for _, body := range ctx.VectorClock.Bodies.all() {
+		switch content := body.content.(type) {
+		case *RumourMessage:
+			snapshot.Messages = append(snapshot.Messages, storedMessage{Rumour: content, Stored: body.stored})
+		case *TLCMessage:
+			snapshot.Messages = append(snapshot.Messages, storedMessage{TLC: content, Stored: body.stored})
+		}
+	}
+
+	ctx.KeyRing.keyLocker.RLock()
+	for name, key := range ctx.KeyRing.keys {
+		snapshot.Keys[name] = key
+	}
+	for name, key := range ctx.KeyRing.encryptionKeys {
+		snapshot.EncryptionKeys[name] = key
+	}
+	ctx.KeyRing.keyLocker.RUnlock()
+
+	return store.Put(CONTEXT_SNAPSHOT, snapshot)
+}
+
+//Restore reloads a previous snapshot. It must run before the gossiper starts exchanging packets.
+func (ctx *Context) Restore(store *Store) error {
+	var savedIdentity identitySnapshot
+	found, err := store.Get(IDENTITY_SNAPSHOT, &savedIdentity)
+	if err != nil {
+		return err
+	}
+	if found {
+		if strings.Compare(savedIdentity.Name, ctx.Name) != 0 {
+			return fmt.Errorf("Data directory belongs to gossiper %s", savedIdentity.Name)
+		}
+		if err := ctx.reconcileKeyFile(savedIdentity); err != nil {
+			return err
+		}
+		identity, err := restoreIdentity(savedIdentity)
+		if err != nil {
+			return err
+		}
+		ctx.Identity = identity
+		ctx.KeyRing = NewKeyRing(identity)
+	}
+
+	var snapshot contextSnapshot
+	found, err = store.Get(CONTEXT_SNAPSHOT, &snapshot)
+	if err != nil || !found {
+		return err
+	}
+	//Configured peers are pinned again when they are added on start, the others are forgotten if they do not come back
+	for _, peer := range snapshot.Peers {
+		ctx.PeerManager.Learn(peer)
+	}
+	ctx.Routes.restore(snapshot.Routes)
+	//The clock also remembers messages whose bodies were pruned before the snapshot
+	ctx.VectorClock.restore(snapshot.Clock)
+	now := time.Now()
+	for _, message := range snapshot.Messages {
+		stored := message.Stored
+		if stored.IsZero() || stored.After(now) {
+			stored = now
+		}
+		if message.Rumour != nil {
+			ctx.VectorClock.storeMessageAt(message.Rumour, stored)
+		} else if message.TLC != nil {
+			ctx.VectorClock.storeMessageAt(message.TLC, stored)
+		}
+	}
+	ctx.KeyRing.keyLocker.Lock()
+	for name, key := range snapshot.Keys {
+		if _, bound := ctx.KeyRing.keys[name]; !bound {
+			ctx.KeyRing.keys[name] = ed25519.PublicKey(key)
+		}
+	}
+	for name, key := range snapshot.EncryptionKeys {
+		if _, bound := ctx.KeyRing.encryptionKeys[name]; !bound {
+			ctx.KeyRing.encryptionKeys[name] = key
+		}
+	}
+	ctx.KeyRing.keyLocker.Unlock()
+	return nil
+}
+
+//LoadKeys makes the gossiper keep its keys across restarts in a key file of keyDirectory, named after the gossiper.
+//The keys generated at startup are saved there the first time, and replaced by the saved ones afterwards:
+//peers bind a name to the first key they see, and would reject the packets of a gossiper that came back with new keys.
+func (ctx *Context) LoadKeys(keyDirectory string) error {
+	store, err := NewStore(keyDirectory)
+	if err != nil {
+		return err
+	}
+	keyFile := url.PathEscape(ctx.Name)
+	var savedIdentity identitySnapshot
+	found, err := store.Get(keyFile, &savedIdentity)
+	if err != nil {
+		return err
+	}
+	ctx.keyFile = &loadedKeyFile{store: store, name: keyFile, found: found}
+	if !found {
+		return store.Put(keyFile, snapshotIdentity(ctx.Identity))
+	}
+	if strings.Compare(savedIdentity.Name, ctx.Name) != 0 {
+		return fmt.Errorf("Key file belongs to gossiper %s", savedIdentity.Name)
+	}
+	identity, err := restoreIdentity(savedIdentity)
+	if err != nil {
+		return err
+	}
+	ctx.Identity = identity
+	ctx.KeyRing = NewKeyRing(identity)
+	return nil
+}
+
+//reconcileKeyFile checks the identity of a data directory against the key file loaded by LoadKeys, if any.
+//A key file created by this run only holds the keys generated at startup, it takes the identity of the data directory instead.
+//Otherwise both must hold the same keys, or the gossiper would sign with keys its peers never bound to its name.
+func (ctx *Context) reconcileKeyFile(saved identitySnapshot) error {
+	if ctx.keyFile == nil {
+		return nil
+	}
+	if !ctx.keyFile.found {
+		ctx.keyFile.found = true
+		return ctx.keyFile.store.Put(ctx.keyFile.name, saved)
+	}
+	current := snapshotIdentity(ctx.Identity)
+	if !bytes.Equal(current.SigningSeed, saved.SigningSeed) || !bytes.Equal(current.EncryptionKey, saved.EncryptionKey) {
+		return fmt.Errorf("Data directory and key file hold different keys for gossiper %s", ctx.Name)
+	}
+	return nil
+}
+
+func snapshotIdentity(identity *Identity) identitySnapshot {
+	return identitySnapshot{
+		Name:          identity.Name,
+		SigningSeed:   identity.privateKey.Seed(),
+		EncryptionKey: identity.encryptionKey.Bytes(),
+	}
+}
+
+func restoreIdentity(snapshot identitySnapshot) (*Identity, error) {
+	if len(snapshot.SigningSeed) != ed25519.SeedSize {
+		return nil, errors.New("Corrupt identity snapshot")
+	}
+	privateKey := ed25519.NewKeyFromSeed(snapshot.SigningSeed)
+	encryptionKey, err := ecdh.X25519().NewPrivateKey(snapshot.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Name:          snapshot.Name,
+		PublicKey:     privateKey.Public().(ed25519.PublicKey),
+		privateKey:    privateKey,
+		encryptionKey: encryptionKey,
+	}, nil
+}
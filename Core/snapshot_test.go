@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRestoreKeepsStoredTimes(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewChannelNetwork()
+	saved := newTestContext(t, network, "10.0.0.1:5000")
+	stored := time.Now().Add(-time.Hour).Truncate(time.Second)
+	saved.VectorClock.storeMessageAt(NewRumourMessage(1, "old", "A"), stored)
+	if err := saved.Save(store); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestContext(t, network, "10.0.0.2:5000")
+	if err := restored.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	bodies := restored.VectorClock.Bodies.all()
+	if len(bodies) != 1 || !bodies[0].stored.Equal(stored) {
+		t.Fatalf("got bodies %v, want one stored at %v", bodies, stored)
+	}
+	//The body is pruned after the retention window that started before the restart
+	restored.VectorClock.SetRetention(30 * time.Minute)
+	if pruned := restored.VectorClock.Prune(time.Now()); pruned != 1 {
+		t.Fatalf("pruned %d bodies, want 1", pruned)
+	}
+}
+
+func newTestContext(t *testing.T, network *ChannelNetwork, address string) *Context {
+	transport, err := network.NewTransport(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := CreateContextWithTransport(transport, "A", "", false, false, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestRestoreReconcilesKeyFile(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewChannelNetwork()
+	saved := newTestContext(t, network, "10.0.0.1:5000")
+	if err := saved.Save(store); err != nil {
+		t.Fatal(err)
+	}
+	signingKey := saved.Identity.privateKey.Seed()
+
+	//A key file created on this run takes the identity of the data directory
+	keyDirectory := t.TempDir()
+	first := newTestContext(t, network, "10.0.0.2:5000")
+	if err := first.LoadKeys(keyDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	second := newTestContext(t, network, "10.0.0.3:5000")
+	if err := second.LoadKeys(keyDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(second.Identity.privateKey.Seed(), signingKey) {
+		t.Fatal("key file does not hold the identity of the data directory")
+	}
+
+	//An existing key file holding other keys is refused
+	conflicting := t.TempDir()
+	if err := newTestContext(t, network, "10.0.0.5:5000").LoadKeys(conflicting); err != nil {
+		t.Fatal(err)
+	}
+	third := newTestContext(t, network, "10.0.0.6:5000")
+	if err := third.LoadKeys(conflicting); err != nil {
+		t.Fatal(err)
+	}
+	if err := third.Restore(store); err == nil {
+		t.Fatal("restored an identity other than the one of the key file")
+	}
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SNAPSHOT_INTERVAL = 10 * time.Second
+	snapshotExtension = ".json"
+)
+
+//Persistent is implemented by every subsystem whose state should survive a restart
+type Persistent interface {
+	Save(store *Store) error
+	Restore(store *Store) error
+}
+
+//Store keeps one JSON snapshot file per key inside a data directory.
+//Snapshots are written to a temporary file, synced and renamed over the previous one, so a crash never leaves a half written snapshot behind.
+//A nil Store persists nothing.
+type Store struct {
+	dataDir     string
+	storeLocker sync.Mutex
+}
+
+//NewStore opens the store in dataDir, creating the directory if needed
+func NewStore(dataDir string) (*Store, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dataDir: dataDir}, nil
+}
+
+//Put atomically replaces the snapshot stored under key with the JSON encoding of value
+func (store *Store) Put(key string, value interface{}) error {
+	if store == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	store.storeLocker.Lock()
+	defer store.storeLocker.Unlock()
+
+	target := filepath.Join(store.dataDir, key+snapshotExtension)
+	tmp, err := os.CreateTemp(store.dataDir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	return syncDirectory(store.dataDir)
+}
+
+//Get decodes the snapshot stored under key into value. It reports false when no snapshot exists yet.
+func (store *Store) Get(key string, value interface{}) (bool, error) {
+	if store == nil {
+		return false, nil
+	}
+	store.storeLocker.Lock()
+	defer store.storeLocker.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(store.dataDir, key+snapshotExtension))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+//syncDirectory makes a rename durable by syncing the directory entry
+func syncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
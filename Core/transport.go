@@ -0,0 +1,186 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	UDP_BUFFER_SIZE     = 65536
+	CHANNEL_INBOX_SIZE  = 256
+	CHANNEL_BUFFER_SIZE = 65536
+)
+
+//ErrTransportClosed is returned by Receive once a transport has been closed
+var ErrTransportClosed = errors.New("Transport closed")
+
+//ErrDatagramTruncated is returned by Receive for datagrams that did not fit into the receive buffer
+var ErrDatagramTruncated = errors.New("Datagram truncated: exceeds receive buffer")
+
+//Transport abstracts the medium a gossiper uses to exchange packets with its peers
+type Transport interface {
+	Send(address string, data []byte) error
+	Receive() ([]byte, string, error)
+	LocalAddress() string
+	Close() error
+}
+
+//UDPTransport sends and receives datagrams over a UDP socket
+type UDPTransport struct {
+	conn    *net.UDPConn
+	address *net.UDPAddr
+}
+
+//NewUDPTransport binds a new UDP socket on the given address
+func NewUDPTransport(address string) (*UDPTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTransport{conn: udpConn, address: udpAddr}, nil
+}
+
+//Send writes a datagram to the given address
+func (t *UDPTransport) Send(address string, data []byte) error {
+	peerAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(data, peerAddress)
+	return err
+}
+
+//Receive blocks until a datagram arrives and returns it along with the sender's address
+func (t *UDPTransport) Receive() ([]byte, string, error) {
+	buf := make([]byte, UDP_BUFFER_SIZE)
+	n, udpAddr, err := t.conn.ReadFromUDP(buf)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return nil, "", ErrTransportClosed
+		}
+		return nil, "", err
+	}
+	if n == len(buf) {
+		return nil, udpAddr.String(), ErrDatagramTruncated
+	}
+	return buf[:n], udpAddr.String(), nil
+}
+
+//LocalAddress returns the address the socket is bound to
+func (t *UDPTransport) LocalAddress() string {
+	return t.address.String()
+}
+
+//Close releases the underlying socket
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+type datagram struct {
+	data   []byte
+	sender string
+}
+
+//ChannelNetwork connects ChannelTransports living in the same process
+type ChannelNetwork struct {
+	locker    sync.RWMutex
+	endpoints map[string]*ChannelTransport
+}
+
+//NewChannelNetwork creates an empty in-memory network
+func NewChannelNetwork() *ChannelNetwork {
+	return &ChannelNetwork{endpoints: make(map[string]*ChannelTransport)}
+}
+
+//NewTransport attaches a new endpoint with the given address to the network
+func (network *ChannelNetwork) NewTransport(address string) (*ChannelTransport, error) {
+	network.locker.Lock()
+	defer network.locker.Unlock()
+	if _, exists := network.endpoints[address]; exists {
+		return nil, errors.New("Address already in use: " + address)
+	}
+	transport := &ChannelTransport{
+		network: network,
+		address: address,
+		inbox:   make(chan datagram, CHANNEL_INBOX_SIZE),
+		closed:  make(chan struct{}),
+	}
+	network.endpoints[address] = transport
+	return transport, nil
+}
+
+func (network *ChannelNetwork) lookup(address string) (*ChannelTransport, bool) {
+	network.locker.RLock()
+	defer network.locker.RUnlock()
+	transport, ok := network.endpoints[address]
+	return transport, ok
+}
+
+func (network *ChannelNetwork) detach(address string) {
+	network.locker.Lock()
+	defer network.locker.Unlock()
+	delete(network.endpoints, address)
+}
+
+//ChannelTransport is an in-process transport delivering datagrams over channels.
+//Like UDP it gives no delivery guarantee: datagrams to unknown addresses or full inboxes are dropped.
+type ChannelTransport struct {
+	network   *ChannelNetwork
+	address   string
+	inbox     chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+//Send delivers a copy of data to the endpoint registered under address
+func (t *ChannelTransport) Send(address string, data []byte) error {
+	select {
+	case <-t.closed:
+		return ErrTransportClosed
+	default:
+	}
+	if len(data) > CHANNEL_BUFFER_SIZE {
+		return errors.New("Datagram exceeds maximum size")
+	}
+	destination, ok := t.network.lookup(address)
+	if !ok {
+		return nil
+	}
+	payload := make([]byte, len(data))
+	copy(payload, data)
+	select {
+	case destination.inbox <- datagram{data: payload, sender: t.address}:
+	case <-destination.closed:
+	default:
+	}
+	return nil
+}
+
+//Receive blocks until a datagram arrives or the transport is closed
+func (t *ChannelTransport) Receive() ([]byte, string, error) {
+	select {
+	case d := <-t.inbox:
+		return d.data, d.sender, nil
+	case <-t.closed:
+		return nil, "", ErrTransportClosed
+	}
+}
+
+//LocalAddress returns the address the endpoint is registered under
+func (t *ChannelTransport) LocalAddress() string {
+	return t.address
+}
+
+//Close detaches the endpoint from its network
+func (t *ChannelTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.network.detach(t.address)
+		close(t.closed)
+	})
+	return nil
+}
@@ -1,42 +1,164 @@
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
 	"sync"
+	"time"
 )
 
-//VectorClock structure
+//originClock records which IDs were received from one origin: every ID below next, plus the IDs received out of order above it.
+//signed is the highest ID of a signed rumour received from the origin, the proof that it published every ID up to there.
+//proof is that rumour, kept after its body is pruned so that peers told to skip pruned IDs can verify the origin published them.
+//reserved is the ID after the last one handed out for a message we originate, which may not be stored yet.
+type originClock struct {
+	next       uint32
+	outOfOrder map[uint32]bool
+	signed     uint32
+	proof      *RumourMessage
+	reserved   uint32
+}
+
+func newOriginClock() *originClock {
+	return &originClock{next: 1, outOfOrder: make(map[uint32]bool)}
+}
+
+func (clock *originClock) has(id uint32) bool {
+	return id < clock.next || clock.outOfOrder[id]
+}
+
+func (clock *originClock) add(id uint32) {
+	if clock.has(id) {
+		return
+	}
+	clock.outOfOrder[id] = true
+	clock.advance()
+}
+
+//advance moves the contiguous prefix over the out of order IDs that now follow it
+func (clock *originClock) advance() {
+	for clock.outOfOrder[clock.next] {
+		delete(clock.outOfOrder, clock.next)
+		clock.next++
+	}
+}
+
+//VectorClock structure. Message bodies are kept apart in Bodies, so pruning them does not change the clock.
 type VectorClock struct {
-	Locker sync.RWMutex
-	Stack  map[string]map[uint32]interface{}
+	clockLocker sync.RWMutex
+	origins     map[string]*originClock
+	Bodies      *MessageStore
 }
 
 //NewVectorClock constructor for vector clock
 func NewVectorClock() *VectorClock {
 	vClock := &VectorClock{
-		Stack: make(map[string]map[uint32]interface{}),
+		origins: make(map[string]*originClock),
+		Bodies:  NewMessageStore(),
 	}
 	return vClock
 }
 
-//GetStoredMessage retrieves a stored message from the Message Stack
+//Has reports whether a message was received, even if its body has since been pruned
+func (vClock *VectorClock) Has(origin string, ID uint32) bool {
+	vClock.clockLocker.RLock()
+	defer vClock.clockLocker.RUnlock()
+	clock, ok := vClock.origins[origin]
+	return ok && clock.has(ID)
+}
+
+//GetStoredMessage retrieves a stored message body, unless it was pruned
 func (vClock *VectorClock) GetStoredMessage(origin string, ID uint32) (interface{}, bool) {
-	vClock.Locker.RLock()
-	defer vClock.Locker.RUnlock()
-	v, ok := vClock.Stack[origin][ID]
-	return v, ok
+	content, ok := vClock.Bodies.Get(origin, ID)
+	if !ok {
+		return nil, false
+	}
+	return content.GetValue(), true
 }
 
-//StoreMessage stores a new message to the message stack
+//StoreMessage records a new message in the clock and stores its body
 func (vClock *VectorClock) StoreMessage(value Stackable) {
-	nextID := vClock.GetMaxIdFrom(value.GetOrigin())
-	vClock.Locker.Lock()
-	defer vClock.Locker.Unlock()
-	if nextID == 0 {
-		toAdd := map[uint32]interface{}{value.GetID(): value.GetValue()}
-		vClock.Stack[value.GetOrigin()] = toAdd
-	} else {
-		vClock.Stack[value.GetOrigin()][value.GetID()] = value.GetValue()
+	vClock.storeMessageAt(value, time.Now())
+}
+
+//storeMessageAt records a message stored at the given time, so that a restored body is pruned when it would have been
+func (vClock *VectorClock) storeMessageAt(value Stackable, stored time.Time) {
+	vClock.clockLocker.Lock()
+	clock, ok := vClock.origins[value.GetOrigin()]
+	if !ok {
+		clock = newOriginClock()
+		vClock.origins[value.GetOrigin()] = clock
+	}
+	clock.add(value.GetID())
+	if rumour, signed := value.(*RumourMessage); signed && value.GetID() > clock.signed {
+		clock.signed = value.GetID()
+		clock.proof = rumour
+	}
+	vClock.clockLocker.Unlock()
+	vClock.Bodies.PutAt(value, stored)
+}
+
+//ReserveID hands out the ID of a new message we originate as origin. The ID is not handed out again while the message is being
+//created and stored, so messages created concurrently get distinct IDs.
+func (vClock *VectorClock) ReserveID(origin string) uint32 {
+	vClock.clockLocker.Lock()
+	defer vClock.clockLocker.Unlock()
+	clock, ok := vClock.origins[origin]
+	if !ok {
+		clock = newOriginClock()
+		vClock.origins[origin] = clock
+	}
+	id := clock.next
+	if clock.reserved > id {
+		id = clock.reserved
+	}
+	for clock.outOfOrder[id] {
+		id++
+	}
+	clock.reserved = id + 1
+	return id
+}
+
+//Skip marks every ID from origin below nextID as received, and reports whether it did. Used for messages a peer pruned before we could get them.
+//Pruned hints are not signed, so the clock only moves past IDs up to a signed rumour of the origin: a peer cannot make us drop IDs the origin
+//never published. Peers send the proof of the origin along with their hints, it must be stored first.
+func (vClock *VectorClock) Skip(origin string, nextID uint32) bool {
+	vClock.clockLocker.Lock()
+	defer vClock.clockLocker.Unlock()
+	clock, ok := vClock.origins[origin]
+	if !ok || nextID <= clock.next || nextID > clock.signed+1 {
+		return false
+	}
+	for id := range clock.outOfOrder {
+		if id < nextID {
+			delete(clock.outOfOrder, id)
+		}
+	}
+	clock.next = nextID
+	clock.advance()
+	return true
+}
+
+//Proof returns the highest signed rumour received from origin, even if its body was pruned
+func (vClock *VectorClock) Proof(origin string) (*RumourMessage, bool) {
+	vClock.clockLocker.RLock()
+	defer vClock.clockLocker.RUnlock()
+	clock, ok := vClock.origins[origin]
+	if !ok || clock.proof == nil {
+		return nil, false
 	}
+	return clock.proof, true
+}
+
+//SetRetention sets how long message bodies are kept. Zero keeps them forever.
+func (vClock *VectorClock) SetRetention(retention time.Duration) {
+	vClock.Bodies.SetRetention(retention)
+}
+
+//Prune drops the message bodies older than the retention window and returns how many were dropped
+func (vClock *VectorClock) Prune(now time.Time) int {
+	return vClock.Bodies.Prune(now)
 }
 
 //IsInSyncWith : Check if vector clock is synchronized with another
@@ -69,57 +191,139 @@ func (vClock *VectorClock) CompareV2(vClockToCompare StatusPacket) ([]PeerStatus
 
 //GetMaxIdFrom returns the latest id from a given origin
 func (vClock *VectorClock) GetMaxIdFrom(origin string) uint32 {
-	vClock.Locker.RLock()
-	defer vClock.Locker.RUnlock()
-	allMessagesFromPeer, ok := vClock.Stack[origin]
+	vClock.clockLocker.RLock()
+	defer vClock.clockLocker.RUnlock()
+	clock, ok := vClock.origins[origin]
 	if !ok {
 		return 0
 	}
-	var maxID uint32
-	for maxID = range allMessagesFromPeer {
-		break
-	}
-	for n := range allMessagesFromPeer {
-		if n > maxID {
-			maxID = n
+	maxID := clock.next - 1
+	for id := range clock.outOfOrder {
+		if id > maxID {
+			maxID = id
 		}
 	}
 	return maxID
 }
 
-//GetNextIDFrom - If user exists get lnextatest message ID from vector clock, otherwise return 0
+//GetNextIDFrom - If user exists get next message ID from vector clock, otherwise return 1
 func (vClock *VectorClock) GetNextIDFrom(origin string) uint32 {
-	vClock.Locker.RLock()
-	defer vClock.Locker.RUnlock()
-	allMessagesFromPeer, ok := vClock.Stack[origin]
+	vClock.clockLocker.RLock()
+	defer vClock.clockLocker.RUnlock()
+	clock, ok := vClock.origins[origin]
 	if !ok {
 		return 1
 	}
-
-	return getNextID(allMessagesFromPeer)
-}
-
-func getNextID(messages map[uint32]interface{}) uint32 {
-	var i uint32
-	i = 1
-	ok := true
-	for {
-		if _, ok = messages[i]; !ok {
-			return i
-		}
-		i++
-	}
+	return clock.next
 }
 
 //GetCurrentStatus - Produce a want[] packet based on current vector clock status
 func (vClock *VectorClock) GetCurrentStatus() []PeerStatus {
 	var packet []PeerStatus
 
-	vClock.Locker.RLock()
-	defer vClock.Locker.RUnlock()
-	for k, v := range vClock.Stack {
-		toAdd := PeerStatus{Identifier: k, NextID: getNextID(v)}
+	vClock.clockLocker.RLock()
+	defer vClock.clockLocker.RUnlock()
+	for k, v := range vClock.origins {
+		toAdd := PeerStatus{Identifier: k, NextID: v.next}
 		packet = append(packet, toAdd)
 	}
 	return packet
 }
+
+//Digest hashes the current status, so that two peers can tell whether their clocks match without exchanging them
+func (vClock *VectorClock) Digest() []byte {
+	status := vClock.GetCurrentStatus()
+	sort.Slice(status, func(i, j int) bool { return status[i].Identifier < status[j].Identifier })
+	h := sha256.New()
+	for _, peerStatus := range status {
+		next := make([]byte, 4)
+		binary.LittleEndian.PutUint32(next, peerStatus.NextID)
+		h.Write([]byte(peerStatus.Identifier))
+		h.Write([]byte{0})
+		h.Write(next)
+	}
+	return h.Sum(nil)
+}
+
+//CollectMissing returns up to limit retained messages that a peer with the given status lacks, in ID order for each origin.
+//Origins missing from the status are treated as entirely unknown to the peer.
+//For origins whose next message the peer wants was pruned, it also returns the ID the peer should skip to.
+func (vClock *VectorClock) CollectMissing(status StatusPacket, limit int) ([]Stackable, []PeerStatus) {
+	wants := make(map[string]uint32)
+	for _, peerStatus := range status.Want {
+		wants[peerStatus.Identifier] = peerStatus.NextID
+	}
+
+	current := vClock.GetCurrentStatus()
+	sort.Slice(current, func(i, j int) bool { return current[i].Identifier < current[j].Identifier })
+	missing := []Stackable{}
+	pruned := []PeerStatus{}
+	for _, ours := range current {
+		from, known := wants[ours.Identifier]
+		if !known {
+			from = 1
+		}
+		if from >= ours.NextID {
+			continue
+		}
+		if _, retained := vClock.Bodies.Get(ours.Identifier, from); !retained {
+			skipTo, found := vClock.Bodies.FirstRetained(ours.Identifier, from)
+			if !found || skipTo > ours.NextID {
+				skipTo = ours.NextID
+			}
+			pruned = append(pruned, PeerStatus{Identifier: ours.Identifier, NextID: skipTo})
+			from = skipTo
+		}
+		for id := from; id < ours.NextID && len(missing) < limit; id++ {
+			content, retained := vClock.Bodies.Get(ours.Identifier, id)
+			if !retained {
+				//Pruned in the middle of the range, the peer learns to skip it on the next exchange
+				break
+			}
+			missing = append(missing, content)
+		}
+	}
+	return missing, pruned
+}
+
+//originSnapshot is the persisted form of an originClock
+type originSnapshot struct {
+	Next       uint32
+	OutOfOrder []uint32       `json:",omitempty"`
+	Signed     uint32         `json:",omitempty"`
+	Proof      *RumourMessage `json:",omitempty"`
+}
+
+func (vClock *VectorClock) snapshot() map[string]originSnapshot {
+	vClock.clockLocker.RLock()
+	defer vClock.clockLocker.RUnlock()
+	origins := make(map[string]originSnapshot)
+	for origin, clock := range vClock.origins {
+		saved := originSnapshot{Next: clock.next, Signed: clock.signed, Proof: clock.proof}
+		for id := range clock.outOfOrder {
+			saved.OutOfOrder = append(saved.OutOfOrder, id)
+		}
+		origins[origin] = saved
+	}
+	return origins
+}
+
+func (vClock *VectorClock) restore(origins map[string]originSnapshot) {
+	vClock.clockLocker.Lock()
+	defer vClock.clockLocker.Unlock()
+	for origin, saved := range origins {
+		clock := newOriginClock()
+		clock.signed = saved.Signed
+		clock.proof = saved.Proof
+		if saved.Next > 1 {
+			clock.next = saved.Next
+		}
+		for _, id := range saved.OutOfOrder {
+			if id >= clock.next {
+				clock.outOfOrder[id] = true
+			}
+		}
+		clock.advance()
+		vClock.origins[origin] = clock
+	}
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCollectMissing(t *testing.T) {
+	cases := []struct {
+		name    string
+		stored  map[string]uint32
+		pruned  map[string][]uint32
+		want    []PeerStatus
+		limit   int
+		missing []string
+		skips   []PeerStatus
+	}{
+		{
+			name:    "peer in sync",
+			stored:  map[string]uint32{"A": 2},
+			want:    []PeerStatus{{Identifier: "A", NextID: 3}},
+			limit:   10,
+			missing: []string{},
+		},
+		{
+			name:    "unknown origins are sent from the start",
+			stored:  map[string]uint32{"A": 2, "B": 1},
+			want:    []PeerStatus{{Identifier: "A", NextID: 2}},
+			limit:   10,
+			missing: []string{"A2", "B1"},
+		},
+		{
+			name:    "limit applies across origins",
+			stored:  map[string]uint32{"A": 3, "B": 3},
+			limit:   4,
+			missing: []string{"A1", "A2", "A3", "B1"},
+		},
+		{
+			name:    "pruned head is skipped",
+			stored:  map[string]uint32{"A": 4},
+			pruned:  map[string][]uint32{"A": {1, 2}},
+			limit:   10,
+			missing: []string{"A3", "A4"},
+			skips:   []PeerStatus{{Identifier: "A", NextID: 3}},
+		},
+		{
+			name:    "everything pruned skips to the end",
+			stored:  map[string]uint32{"A": 2},
+			pruned:  map[string][]uint32{"A": {1, 2}},
+			limit:   10,
+			missing: []string{},
+			skips:   []PeerStatus{{Identifier: "A", NextID: 3}},
+		},
+		{
+			name:    "pruned in the middle stops at the gap",
+			stored:  map[string]uint32{"A": 4},
+			pruned:  map[string][]uint32{"A": {3}},
+			limit:   10,
+			missing: []string{"A1", "A2"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vClock := NewVectorClock()
+			for origin, count := range c.stored {
+				for id := uint32(1); id <= count; id++ {
+					vClock.StoreMessage(NewRumourMessage(id, "", origin))
+				}
+			}
+			dropBodies(vClock, c.pruned)
+			missing, skips := vClock.CollectMissing(StatusPacket{Want: c.want}, c.limit)
+			got := []string{}
+			for _, content := range missing {
+				got = append(got, content.GetOrigin()+string(rune('0'+content.GetID())))
+			}
+			if !reflect.DeepEqual(got, c.missing) {
+				t.Errorf("got missing %v, want %v", got, c.missing)
+			}
+			if len(skips) != 0 || len(c.skips) != 0 {
+				if !reflect.DeepEqual(skips, c.skips) {
+					t.Errorf("got skips %v, want %v", skips, c.skips)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipOnlyUpToSignedRumours(t *testing.T) {
+	vClock := NewVectorClock()
+	vClock.StoreMessage(NewRumourMessage(1, "", "A"))
+	vClock.StoreMessage(NewRumourMessage(5, "", "A"))
+	if vClock.Skip("A", 7) || vClock.Skip("B", 2) {
+		t.Fatal("skipped past the last signed rumour")
+	}
+	if !vClock.Skip("A", 6) || vClock.GetNextIDFrom("A") != 6 {
+		t.Fatalf("got next ID %d, want 6", vClock.GetNextIDFrom("A"))
+	}
+}
+
+func TestSkipSilentOriginWithProof(t *testing.T) {
+	holder := NewVectorClock()
+	for id := uint32(1); id <= 3; id++ {
+		holder.StoreMessage(NewRumourMessage(id, "", "A"))
+	}
+	dropBodies(holder, map[string][]uint32{"A": {1, 2, 3}})
+	_, skips := holder.CollectMissing(StatusPacket{}, 10)
+	proof, ok := holder.Proof("A")
+	if !ok || proof.ID != 3 {
+		t.Fatalf("got proof %v, want the rumour with ID 3 kept after pruning", proof)
+	}
+
+	joiner := NewVectorClock()
+	if joiner.Skip("A", skips[0].NextID) {
+		t.Fatal("skipped without the proof of the origin")
+	}
+	joiner.StoreMessage(proof)
+	if !joiner.Skip("A", skips[0].NextID) || joiner.GetNextIDFrom("A") != 4 {
+		t.Fatalf("got next ID %d, want 4", joiner.GetNextIDFrom("A"))
+	}
+}
+
+func TestReserveID(t *testing.T) {
+	vClock := NewVectorClock()
+	first, second := vClock.ReserveID("A"), vClock.ReserveID("A")
+	if first != 1 || second != 2 {
+		t.Fatalf("got IDs %d and %d, want 1 and 2", first, second)
+	}
+	vClock.StoreMessage(NewRumourMessage(first, "", "A"))
+	vClock.StoreMessage(NewRumourMessage(4, "", "A"))
+	if third := vClock.ReserveID("A"); third != 3 {
+		t.Fatalf("got ID %d, want 3", third)
+	}
+	if fourth := vClock.ReserveID("A"); fourth != 5 {
+		t.Fatalf("got ID %d, want 5 past the one received out of order", fourth)
+	}
+}
+
+//dropBodies prunes the given message bodies while the clock keeps them as received
+func dropBodies(vClock *VectorClock, pruned map[string][]uint32) {
+	for origin, ids := range pruned {
+		for _, id := range ids {
+			vClock.Bodies.bodies[origin][id].stored = time.Time{}
+		}
+	}
+	vClock.SetRetention(time.Hour)
+	vClock.Prune(time.Now())
+	vClock.SetRetention(0)
+}
@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	EXCHANGE_SAMPLE_SIZE = 8
+	MAX_EXCHANGE_SIZE    = 32
+	MAX_ACCEPTED_PEERS   = 8
+	MAX_KNOWN_PEERS      = 64
+	DEFAULT_WINDOW       = 10 * time.Second
+)
+
+//Discoverer periodically gossips a sample of known peer addresses and learns new peers from the samples it receives
+type Discoverer struct {
+	ctx             *core.Context
+	discoveryLocker sync.Mutex
+	window          time.Duration
+	exchanging      bool
+	windowStart     time.Time
+	acceptedPeers   int
+}
+
+//NewDiscoverer creates a discoverer exchanging peers every intervalSeconds and accepting at most MAX_ACCEPTED_PEERS new peers per interval,
+//as long as fewer than MAX_KNOWN_PEERS peers are known. Discovered peers are forgotten once they stay dead.
+//Zero disables the periodic exchange, incoming samples are still answered.
+func NewDiscoverer(cntx *core.Context, intervalSeconds int) *Discoverer {
+	discoverer := &Discoverer{ctx: cntx, window: DEFAULT_WINDOW}
+	discoverer.registerPacketKinds()
+	if intervalSeconds > 0 {
+		discoverer.window = time.Duration(intervalSeconds) * time.Second
+		discoverer.exchanging = true
+	}
+	return discoverer
+}
+
+func (discoverer *Discoverer) registerPacketKinds() {
+	err := discoverer.ctx.Registry.Register(core.PacketKind{
+		Type:    core.PEER_EXCHANGE,
+		Name:    "PeerExchange",
+		Present: func(packet *core.GossipPacket) bool { return packet.PeerExchange != nil },
+		Validate: func(packet *core.GossipPacket) error {
+			if len(packet.PeerExchange.Peers) > MAX_EXCHANGE_SIZE {
+				return errors.New("too many peers in exchange")
+			}
+			return nil
+		},
+		Handle: discoverer.HandlePeerExchange,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Start exchanges peers every interval, if the periodic exchange is enabled, until the context is stopped
+func (discoverer *Discoverer) Start() {
+	if !discoverer.exchanging {
+		return
+	}
+	ticker := time.NewTicker(discoverer.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-discoverer.ctx.Done():
+			return
+		}
+		peer := core.RandomPeer(discoverer.ctx, "")
+		if len(peer) == 0 {
+			continue
+		}
+		discoverer.sendSample(peer, true)
+	}
+}
+
+//HandlePeerExchange adds the unknown addresses of a received sample, within the per interval limit, and answers requests with a sample of our own
+func (discoverer *Discoverer) HandlePeerExchange(packet core.GossipPacket, sender string) {
+	exchange := packet.PeerExchange
+	for _, address := range exchange.Peers {
+		if !discoverer.isCandidate(address, sender) {
+			continue
+		}
+		if !discoverer.reserveSlot() {
+			break
+		}
+		if discoverer.ctx.PeerManager.LearnWithin(address, MAX_KNOWN_PEERS) {
+			fmt.Println("DISCOVERED peer", address, "from", sender)
+		}
+	}
+	if exchange.Request {
+		discoverer.sendSample(sender, false)
+	}
+}
+
+func (discoverer *Discoverer) sendSample(peer string, request bool) {
+	candidates := []string{}
+	for _, known := range discoverer.ctx.GetPeers() {
+		if strings.Compare(known, peer) != 0 {
+			candidates = append(candidates, known)
+		}
+	}
+	sampleSize := EXCHANGE_SAMPLE_SIZE
+	if sampleSize > len(candidates) {
+		sampleSize = len(candidates)
+	}
+	exchange := &core.PeerExchange{
+		Peers:   core.RandomPeers(sampleSize, candidates),
+		Request: request,
+	}
+	go discoverer.ctx.SendPacketToPeer(core.GossipPacket{PeerExchange: exchange}, peer)
+}
+
+//isCandidate filters out malformed addresses, our own address and peers we already know
+func (discoverer *Discoverer) isCandidate(address, sender string) bool {
+	if strings.Compare(address, sender) == 0 || strings.Compare(address, discoverer.ctx.Address.String()) == 0 {
+		return false
+	}
+	if _, known := discoverer.ctx.PeerManager.GetState(address); known {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || len(port) == 0 || net.ParseIP(host) == nil {
+		return false
+	}
+	return true
+}
+
+func (discoverer *Discoverer) reserveSlot() bool {
+	discoverer.discoveryLocker.Lock()
+	defer discoverer.discoveryLocker.Unlock()
+	if now := time.Now(); now.Sub(discoverer.windowStart) > discoverer.window {
+		discoverer.windowStart = now
+		discoverer.acceptedPeers = 0
+	}
+	if discoverer.acceptedPeers >= MAX_ACCEPTED_PEERS {
+		return false
+	}
+	discoverer.acceptedPeers++
+	return true
+}
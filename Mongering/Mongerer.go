@@ -1,8 +1,10 @@
 package mongering
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"math/rand"
+	"log"
 	"strings"
 	"sync"
 	"time"
@@ -10,67 +12,207 @@ import (
 	core "github.com/ksei/Peerster/Core"
 )
 
+const (
+	//MAX_BATCH_SIZE bounds the number of messages carried by a single MessageBatch
+	MAX_BATCH_SIZE = 256
+	//DEFAULT_ACK_TIMEOUT is how long a mongering session waits for the peer's status by default
+	DEFAULT_ACK_TIMEOUT = 10 * time.Second
+)
+
+//BatchReceiver stores a message that arrived in a MessageBatch. It must not acknowledge or monger it,
+//the batch is acknowledged once all its messages are stored.
+type BatchReceiver func(packet core.GossipPacket, sender string)
+
+//Mongerer spreads rumours and TLC messages. Every message sent to a peer is a session of its own, acknowledged by a status from that peer.
 type Mongerer struct {
-	ctx                         *core.Context
-	acknowledgementChannel      chan *core.InternalPacket
-	ackLocker                   sync.RWMutex
-	awaitingAcknowledgementFrom map[string]bool
+	ctx            *core.Context
+	sessionLocker  sync.Mutex
+	sessions       map[string][]*mongeringSession
+	batchSize      int
+	strategy       Strategy
+	ackTimeout     time.Duration
+	receiverLocker sync.RWMutex
+	batchReceivers map[int]BatchReceiver
 }
 
-func NewMongerer(cntx *core.Context, antiEntropy int) *Mongerer {
+//NewMongerer creates a mongerer spreading messages with the given strategy, anti entropy runs once StartAntiEntropy is called.
+//With a positive batchSize, anti entropy exchanges digests and streams up to batchSize missing messages per status instead of one.
+//A nil strategy defaults to the coin flip, a zero ackTimeout to DEFAULT_ACK_TIMEOUT.
+func NewMongerer(cntx *core.Context, batchSize int, strategy Strategy, ackTimeout time.Duration) *Mongerer {
+	if batchSize > MAX_BATCH_SIZE {
+		batchSize = MAX_BATCH_SIZE
+	}
+	if strategy == nil {
+		strategy = &CoinFlip{}
+	}
+	if ackTimeout <= 0 {
+		ackTimeout = DEFAULT_ACK_TIMEOUT
+	}
 	mongerer := &Mongerer{
-		acknowledgementChannel:      make(chan *core.InternalPacket, 50),
-		awaitingAcknowledgementFrom: make(map[string]bool),
+		sessions:       make(map[string][]*mongeringSession),
+		batchSize:      batchSize,
+		strategy:       strategy,
+		ackTimeout:     ackTimeout,
+		batchReceivers: make(map[int]BatchReceiver),
 	}
 	mongerer.ctx = cntx
-	go mongerer.StartAntiEntropy(antiEntropy)
+	mongerer.registerPacketKinds()
 	return mongerer
 }
 
+func (mongerer *Mongerer) registerPacketKinds() {
+	kinds := []core.PacketKind{
+		{
+			Type:    core.STATUS_PACKET,
+			Name:    "StatusPacket",
+			Present: func(packet *core.GossipPacket) bool { return packet.Status != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				for _, peerStatus := range packet.Status.Want {
+					if len(peerStatus.Identifier) == 0 || peerStatus.NextID == 0 {
+						return errors.New("malformed peer status")
+					}
+				}
+				return nil
+			},
+			Handle: mongerer.HandleStatusPacket,
+		},
+		{
+			Type:    core.MESSAGE_BATCH,
+			Name:    "MessageBatch",
+			Present: func(packet *core.GossipPacket) bool { return packet.Batch != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.Batch.Rumours)+len(packet.Batch.TLCs) > MAX_BATCH_SIZE {
+					return errors.New("too many messages in batch")
+				}
+				for _, rumour := range packet.Batch.Rumours {
+					if rumour == nil {
+						return errors.New("empty rumour in batch")
+					}
+				}
+				for _, tlcMessage := range packet.Batch.TLCs {
+					if tlcMessage == nil {
+						return errors.New("empty TLC message in batch")
+					}
+				}
+				for _, peerStatus := range packet.Batch.Pruned {
+					if len(peerStatus.Identifier) == 0 || peerStatus.NextID == 0 {
+						return errors.New("malformed pruned status")
+					}
+				}
+				return nil
+			},
+			Handle: mongerer.HandleMessageBatch,
+		},
+	}
+	for _, kind := range kinds {
+		if err := mongerer.ctx.Registry.Register(kind); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+//RegisterBatchReceiver sets the receiver storing batched messages of the given packet type
+func (mongerer *Mongerer) RegisterBatchReceiver(packetType int, receiver BatchReceiver) {
+	mongerer.receiverLocker.Lock()
+	defer mongerer.receiverLocker.Unlock()
+	mongerer.batchReceivers[packetType] = receiver
+}
+
+//Spread starts mongering a new message with the peers chosen by the strategy, avoiding the peer it was received from
+func (mongerer *Mongerer) Spread(content core.Stackable, sender string) {
+	for _, peer := range mongerer.strategy.Initial(mongerer.ctx.GetPeers(), sender) {
+		go mongerer.monger(content, peer, 1)
+	}
+}
+
+//StartMongering mongers content with the given peer, then lets the strategy decide whether to carry on with others
 func (mongerer *Mongerer) StartMongering(content core.Stackable, peer string) {
+	mongerer.monger(content, peer, 1)
+}
+
+func (mongerer *Mongerer) monger(content core.Stackable, peer string, round int) {
 	// fmt.Println("MONGERING with", peer)
+	if len(peer) == 0 {
+		return
+	}
+	session, started := mongerer.openSession(peer, content)
+	if !started {
+		return
+	}
 	gossipPacket := core.CreateGossipPacket(content)
-	mongerer.ackLocker.Lock()
-	mongerer.awaitingAcknowledgementFrom[peer] = true
-	mongerer.ackLocker.Unlock()
 	go mongerer.ctx.SendPacketToPeer(gossipPacket, peer)
-	for {
-		select {
-		case acknowledged := <-mongerer.acknowledgementChannel:
-			if strings.Compare(peer, acknowledged.Sender) != 0 {
-				continue
-			}
-			mongerer.ackLocker.Lock()
-			mongerer.awaitingAcknowledgementFrom[peer] = false
-			mongerer.ackLocker.Unlock()
-			// printStatus(acknowledged.Sender, acknowledged.Packet.Status.Want)
-			if !mongerer.ctx.VectorClock.IsInSyncWith(*acknowledged.Packet.Status) {
-				go mongerer.syncStatuses(*acknowledged.Packet.Status, acknowledged.Sender)
-			} else {
-				// fmt.Println("IN SYNC WITH", acknowledged.Sender)
-				go mongerer.flipCoin(content, peer)
+	if mongerer.strategy.Pull() {
+		go mongerer.Acknowledge(peer)
+	}
+	select {
+	case inSync := <-session.acked:
+		if inSync {
+			// fmt.Println("IN SYNC WITH", peer)
+			go mongerer.continueMongering(content, peer, round)
+		}
+	case <-time.After(mongerer.ackTimeout):
+		if !mongerer.closeSession(session) {
+			//Acknowledged just as the timeout fired
+			if <-session.acked {
+				go mongerer.continueMongering(content, peer, round)
 			}
 			return
-		case <-time.After(10 * time.Second):
-			mongerer.ackLocker.Lock()
-			mongerer.awaitingAcknowledgementFrom[peer] = false
-			mongerer.ackLocker.Unlock()
-			go mongerer.flipCoin(content, peer)
-			return
 		}
+		fmt.Println("MONGERING TIMEOUT with", peer, "origin", content.GetOrigin(), "ID", content.GetID())
+		go mongerer.continueMongering(content, peer, round)
 	}
 }
 
+//HandleStatusPacket acknowledges the mongering sessions with the sender that the status answers, and syncs with the sender if needed
 func (mongerer *Mongerer) HandleStatusPacket(packet core.GossipPacket, sender string) {
-	mongerer.ackLocker.RLock()
-	waiting, ok := mongerer.awaitingAcknowledgementFrom[sender]
-	waiting = ok && waiting
-	mongerer.ackLocker.RUnlock()
-	if waiting {
-		mongerer.acknowledgementChannel <- &core.InternalPacket{Packet: packet, Sender: sender}
-	} else if !mongerer.ctx.VectorClock.IsInSyncWith(*packet.Status) {
+	if status := packet.Status; len(status.Want) == 0 && len(status.Digest) > 0 {
+		if !bytes.Equal(status.Digest, mongerer.ctx.VectorClock.Digest()) {
+			go mongerer.Acknowledge(sender)
+		}
+		return
+	}
+	// printStatus(sender, packet.Status.Want)
+	inSync := mongerer.isInSyncWith(*packet.Status)
+	if !inSync {
 		go mongerer.syncStatuses(*packet.Status, sender)
 	}
+	for _, session := range mongerer.acknowledgeSessions(sender, *packet.Status) {
+		session.acked <- inSync
+	}
+}
+
+//HandleMessageBatch stores every valid message of a batch, skips the messages the sender pruned and answers with a single status.
+//The messages are stored first, since a pruned hint is only followed up to a signed rumour of its origin.
+func (mongerer *Mongerer) HandleMessageBatch(packet core.GossipPacket, sender string) {
+	for _, rumour := range packet.Batch.Rumours {
+		mongerer.receiveBatched(core.GossipPacket{Rumor: rumour}, sender)
+	}
+	for _, tlcMessage := range packet.Batch.TLCs {
+		mongerer.receiveBatched(core.GossipPacket{TLCMessage: tlcMessage}, sender)
+	}
+	for _, peerStatus := range packet.Batch.Pruned {
+		if strings.Compare(peerStatus.Identifier, mongerer.ctx.Name) == 0 {
+			continue
+		}
+		if mongerer.ctx.VectorClock.Skip(peerStatus.Identifier, peerStatus.NextID) {
+			fmt.Println("SKIPPING pruned messages origin", peerStatus.Identifier, "up to ID", peerStatus.NextID, "from", sender)
+		}
+	}
+	mongerer.Acknowledge(sender)
+}
+
+func (mongerer *Mongerer) receiveBatched(packet core.GossipPacket, sender string) {
+	kind, err := mongerer.ctx.Registry.Admit(&packet, sender, mongerer.ctx.SimpleMode)
+	if err != nil {
+		fmt.Println("Dropping batched message:", err)
+		return
+	}
+	mongerer.receiverLocker.RLock()
+	receiver, ok := mongerer.batchReceivers[kind.Type]
+	mongerer.receiverLocker.RUnlock()
+	if ok {
+		receiver(packet, sender)
+	}
 }
 
 func (mongerer *Mongerer) Acknowledge(peer string) {
@@ -79,24 +221,48 @@ func (mongerer *Mongerer) Acknowledge(peer string) {
 	go mongerer.ctx.SendPacketToPeer(*gossipPacket, peer)
 }
 
+//Authenticate verifies the signature of a rumour before it is stored or used for routing, rejecting forged ones
+func (mongerer *Mongerer) Authenticate(rumour *core.RumourMessage) bool {
+	if err := mongerer.ctx.KeyRing.VerifyRumour(rumour); err != nil {
+		fmt.Println("REJECTED rumour origin", rumour.Origin, "ID", rumour.ID, ":", err)
+		return false
+	}
+	return true
+}
+
 func (mongerer *Mongerer) messageExists(rumour core.RumourMessage) bool {
-	_, ok := mongerer.ctx.VectorClock.GetStoredMessage(rumour.Origin, rumour.ID)
-	return ok
+	return mongerer.ctx.VectorClock.Has(rumour.Origin, rumour.ID)
+}
+
+//isInSyncWith also looks for origins missing from the peer status when batching, since batches can send them
+func (mongerer *Mongerer) isInSyncWith(statusPacket core.StatusPacket) bool {
+	if !mongerer.ctx.VectorClock.IsInSyncWith(statusPacket) {
+		return false
+	}
+	if mongerer.batchSize == 0 {
+		return true
+	}
+	missing, pruned := mongerer.ctx.VectorClock.CollectMissing(statusPacket, 1)
+	return len(missing) == 0 && len(pruned) == 0
 }
 
 func (mongerer *Mongerer) syncStatuses(statusPacket core.StatusPacket, sender string) {
+	if mongerer.batchSize > 0 {
+		mongerer.syncBatch(statusPacket, sender)
+		return
+	}
 	have, need := mongerer.ctx.VectorClock.CompareV2(statusPacket)
 
 	if len(have) > 0 {
-		mongerer.ctx.VectorClock.Locker.RLock()
-		var content core.Stackable
-		switch mongerer.ctx.VectorClock.Stack[have[0].Identifier][have[0].NextID].(type) {
-		case string:
-			content = core.NewRumourMessage(have[0].NextID, mongerer.ctx.VectorClock.Stack[have[0].Identifier][have[0].NextID].(string), have[0].Identifier)
-		case *core.TLCMessage:
-			content = mongerer.ctx.VectorClock.Stack[have[0].Identifier][have[0].NextID].(*core.TLCMessage)
+		content, retained := mongerer.ctx.VectorClock.Bodies.Get(have[0].Identifier, have[0].NextID)
+		if !retained {
+			//Tell the peer which pruned messages it will not get from us
+			_, pruned := mongerer.ctx.VectorClock.CollectMissing(statusPacket, 0)
+			batch := &core.MessageBatch{Rumours: []*core.RumourMessage{}, TLCs: []*core.TLCMessage{}, Pruned: pruned}
+			mongerer.attachProofs(batch)
+			go mongerer.ctx.SendPacketToPeer(core.GossipPacket{Batch: batch}, sender)
+			return
 		}
-		mongerer.ctx.VectorClock.Locker.RUnlock()
 		go mongerer.StartMongering(content, sender)
 	} else {
 		statusPacket := &core.StatusPacket{Want: need}
@@ -105,28 +271,93 @@ func (mongerer *Mongerer) syncStatuses(statusPacket core.StatusPacket, sender st
 	}
 }
 
-func (mongerer *Mongerer) flipCoin(content core.Stackable, previousPeer string) {
-	continueMongering := rand.Intn(2) == 1
-	if continueMongering {
-		randomPeer := core.RandomPeer(mongerer.ctx, previousPeer)
-		// fmt.Println("FLIPPED COIN sending rumor to", randomPeer)
-		go mongerer.StartMongering(content, randomPeer)
+//syncBatch streams a batch of the messages the peer is missing, or asks for the ones we are missing once the peer has all of ours
+func (mongerer *Mongerer) syncBatch(statusPacket core.StatusPacket, sender string) {
+	missing, pruned := mongerer.ctx.VectorClock.CollectMissing(statusPacket, mongerer.batchSize)
+	if len(missing) > 0 || len(pruned) > 0 {
+		batch := &core.MessageBatch{Rumours: []*core.RumourMessage{}, TLCs: []*core.TLCMessage{}, Pruned: pruned}
+		for _, content := range missing {
+			switch message := content.(type) {
+			case *core.RumourMessage:
+				batch.Rumours = append(batch.Rumours, message)
+			case *core.TLCMessage:
+				batch.TLCs = append(batch.TLCs, message)
+			}
+		}
+		mongerer.attachProofs(batch)
+		go mongerer.ctx.SendPacketToPeer(core.GossipPacket{Batch: batch}, sender)
+		return
+	}
+	//Ask with our full status: the peer batches every origin missing from it as if we had none of its messages
+	if _, need := mongerer.ctx.VectorClock.CompareV2(statusPacket); len(need) > 0 {
+		mongerer.Acknowledge(sender)
 	}
 }
 
+//attachProofs adds to a batch the highest signed rumour of every origin it has a pruned hint for, which the peer needs to follow the hint.
+//Hints whose proof does not fit in the batch are left for the next exchange.
+func (mongerer *Mongerer) attachProofs(batch *core.MessageBatch) {
+	kept := batch.Pruned[:0]
+	for _, peerStatus := range batch.Pruned {
+		proof, ok := mongerer.ctx.VectorClock.Proof(peerStatus.Identifier)
+		if ok && !hasRumour(batch, proof) {
+			if len(batch.Rumours)+len(batch.TLCs) >= MAX_BATCH_SIZE {
+				continue
+			}
+			batch.Rumours = append(batch.Rumours, proof)
+		}
+		kept = append(kept, peerStatus)
+	}
+	batch.Pruned = kept
+}
+
+func hasRumour(batch *core.MessageBatch, rumour *core.RumourMessage) bool {
+	for _, batched := range batch.Rumours {
+		if batched.Origin == rumour.Origin && batched.ID == rumour.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (mongerer *Mongerer) continueMongering(content core.Stackable, previousPeer string, round int) {
+	for _, peer := range mongerer.strategy.Continue(mongerer.ctx.GetPeers(), previousPeer, round) {
+		// fmt.Println("FLIPPED COIN sending rumor to", peer)
+		go mongerer.monger(content, peer, round+1)
+	}
+}
+
+//StartAntiEntropy exchanges statuses with a random peer every waitPeriodSeconds until the context is stopped
 func (mongerer *Mongerer) StartAntiEntropy(waitPeriodSeconds int) {
-	if mongerer.ctx.SimpleMode || waitPeriodSeconds == 0 || len(mongerer.ctx.Peers) == 0 {
+	if mongerer.ctx.SimpleMode || waitPeriodSeconds == 0 {
 		return
 	}
+	ticker := time.NewTicker(time.Duration(waitPeriodSeconds) * time.Second)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Duration(waitPeriodSeconds) * time.Second)
+		select {
+		case <-ticker.C:
+		case <-mongerer.ctx.Done():
+			return
+		}
 		if len(mongerer.ctx.GetPeers()) == 0 {
 			continue
 		}
-		go mongerer.Acknowledge(core.RandomPeer(mongerer.ctx, ""))
+		peer := core.RandomPeer(mongerer.ctx, "")
+		if mongerer.batchSize > 0 {
+			go mongerer.sendDigest(peer)
+		} else {
+			go mongerer.Acknowledge(peer)
+		}
 	}
 }
 
+//sendDigest starts an anti entropy exchange with a digest of our status, the peer answers with its full status only if they differ
+func (mongerer *Mongerer) sendDigest(peer string) {
+	statusPacket := &core.StatusPacket{Digest: mongerer.ctx.VectorClock.Digest()}
+	mongerer.ctx.SendPacketToPeer(core.GossipPacket{Status: statusPacket}, peer)
+}
+
 func (mongerer *Mongerer) GetContext() *core.Context {
 	return mongerer.ctx
 }
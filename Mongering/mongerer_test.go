@@ -0,0 +1,108 @@
+package mongering
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/protobuf"
+	core "github.com/ksei/Peerster/Core"
+)
+
+//silentStrategy never carries on mongering once a session ends
+type silentStrategy struct{}
+
+func (strategy *silentStrategy) Initial(peers []string, sender string) []string { return nil }
+func (strategy *silentStrategy) Continue(peers []string, previousPeer string, round int) []string {
+	return nil
+}
+func (strategy *silentStrategy) Pull() bool { return false }
+
+//startMongerer runs a mongerer on an in-process network, with a receiver that stores rumours and answers them with a status
+func startMongerer(t *testing.T, network *core.ChannelNetwork, address, name string) *Mongerer {
+	transport, err := network.NewTransport(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := core.CreateContextWithTransport(transport, name, "", false, false, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mongerer := NewMongerer(ctx, 0, &silentStrategy{}, time.Minute)
+	err = ctx.Registry.Register(core.PacketKind{
+		Type:    core.RUMOUR_MESSAGE,
+		Name:    "RumourMessage",
+		Present: func(packet *core.GossipPacket) bool { return packet.Rumor != nil },
+		Handle: func(packet core.GossipPacket, sender string) {
+			ctx.VectorClock.StoreMessage(packet.Rumor)
+			mongerer.Acknowledge(sender)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			buf, sender, err := ctx.GetTransport().Receive()
+			if err == core.ErrTransportClosed {
+				return
+			}
+			packet := core.GossipPacket{}
+			if err == nil && protobuf.Decode(buf, &packet) == nil {
+				ctx.Registry.Dispatch(packet, sender, false)
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		ctx.Stop()
+		ctx.GetTransport().Close()
+	})
+	return mongerer
+}
+
+func TestConcurrentSessionsAreAllAcknowledged(t *testing.T) {
+	const burst = 30
+	network := core.NewChannelNetwork()
+	mongerer := startMongerer(t, network, "10.0.0.1:5000", "A")
+	startMongerer(t, network, "10.0.0.2:5000", "B")
+
+	rumours := []*core.RumourMessage{}
+	for id := uint32(1); id <= burst; id++ {
+		rumour := core.NewRumourMessage(id, "burst", "A")
+		mongerer.ctx.VectorClock.StoreMessage(rumour)
+		rumours = append(rumours, rumour)
+	}
+	var wg sync.WaitGroup
+	for _, rumour := range rumours {
+		wg.Add(1)
+		go func(rumour *core.RumourMessage) {
+			defer wg.Done()
+			mongerer.StartMongering(rumour, "10.0.0.2:5000")
+		}(rumour)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	//The sessions only return before the one minute ack timeout if their status reached them
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("mongering sessions lost their acknowledgement")
+	}
+	//Statuses received meanwhile may have started syncing sessions of their own, they are acknowledged too
+	deadline := time.Now().Add(10 * time.Second)
+	for open := openSessions(mongerer, "10.0.0.2:5000"); open > 0; open = openSessions(mongerer, "10.0.0.2:5000") {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions left open", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openSessions(mongerer *Mongerer, peer string) int {
+	mongerer.sessionLocker.Lock()
+	defer mongerer.sessionLocker.Unlock()
+	return len(mongerer.sessions[peer])
+}
@@ -0,0 +1,81 @@
+package mongering
+
+import (
+	core "github.com/ksei/Peerster/Core"
+)
+
+type sessionKey struct {
+	peer   string
+	origin string
+	id     uint32
+}
+
+//mongeringSession is one message waiting for a status from one peer. The status tells whether we are in sync with that peer.
+type mongeringSession struct {
+	key   sessionKey
+	acked chan bool
+}
+
+//openSession registers a session for sending content to peer. Returns false if that message is already being mongered with that peer.
+func (mongerer *Mongerer) openSession(peer string, content core.Stackable) (*mongeringSession, bool) {
+	key := sessionKey{peer: peer, origin: content.GetOrigin(), id: content.GetID()}
+	mongerer.sessionLocker.Lock()
+	defer mongerer.sessionLocker.Unlock()
+	for _, session := range mongerer.sessions[peer] {
+		if session.key == key {
+			return nil, false
+		}
+	}
+	session := &mongeringSession{key: key, acked: make(chan bool, 1)}
+	mongerer.sessions[peer] = append(mongerer.sessions[peer], session)
+	return session, true
+}
+
+//closeSession removes a session that timed out. Returns false if a status acknowledged it in the meantime.
+func (mongerer *Mongerer) closeSession(closing *mongeringSession) bool {
+	mongerer.sessionLocker.Lock()
+	defer mongerer.sessionLocker.Unlock()
+	sessions := mongerer.sessions[closing.key.peer]
+	for i, session := range sessions {
+		if session == closing {
+			mongerer.setSessions(closing.key.peer, append(sessions[:i:i], sessions[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+//acknowledgeSessions removes and returns the sessions with peer that a status from it acknowledges: every session whose message the peer now has.
+//A message a gap keeps out of the peer's vector clock is not acknowledged, its session times out instead.
+func (mongerer *Mongerer) acknowledgeSessions(peer string, status core.StatusPacket) []*mongeringSession {
+	wants := make(map[string]uint32)
+	for _, peerStatus := range status.Want {
+		wants[peerStatus.Identifier] = peerStatus.NextID
+	}
+
+	mongerer.sessionLocker.Lock()
+	defer mongerer.sessionLocker.Unlock()
+	sessions := mongerer.sessions[peer]
+	if len(sessions) == 0 {
+		return nil
+	}
+	acked := []*mongeringSession{}
+	pending := []*mongeringSession{}
+	for _, session := range sessions {
+		if wants[session.key.origin] > session.key.id {
+			acked = append(acked, session)
+		} else {
+			pending = append(pending, session)
+		}
+	}
+	mongerer.setSessions(peer, pending)
+	return acked
+}
+
+func (mongerer *Mongerer) setSessions(peer string, sessions []*mongeringSession) {
+	if len(sessions) == 0 {
+		delete(mongerer.sessions, peer)
+		return
+	}
+	mongerer.sessions[peer] = sessions
+}
@@ -0,0 +1,157 @@
+package mongering
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	COIN_FLIP_STRATEGY = "coin"
+	FANOUT_STRATEGY    = "fanout"
+	PUSH_PULL_STRATEGY = "pushpull"
+	DECAY_STRATEGY     = "decay"
+)
+
+//Strategy decides which peers a message is mongered with, trading bandwidth against convergence time
+type Strategy interface {
+	//Initial returns the peers a new message is pushed to, avoiding the peer it came from
+	Initial(peers []string, sender string) []string
+	//Continue returns the peers to keep mongering with once the session with previousPeer ended, after round sessions of this message. Empty stops mongering.
+	Continue(peers []string, previousPeer string, round int) []string
+	//Pull reports whether every push is followed by our status, so that the peer also sends us what we are missing
+	Pull() bool
+}
+
+//NewStrategy creates the strategy with the given name. Fanout is used by the fanout and push-pull strategies, decay by the decaying strategy.
+func NewStrategy(name string, fanout int, decay float64) (Strategy, error) {
+	switch strings.ToLower(name) {
+	case COIN_FLIP_STRATEGY, "":
+		return &CoinFlip{}, nil
+	case FANOUT_STRATEGY:
+		if fanout < 1 {
+			return nil, errors.New("fanout must be at least 1")
+		}
+		return &FanoutPush{Fanout: fanout}, nil
+	case PUSH_PULL_STRATEGY:
+		if fanout < 1 {
+			return nil, errors.New("fanout must be at least 1")
+		}
+		return &PushPull{Fanout: fanout}, nil
+	case DECAY_STRATEGY:
+		if decay <= 0 || decay >= 1 {
+			return nil, errors.New("decay must be between 0 and 1")
+		}
+		return &DecayingStop{Decay: decay}, nil
+	}
+	return nil, errors.New("Unknown gossip strategy " + name)
+}
+
+//CoinFlip is the original rumor mongering: one random peer at a time, continuing with probability 1/2
+type CoinFlip struct{}
+
+//Initial picks one random peer
+func (strategy *CoinFlip) Initial(peers []string, sender string) []string {
+	return randomPeer(peers, sender)
+}
+
+//Continue picks another random peer on heads
+func (strategy *CoinFlip) Continue(peers []string, previousPeer string, round int) []string {
+	if rand.Intn(2) == 1 {
+		return randomPeer(peers, previousPeer)
+	}
+	return []string{}
+}
+
+//Pull is false, peers only pull through anti entropy
+func (strategy *CoinFlip) Pull() bool {
+	return false
+}
+
+//FanoutPush pushes every new message to Fanout random peers at once and never continues: each peer that learns it pushes it further
+type FanoutPush struct {
+	Fanout int
+}
+
+//Initial picks Fanout random peers
+func (strategy *FanoutPush) Initial(peers []string, sender string) []string {
+	return randomPeers(peers, sender, strategy.Fanout)
+}
+
+//Continue always stops
+func (strategy *FanoutPush) Continue(peers []string, previousPeer string, round int) []string {
+	return []string{}
+}
+
+//Pull is false
+func (strategy *FanoutPush) Pull() bool {
+	return false
+}
+
+//PushPull pushes like FanoutPush and sends our status along, so each contacted peer also sends back what we are missing
+type PushPull struct {
+	Fanout int
+}
+
+//Initial picks Fanout random peers
+func (strategy *PushPull) Initial(peers []string, sender string) []string {
+	return randomPeers(peers, sender, strategy.Fanout)
+}
+
+//Continue always stops
+func (strategy *PushPull) Continue(peers []string, previousPeer string, round int) []string {
+	return []string{}
+}
+
+//Pull is true
+func (strategy *PushPull) Pull() bool {
+	return true
+}
+
+//DecayingStop mongers with one peer at a time and continues with probability Decay^round, so long chains become unlikely
+type DecayingStop struct {
+	Decay float64
+}
+
+//Initial picks one random peer
+func (strategy *DecayingStop) Initial(peers []string, sender string) []string {
+	return randomPeer(peers, sender)
+}
+
+//Continue picks another random peer with a probability decaying with every round
+func (strategy *DecayingStop) Continue(peers []string, previousPeer string, round int) []string {
+	if rand.Float64() < math.Pow(strategy.Decay, float64(round)) {
+		return randomPeer(peers, previousPeer)
+	}
+	return []string{}
+}
+
+//Pull is false
+func (strategy *DecayingStop) Pull() bool {
+	return false
+}
+
+//randomPeer picks a peer other than exclude, unless exclude is the only peer
+func randomPeer(peers []string, exclude string) []string {
+	candidates := randomPeers(peers, exclude, 1)
+	if len(candidates) == 0 && len(peers) > 0 {
+		return peers[:1]
+	}
+	return candidates
+}
+
+//randomPeers picks up to n distinct peers other than exclude
+func randomPeers(peers []string, exclude string, n int) []string {
+	candidates := []string{}
+	for _, peer := range peers {
+		if strings.Compare(peer, exclude) != 0 {
+			candidates = append(candidates, peer)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if n < len(candidates) {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+//Router floods the routing heartbeats of every node, keeping the routing table and the announced encryption keys up to date
+type Router struct {
+	ctx               *core.Context
+	announceLocker    sync.Mutex
+	seqNum            uint32
+	latest            map[string]uint32
+	reachableHandlers []func(origin string)
+}
+
+//NewRouter creates the router and registers the route announcement packet
+func NewRouter(cntx *core.Context) *Router {
+	router := &Router{ctx: cntx, latest: make(map[string]uint32)}
+	router.registerPacketKinds()
+	return router
+}
+
+func (router *Router) registerPacketKinds() {
+	err := router.ctx.Registry.Register(core.PacketKind{
+		Type:    core.ROUTE_ANNOUNCEMENT,
+		Name:    "RouteAnnouncement",
+		Present: func(packet *core.GossipPacket) bool { return packet.Route != nil },
+		Validate: func(packet *core.GossipPacket) error {
+			if len(packet.Route.Origin) == 0 || packet.Route.SeqNum == 0 {
+				return errors.New("missing origin or sequence number")
+			}
+			return nil
+		},
+		Handle: router.HandleRouteAnnouncement,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//OnReachable registers a handler called whenever a fresh announcement shows that origin can be reached
+func (router *Router) OnReachable(handler func(origin string)) {
+	router.announceLocker.Lock()
+	defer router.announceLocker.Unlock()
+	router.reachableHandlers = append(router.reachableHandlers, handler)
+}
+
+//Start announces this node every intervalSeconds, or once if it is zero, as soon as it has peers. It returns once the context is stopped.
+func (router *Router) Start(intervalSeconds int) {
+	if router.ctx.SimpleMode {
+		return
+	}
+	for {
+		wait := time.Second
+		if len(router.ctx.GetPeers()) > 0 {
+			router.Announce()
+			if intervalSeconds == 0 {
+				return
+			}
+			wait = time.Duration(intervalSeconds) * time.Second
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-router.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+//Announce floods a new heartbeat of this node to its peers. Sequence numbers follow the clock, so that a restarted node is not mistaken for a stale one.
+func (router *Router) Announce() {
+	router.announceLocker.Lock()
+	router.seqNum++
+	if now := uint32(time.Now().Unix()); now > router.seqNum {
+		router.seqNum = now
+	}
+	announcement := &core.RouteAnnouncement{
+		Origin:        router.ctx.Name,
+		SeqNum:        router.seqNum,
+		EncryptionKey: router.ctx.Identity.EncryptionPublicKey(),
+	}
+	router.announceLocker.Unlock()
+	router.ctx.Identity.SignRouteAnnouncement(announcement)
+	router.flood(announcement, "")
+}
+
+//HandleRouteAnnouncement updates the route to the origin of an announcement and floods it further the first time it is seen
+func (router *Router) HandleRouteAnnouncement(packet core.GossipPacket, sender string) {
+	announcement := packet.Route
+	if strings.Compare(announcement.Origin, router.ctx.Name) == 0 {
+		return
+	}
+	router.announceLocker.Lock()
+	latest := router.latest[announcement.Origin]
+	router.announceLocker.Unlock()
+	if announcement.SeqNum < latest {
+		return
+	}
+	if err := router.ctx.KeyRing.VerifyRouteAnnouncement(announcement); err != nil {
+		fmt.Println("REJECTED route announcement origin", announcement.Origin, ":", err)
+		return
+	}
+	announcement.Hops++
+	router.ctx.UpdateRoute(announcement.Origin, sender, announcement.SeqNum, announcement.Hops)
+	if announcement.SeqNum == latest {
+		//A copy that travelled another path, it may only shorten the route
+		return
+	}
+
+	router.announceLocker.Lock()
+	if announcement.SeqNum <= router.latest[announcement.Origin] {
+		router.announceLocker.Unlock()
+		return
+	}
+	router.latest[announcement.Origin] = announcement.SeqNum
+	handlers := router.reachableHandlers
+	router.announceLocker.Unlock()
+
+	router.ctx.KeyRing.BindEncryptionKey(announcement.Origin, announcement.EncryptionKey)
+	for _, handler := range handlers {
+		go handler(announcement.Origin)
+	}
+	if announcement.Hops < router.ctx.GetHopLimit() {
+		router.flood(announcement, sender)
+	}
+}
+
+//flood sends an announcement to every peer but the one it came from
+func (router *Router) flood(announcement *core.RouteAnnouncement, sender string) {
+	for _, peer := range router.ctx.GetPeers() {
+		if strings.Compare(peer, sender) != 0 {
+			go router.ctx.SendPacketToPeer(core.GossipPacket{Route: announcement}, peer)
+		}
+	}
+}
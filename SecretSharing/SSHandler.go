@@ -7,6 +7,7 @@ package SecretSharing
 import (
 	"errors"
 	"fmt"
+	"log"
 	"sync"
 
 	core "github.com/ksei/Peerster/Core"
@@ -54,10 +55,48 @@ func NewSSHandler(ctx *core.Context) *SSHandler {
 		distributionSuccessful:  make(chan bool, 20),
 		attemptedInsertionOnce:  false,
 	}
-
+	h.registerPacketKinds()
 	return h
 }
 
+func (ssHandler *SSHandler) registerPacketKinds() {
+	kinds := []core.PacketKind{
+		{
+			Type:    core.PASSWORD_INSERT,
+			Name:    "PublicShare",
+			Present: func(packet *core.GossipPacket) bool { return packet.PublicSecretShare != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				share := packet.PublicSecretShare
+				if len(share.Origin) == 0 || len(share.Destination) == 0 || len(share.UID) == 0 {
+					return errors.New("missing origin, destination or share UID")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { ssHandler.HandlePublicShare(packet) },
+		},
+		{
+			Type:    core.PASSWORD_RETRIEVE,
+			Name:    "ShareRequest",
+			Present: func(packet *core.GossipPacket) bool { return packet.ShareRequest != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.ShareRequest.Origin) == 0 || len(packet.ShareRequest.RequestUID) == 0 {
+					return errors.New("missing origin or request UID")
+				}
+				if packet.ShareRequest.Budget == 0 {
+					return errors.New("exhausted budget")
+				}
+				return nil
+			},
+			Handle: ssHandler.HandleSearchRequest,
+		},
+	}
+	for _, kind := range kinds {
+		if err := ssHandler.ctx.Registry.Register(kind); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 //HandlePasswordInsert handles password insertion by user
 func (ssHandler *SSHandler) HandlePasswordInsert(masterKey, account, username, newPassword string) {
 
@@ -131,6 +170,7 @@ func (ssHandler *SSHandler) HandlePasswordInsert(masterKey, account, username, n
 		}
 		return
 	}
+	ssHandler.persist()
 	res := "Stored Successfully!"
 	ssHandler.ctx.GUImessageChannel <- &core.GUIPacket{PasswordOpResult: &res}
 }
@@ -172,6 +212,7 @@ func (ssHandler *SSHandler) HandlePasswordDelete(masterKey, account, username st
 
 	//3.Clear additional data
 	ssHandler.clearResidues(passwordUID)
+	ssHandler.persist()
 
 	res := "Deleted Successfully!"
 	ssHandler.ctx.GUImessageChannel <- &core.GUIPacket{PasswordOpResult: &res}
@@ -204,6 +245,7 @@ func (ssHandler *SSHandler) processShare(publicShare core.PublicShare) error {
 	} else if !publicShare.Requested {
 		fmt.Println("Share stored: ", publicShare.UID)
 		ssHandler.storeShare(publicShare)
+		ssHandler.persist()
 		go ssHandler.sendConfirmation(publicShare)
 		//If not requested then check if this node is still awaiting for a password matching to the received share
 	} else if passwordUID, awaiting := ssHandler.awaitingShare(publicShare); awaiting {
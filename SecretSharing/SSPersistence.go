@@ -0,0 +1,82 @@
+/*
+Created and Developed by: Ksandros Apostoli
+Part of the course project for Decentralized System Engineering
+*/
+package SecretSharing
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const SS_SNAPSHOT = "secretsharing"
+
+//ssSnapshot holds the state needed to recover passwords after a restart.
+//Share UIDs are raw SHA-256 digests, so they are hex encoded to survive JSON.
+type ssSnapshot struct {
+	StoredPasswords   []string
+	ArchivedPasswords []string
+	ExtraInfo         map[string]*extraInfo
+	Thresholds        map[string]int
+	HostedShares      map[string][]byte
+}
+
+//Save snapshots stored passwords, their salts and nonces, and the shares hosted on behalf of other peers
+func (ssHandler *SSHandler) Save(store *core.Store) error {
+	ssHandler.ssLocker.RLock()
+	defer ssHandler.ssLocker.RUnlock()
+	snapshot := ssSnapshot{
+		StoredPasswords:   ssHandler.storedPasswords,
+		ArchivedPasswords: ssHandler.archivedPasswords,
+		ExtraInfo:         make(map[string]*extraInfo),
+		Thresholds:        ssHandler.thresholds,
+		HostedShares:      make(map[string][]byte),
+	}
+	for uid, info := range ssHandler.extraInfo {
+		snapshot.ExtraInfo[hex.EncodeToString([]byte(uid))] = info
+	}
+	for uid, share := range ssHandler.hostedShares {
+		snapshot.HostedShares[hex.EncodeToString([]byte(uid))] = share
+	}
+	return store.Put(SS_SNAPSHOT, snapshot)
+}
+
+//Restore reloads the password and hosted share state saved by a previous run
+func (ssHandler *SSHandler) Restore(store *core.Store) error {
+	snapshot := ssSnapshot{}
+	found, err := store.Get(SS_SNAPSHOT, &snapshot)
+	if err != nil || !found {
+		return err
+	}
+	ssHandler.ssLocker.Lock()
+	defer ssHandler.ssLocker.Unlock()
+	ssHandler.storedPasswords = append(ssHandler.storedPasswords, snapshot.StoredPasswords...)
+	ssHandler.archivedPasswords = append(ssHandler.archivedPasswords, snapshot.ArchivedPasswords...)
+	for uid, thresh := range snapshot.Thresholds {
+		ssHandler.thresholds[uid] = thresh
+	}
+	for encodedUID, info := range snapshot.ExtraInfo {
+		uid, err := hex.DecodeString(encodedUID)
+		if err != nil {
+			return err
+		}
+		ssHandler.extraInfo[string(uid)] = info
+	}
+	for encodedUID, share := range snapshot.HostedShares {
+		uid, err := hex.DecodeString(encodedUID)
+		if err != nil {
+			return err
+		}
+		ssHandler.hostedShares[string(uid)] = share
+	}
+	return nil
+}
+
+//persist saves the handler state right away, so shares and salts are on disk before they are confirmed to anyone
+func (ssHandler *SSHandler) persist() {
+	if err := ssHandler.Save(ssHandler.ctx.Store); err != nil {
+		fmt.Println("Could not persist secret sharing state:", err)
+	}
+}
@@ -89,23 +89,26 @@ func (ssHandler *SSHandler) forwardSearchRequest(sender string, shareRequest *co
 	if totalPeers < 1 {
 		return
 	} else if int(totalBudget) < totalPeers {
-		shareRequest.Budget = 1
 		for _, peer := range core.RandomPeers(int(totalBudget), peerList) {
-			go ssHandler.ctx.SendPacketToPeer(core.GossipPacket{ShareRequest: shareRequest}, peer)
+			forward := *shareRequest
+			forward.Budget = 1
+			go ssHandler.ctx.SendPacketToPeer(core.GossipPacket{ShareRequest: &forward}, peer)
 		}
 	} else {
 		remainingBudget := totalBudget % uint64(totalPeers)
 		rand.Seed(time.Now().UnixNano())
 		randomPeerIndices := rand.Perm(totalPeers)[:remainingBudget]
 		for i, peer := range peerList {
-			shareRequest.Budget = totalBudget / uint64(totalPeers)
+			//Every peer gets its own copy, the budgets differ and the sends run concurrently
+			forward := *shareRequest
+			forward.Budget = totalBudget / uint64(totalPeers)
 			for _, randomPeer := range randomPeerIndices {
 				if i == randomPeer {
-					shareRequest.Budget++
+					forward.Budget++
 					break
 				}
 			}
-			go ssHandler.ctx.SendPacketToPeer(core.GossipPacket{ShareRequest: shareRequest}, peer)
+			go ssHandler.ctx.SendPacketToPeer(core.GossipPacket{ShareRequest: &forward}, peer)
 		}
 	}
 }
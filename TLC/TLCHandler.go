@@ -2,7 +2,9 @@ package TLC
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,35 +45,83 @@ func NewTLCHandler(mng *mongering.Mongerer, totalPeers, stubborn int) *TLCHandle
 		peerRounds:            make(map[string]uint32),
 		readyForNextRound:     true,
 	}
+	tlc.registerPacketKinds()
+	mng.RegisterBatchReceiver(core.TLC_MESSAGE, func(packet core.GossipPacket, sender string) { tlc.receiveTLCMessage(packet.TLCMessage, sender) })
 	return tlc
 }
 
+func (tlc *TLCHandler) registerPacketKinds() {
+	kinds := []core.PacketKind{
+		{
+			Type:    core.TLC_MESSAGE,
+			Name:    "TLCMessage",
+			Present: func(packet *core.GossipPacket) bool { return packet.TLCMessage != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.TLCMessage.Origin) == 0 || packet.TLCMessage.ID == 0 || packet.TLCMessage.VectorClock == nil {
+					return errors.New("missing origin, ID or vector clock")
+				}
+				return nil
+			},
+			Handle: tlc.HandleTLCMessage,
+		},
+		{
+			Type:    core.TLC_ACK,
+			Name:    "TLCAck",
+			Present: func(packet *core.GossipPacket) bool { return packet.Ack != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.Ack.Origin) == 0 || len(packet.Ack.Destination) == 0 {
+					return errors.New("missing origin or destination")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { tlc.HandleTLCAck(packet) },
+		},
+	}
+	for _, kind := range kinds {
+		if err := tlc.ctx.Registry.Register(kind); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 func (tlc *TLCHandler) HandleTLCMessage(packet core.GossipPacket, sender string) {
 	tlcMessage := packet.TLCMessage
-	if !tlc.messageExists(*tlcMessage) {
-		if tlc.ctx.VectorClock.GetMaxIdFrom(tlcMessage.Origin) < tlcMessage.ID {
-			tlc.ctx.UpdateDSDV(tlcMessage.Origin, sender, false)
-		}
-		if strings.Compare(sender, tlc.ctx.Address.String()) != 0 {
-			if tlc.ctx.RunningHw3Ex3() && !tlc.satisfiesVectorClock(*tlcMessage) {
-				go tlc.bufferMessage(*tlcMessage)
-			} else {
-				tlc.acceptTLCMessage(*tlcMessage)
-				go tlc.updateBufferStatus(tlcMessage.Origin)
-			}
-			go tlc.mongerer.StartMongering(tlcMessage, core.RandomPeer(tlc.ctx, sender))
-		} else if tlc.ctx.RunningHw3Ex3() && !tlc.readyForNextRound {
-			tlc.tlcLocker.Lock()
-			tlc.clientBuffer = append(tlc.clientBuffer, tlcMessage)
-			tlc.tlcLocker.Unlock()
-		} else {
-			go tlc.advanceToNextRound(*tlcMessage)
+	if strings.Compare(sender, tlc.ctx.Address.String()) != 0 {
+		if tlc.receiveTLCMessage(tlcMessage, sender) {
+			go tlc.mongerer.Spread(tlcMessage, sender)
+		} else if tlcMessage.Confirmed == -1 {
+			go tlc.mongerer.Acknowledge(sender)
 		}
-	} else if strings.Compare(sender, tlc.ctx.Address.String()) != 0 && tlcMessage.Confirmed == -1 {
-		go tlc.mongerer.Acknowledge(sender)
+		return
+	}
+	if tlc.messageExists(*tlcMessage) {
+		return
+	}
+	if tlc.ctx.RunningHw3Ex3() && !tlc.readyForNextRound {
+		tlc.tlcLocker.Lock()
+		tlc.clientBuffer = append(tlc.clientBuffer, tlcMessage)
+		tlc.tlcLocker.Unlock()
+	} else {
+		go tlc.advanceToNextRound(*tlcMessage)
 	}
 }
 
+//receiveTLCMessage accepts or buffers a TLC message received from a peer, returning true if it was new
+func (tlc *TLCHandler) receiveTLCMessage(tlcMessage *core.TLCMessage, sender string) bool {
+	tlcMessage.Hops++
+	tlc.ctx.UpdateRouteFromMessage(tlcMessage.Origin, sender, tlcMessage.ID, tlcMessage.Hops)
+	if tlc.messageExists(*tlcMessage) {
+		return false
+	}
+	if tlc.ctx.RunningHw3Ex3() && !tlc.satisfiesVectorClock(*tlcMessage) {
+		go tlc.bufferMessage(*tlcMessage)
+	} else {
+		tlc.acceptTLCMessage(*tlcMessage)
+		go tlc.updateBufferStatus(tlcMessage.Origin)
+	}
+	return true
+}
+
 func (tlc *TLCHandler) HandleTLCAck(packet core.GossipPacket) {
 	tlcAck := packet.Ack
 	found, destinationIP := tlc.ctx.RetrieveDestinationRoute(tlcAck.Destination)
@@ -105,18 +155,20 @@ func (tlc *TLCHandler) HandleTLCAck(packet core.GossipPacket) {
 
 func (tlc *TLCHandler) publishConfirmed(id uint32) {
 	content, ok := tlc.ctx.VectorClock.GetStoredMessage(tlc.ctx.Name, id)
-	tlcMessage := content.(*core.TLCMessage)
-	if ok {
-		tlcMessage.Origin = tlc.ctx.Name
-		tlcMessage.Confirmed = int(id)
-		tlcMessage.ID = tlc.ctx.VectorClock.GetNextIDFrom(tlc.ctx.Name)
-		go tlc.mongerer.StartMongering(tlcMessage, core.RandomPeer(tlc.ctx, tlc.ctx.Name))
+	if !ok {
+		fmt.Println("Cannot confirm TLC message", id, ": its body was pruned")
+		return
 	}
+	//Copy, the stored unconfirmed message keeps its own ID
+	tlcMessage := *content.(*core.TLCMessage)
+	tlcMessage.Origin = tlc.ctx.Name
+	tlcMessage.Confirmed = int(id)
+	tlcMessage.ID = tlc.ctx.VectorClock.GetNextIDFrom(tlc.ctx.Name)
+	go tlc.mongerer.Spread(&tlcMessage, tlc.ctx.Name)
 }
 
 func (tlc *TLCHandler) messageExists(tlcPacket core.TLCMessage) bool {
-	_, ok := tlc.ctx.VectorClock.GetStoredMessage(tlcPacket.Origin, tlcPacket.ID)
-	return ok
+	return tlc.ctx.VectorClock.Has(tlcPacket.Origin, tlcPacket.ID)
 }
 
 func (tlc *TLCHandler) AcknowledgeTLC(tlcMessage core.TLCMessage) {
@@ -172,8 +224,14 @@ func (tlc *TLCHandler) isConifrmed(id uint32) bool {
 func (tlc *TLCHandler) stubbornRetries(tlcMessage core.TLCMessage) {
 	for {
 		fmt.Println("Sending stubborn")
-		go tlc.mongerer.StartMongering(&tlcMessage, core.RandomPeer(tlc.ctx, tlc.ctx.Name))
-		time.Sleep(time.Duration(tlc.stubbornTimeout) * time.Second)
+		go tlc.mongerer.Spread(&tlcMessage, tlc.ctx.Name)
+		timer := time.NewTimer(time.Duration(tlc.stubbornTimeout) * time.Second)
+		select {
+		case <-timer.C:
+		case <-tlc.ctx.Done():
+			timer.Stop()
+			return
+		}
 		if tlc.isConifrmed(tlcMessage.ID) {
 			return
 		}
@@ -251,7 +309,7 @@ func (tlc *TLCHandler) storeConfirmation(tlcMessage core.TLCMessage) {
 }
 
 func (tlc *TLCHandler) advanceToNextRound(tlcMessage core.TLCMessage) {
-	tlcMessage.ID = tlc.ctx.VectorClock.GetNextIDFrom(tlc.ctx.Name)
+	tlcMessage.ID = tlc.ctx.VectorClock.ReserveID(tlc.ctx.Name)
 	tlc.ctx.VectorClock.StoreMessage(&tlcMessage)
 	tlc.tlcLocker.Lock()
 	tlc.confirmations[tlcMessage.ID] = []string{tlc.ctx.Name}
@@ -304,3 +362,65 @@ func (tlc *TLCHandler) printAdvancement() {
 	}
 	fmt.Println("ADVANCING TO round", tlc.myTime+1, "BASED ON CONFIRMED MESSAGES", confirmationStr)
 }
+
+const TLC_SNAPSHOT = "tlc"
+
+type tlcSnapshot struct {
+	Confirmations         map[uint32][]string
+	MyTime                uint32
+	PeerConfirmations     map[string][]uint32
+	AwaitingConfirmations map[uint32]bool
+	PeerRounds            map[string]uint32
+	ReadyForNextRound     bool
+}
+
+//Save snapshots the round and confirmation state of the handler
+func (tlc *TLCHandler) Save(store *core.Store) error {
+	tlc.tlcLocker.RLock()
+	defer tlc.tlcLocker.RUnlock()
+	snapshot := tlcSnapshot{
+		Confirmations:         tlc.confirmations,
+		MyTime:                tlc.myTime,
+		PeerConfirmations:     tlc.peerConfirmations,
+		AwaitingConfirmations: tlc.awaitingConfirmations,
+		PeerRounds:            tlc.peerRounds,
+		ReadyForNextRound:     tlc.readyForNextRound,
+	}
+	return store.Put(TLC_SNAPSHOT, snapshot)
+}
+
+//Restore reloads the round and confirmation state saved by a previous run and resumes retrying unconfirmed messages
+func (tlc *TLCHandler) Restore(store *core.Store) error {
+	snapshot := tlcSnapshot{}
+	found, err := store.Get(TLC_SNAPSHOT, &snapshot)
+	if err != nil || !found {
+		return err
+	}
+	tlc.tlcLocker.Lock()
+	if snapshot.Confirmations != nil {
+		tlc.confirmations = snapshot.Confirmations
+	}
+	if snapshot.PeerConfirmations != nil {
+		tlc.peerConfirmations = snapshot.PeerConfirmations
+	}
+	if snapshot.AwaitingConfirmations != nil {
+		tlc.awaitingConfirmations = snapshot.AwaitingConfirmations
+	}
+	if snapshot.PeerRounds != nil {
+		tlc.peerRounds = snapshot.PeerRounds
+	}
+	tlc.myTime = snapshot.MyTime
+	tlc.readyForNextRound = snapshot.ReadyForNextRound
+	tlc.tlcLocker.Unlock()
+
+	for id, awaiting := range snapshot.AwaitingConfirmations {
+		content, ok := tlc.ctx.VectorClock.GetStoredMessage(tlc.ctx.Name, id)
+		if !awaiting || !ok {
+			continue
+		}
+		if tlcMessage, isTLC := content.(*core.TLCMessage); isTLC {
+			go tlc.stubbornRetries(*tlcMessage)
+		}
+	}
+	return nil
+}
@@ -16,7 +16,7 @@ import (
 const localAddress string = "127.0.0.1"
 
 func main() {
-	args := [12]*string{}
+	args := [16]*string{}
 
 	args[0] = flag.String("keywords", "", "Matching keywords for desired file.")
 	args[1] = flag.String("budget", "", "Searching budget.")
@@ -30,6 +30,10 @@ func main() {
 	args[9] = flag.String("username", "", "username belonging to specified account")
 	args[10] = flag.String("password", "", "password to be stored at Keyster")
 	args[11] = flag.String("delete", "", "username whose password is to be deleted for the specified account")
+	args[12] = flag.String("channel", "", "channel the message is sent to")
+	args[13] = flag.String("join", "", "channel to join")
+	args[14] = flag.String("leave", "", "channel to leave")
+	args[15] = flag.String("channelKey", "", "passphrase encrypting the joined channel")
 
 	flag.Parse()
 
@@ -58,7 +62,7 @@ func main() {
 		}
 		budget = &i
 	}
-	message = core.Message{Text: *args[3], Destination: args[4], File: args[5], Request: &requestBytes, KeyWords: args[0], Budget: budget, MasterKey: args[7], AccountURL: args[8], UserName: args[9], DeleteUser: args[11], NewPassword: args[10]}
+	message = core.Message{Text: *args[3], Destination: args[4], File: args[5], Request: &requestBytes, KeyWords: args[0], Budget: budget, MasterKey: args[7], AccountURL: args[8], UserName: args[9], DeleteUser: args[11], NewPassword: args[10], Channel: args[12], JoinChannel: args[13], LeaveChannel: args[14], ChannelKey: args[15]}
 
 	toSend := localAddress + ":" + *args[2]
 	updAddr, err1 := net.ResolveUDPAddr("udp", toSend)
@@ -75,7 +79,7 @@ func main() {
 	conn.Write(packetBytes)
 }
 
-func validateInput(args *[12]*string) error {
+func validateInput(args *[16]*string) error {
 	argsCombination := ""
 	for i, arg := range args {
 		if *arg == "" {
@@ -91,7 +95,7 @@ func validateInput(args *[12]*string) error {
 	if err != nil {
 		return err
 	}
-	allowedInputs := []int{768, 896, 576, 608, 368, 2560, 3584, 540, 542, 1081}
+	allowedInputs := []int{12288, 14336, 9216, 9728, 5888, 40960, 57344, 8640, 8672, 17296, 12296, 8196, 8197, 8194}
 
 	for _, ai := range allowedInputs {
 		if int(combination) == ai {
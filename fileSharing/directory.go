@@ -0,0 +1,348 @@
+package filesharing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MANIFEST_HEADER       = "PEERSTER MANIFEST 1\n"
+	MAX_PARALLEL_FILES    = 4
+	MANIFEST_STATE_SUFFIX = ".manifest" + STATE_SUFFIX
+)
+
+//manifestEntry is a file of a shared directory, at a slash separated path relative to the directory
+type manifestEntry struct {
+	Path     string
+	Size     int64
+	Metahash []byte
+}
+
+//directoryState describes a directory download in the state file kept next to the directory until it is rebuilt, so that it can be resumed
+type directoryState struct {
+	Name     string
+	Metahash string
+	Manifest []byte
+	Holders  []string
+}
+
+//Directory is a shared directory tree. It is described by a manifest listing its files, whose hash stands for the directory
+//the way a metahash stands for a file. Every file of the directory is indexed on its own as well.
+type Directory struct {
+	Name      string
+	directory string
+	manifest  []byte
+	metahash  []byte
+}
+
+//encodeManifest lists the entries sorted by path, one per line: metahash in hex, size and path
+func encodeManifest(entries []manifestEntry) []byte {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	var manifest bytes.Buffer
+	manifest.WriteString(MANIFEST_HEADER)
+	for _, entry := range entries {
+		fmt.Fprintf(&manifest, "%s %d %s\n", hex.EncodeToString(entry.Metahash), entry.Size, entry.Path)
+	}
+	return manifest.Bytes()
+}
+
+func isManifest(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(MANIFEST_HEADER))
+}
+
+//parseManifest decodes a manifest, rejecting paths that would escape the directory
+func parseManifest(manifest []byte) ([]manifestEntry, error) {
+	if !isManifest(manifest) {
+		return nil, errors.New("not a manifest")
+	}
+	lines := strings.Split(strings.TrimSuffix(string(manifest[len(MANIFEST_HEADER):]), "\n"), "\n")
+	entries := []manifestEntry{}
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, errors.New("malformed manifest entry")
+		}
+		metahash, err := hex.DecodeString(fields[0])
+		if err != nil || len(metahash) != sha256.Size {
+			return nil, errors.New("malformed metahash in manifest")
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.New("malformed size in manifest")
+		}
+		if !isSafePath(fields[2]) {
+			return nil, errors.New("unsafe path in manifest: " + fields[2])
+		}
+		entries = append(entries, manifestEntry{Path: fields[2], Size: size, Metahash: metahash})
+	}
+	return entries, nil
+}
+
+//isSafePath accepts only clean relative paths that stay within the directory
+func isSafePath(p string) bool {
+	return len(p) > 0 && path.Clean(p) == p && !path.IsAbs(p) && p != "." && p != ".." && !strings.HasPrefix(p, "../") &&
+		!strings.ContainsAny(p, "\\\x00")
+}
+
+//newDirectoryIn indexes every regular file below a directory and builds its manifest.
+//It returns the files indexed, named by their path from the root of the shared folder.
+func newDirectoryIn(directory, dirName string) (*Directory, []*File, error) {
+	root := filepath.Join(directory, dirName)
+	entries := []manifestEntry{}
+	files := []*File{}
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if !isSafePath(relative) || strings.Contains(relative, "\n") {
+			fmt.Println("Skipping file", relative, "of directory", dirName, ": unsupported name")
+			return nil
+		}
+		file, err := newIndexedFileIn(directory, dirName+"/"+relative)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		entries = append(entries, manifestEntry{Path: relative, Size: file.GetSize(), Metahash: file.GetMetaHash()})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := encodeManifest(entries)
+	metahash := sha256.Sum256(manifest)
+	return &Directory{Name: dirName, directory: directory, manifest: manifest, metahash: metahash[:]}, files, nil
+}
+
+//GetMetaHash returns the hash of the manifest of the directory
+func (d *Directory) GetMetaHash() []byte {
+	return d.metahash
+}
+
+//GetSize returns the total size of the files of the directory
+func (d *Directory) GetSize() int64 {
+	entries, _ := parseManifest(d.manifest)
+	size := int64(0)
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	return size
+}
+
+//IndexDirectory shares a directory of the shared folder along with every file below it
+func (fH *FileHandler) IndexDirectory(dirName string) (int64, []byte) {
+	directory, files, err := newDirectoryIn(fileDirectory, strings.TrimSuffix(dirName, "/"))
+	if err != nil {
+		fmt.Println("Could not index directory: ", err)
+		return -1, nil
+	}
+	for _, file := range files {
+		fH.addToFiles(file)
+	}
+	fH.addToDirectories(directory)
+	return directory.GetSize(), directory.GetMetaHash()
+}
+
+func (fH *FileHandler) addToDirectories(directory *Directory) {
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	fH.directories[hex.EncodeToString(directory.metahash)] = directory
+}
+
+//downloadDirectory fetches the files listed in a manifest from the holders of the directory, rebuilding the tree in the download
+//directory. Files with the same contents are downloaded once, or not at all if we already hold them, and copied to their other paths.
+//The manifest is kept in a state file until the tree is rebuilt, a download that failed or was interrupted is resumed at the next start.
+func (fH *FileHandler) downloadDirectory(dirName, metahash string, manifest []byte, holders []string) {
+	fH.fileLocker.Lock()
+	delete(fH.indexedFiles, metahash)
+	fH.settleDownload(metahash, false)
+	fH.fileLocker.Unlock()
+	entries, err := parseManifest(manifest)
+	if err != nil {
+		fmt.Println("DOWNLOAD FAILED of directory", dirName, ":", err)
+		os.Remove(manifestStatePath(dirName))
+		return
+	}
+	if err = saveDirectoryState(directoryState{Name: dirName, Metahash: metahash, Manifest: manifest, Holders: holders}); err != nil {
+		fmt.Println("Could not save the state of directory", dirName, ":", err)
+	}
+	fmt.Println("DOWNLOADING directory", dirName, "with", len(entries), "files")
+	byContent := make(map[string][]manifestEntry)
+	for _, entry := range entries {
+		content := hex.EncodeToString(entry.Metahash)
+		byContent[content] = append(byContent[content], entry)
+	}
+
+	var wait sync.WaitGroup
+	var failedLocker sync.Mutex
+	failed := false
+	fail := func() {
+		failedLocker.Lock()
+		defer failedLocker.Unlock()
+		failed = true
+	}
+	slots := make(chan bool, MAX_PARALLEL_FILES)
+	for content, group := range byContent {
+		target := dirName + "/" + group[0].Path
+		if group[0].Size == 0 {
+			//Empty files have no metafile to request
+			if err := writeEmptyFile(downloadDirectory + target); err != nil {
+				fmt.Println("Could not create", target, ":", err)
+				fail()
+			}
+			continue
+		}
+		if source, held := fH.heldFilePath(content); held {
+			if source != downloadDirectory+target {
+				if err := copyFile(source, downloadDirectory+target); err != nil {
+					fmt.Println("Could not copy", source, "to", target, ":", err)
+					fail()
+				}
+			}
+			continue
+		}
+		if file, err := newIndexedFileIn(downloadDirectory, target); err == nil && hex.EncodeToString(file.GetMetaHash()) == content {
+			//Rebuilt by an earlier attempt
+			fH.addToFiles(file)
+			continue
+		}
+		wait.Add(1)
+		slots <- true
+		hashValue := group[0].Metahash
+		fH.requestFile(target, hashValue, holders, nil, func(ok bool) {
+			if !ok {
+				fail()
+			}
+			<-slots
+			wait.Done()
+		})
+	}
+	wait.Wait()
+	if failed {
+		fmt.Println("DOWNLOAD FAILED of directory", dirName)
+		return
+	}
+
+	for _, group := range byContent {
+		for _, duplicate := range group[1:] {
+			if err := copyFile(downloadDirectory+dirName+"/"+group[0].Path, downloadDirectory+dirName+"/"+duplicate.Path); err != nil {
+				fmt.Println("DOWNLOAD FAILED of directory", dirName, ":", err)
+				return
+			}
+		}
+	}
+	os.Remove(manifestStatePath(dirName))
+	directory, files, err := newDirectoryIn(downloadDirectory, dirName)
+	if err != nil || !bytes.Equal(directory.metahash, manifestHash(manifest)) {
+		fmt.Println("DOWNLOAD FAILED of directory", dirName, ": reconstructed tree does not match its manifest")
+		return
+	}
+	for _, file := range files {
+		fH.addToFiles(file)
+	}
+	fH.addToDirectories(directory)
+	fmt.Println("RECONSTRUCTED directory", dirName)
+}
+
+func manifestStatePath(dirName string) string {
+	return downloadDirectory + dirName + MANIFEST_STATE_SUFFIX
+}
+
+func saveDirectoryState(state directoryState) error {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(manifestStatePath(state.Name)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(manifestStatePath(state.Name), encoded, 0644)
+}
+
+//loadDirectoryState reads back the state file of an interrupted directory download
+func loadDirectoryState(stateFile string) (*directoryState, error) {
+	contents, err := os.ReadFile(downloadDirectory + stateFile)
+	if err != nil {
+		return nil, err
+	}
+	state := &directoryState{}
+	if err = json.Unmarshal(contents, state); err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(manifestHash(state.Manifest)) != state.Metahash || state.Name+MANIFEST_STATE_SUFFIX != stateFile {
+		return nil, errors.New("state file does not match its manifest")
+	}
+	return state, nil
+}
+
+//heldFilePath returns where a complete file with the given metahash is on disk, if we hold one
+func (fH *FileHandler) heldFilePath(metahash string) (string, bool) {
+	fH.fileLocker.RLock()
+	defer fH.fileLocker.RUnlock()
+	file, ok := fH.indexedFiles[metahash]
+	if !ok || file.status != INDEXED {
+		return "", false
+	}
+	return file.meta.directory + file.Name, true
+}
+
+func manifestHash(manifest []byte) []byte {
+	hash := sha256.Sum256(manifest)
+	return hash[:]
+}
+
+func writeEmptyFile(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+//copyFile streams a file to another path, creating the directories on the way
+func copyFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
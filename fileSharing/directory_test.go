@@ -0,0 +1,96 @@
+package filesharing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsSafePath(t *testing.T) {
+	cases := []struct {
+		path string
+		safe bool
+	}{
+		{"file.txt", true},
+		{"sub/dir/file.txt", true},
+		{"..file", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../file", false},
+		{"sub/../../file", false},
+		{"sub/../file", false},
+		{"/etc/passwd", false},
+		{"sub//file", false},
+		{"sub/./file", false},
+		{"sub/", false},
+		{"sub\\..\\file", false},
+		{"file\x00.txt", false},
+	}
+	for _, c := range cases {
+		if safe := isSafePath(c.path); safe != c.safe {
+			t.Errorf("isSafePath(%q) = %v, want %v", c.path, safe, c.safe)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	hash := sha256.Sum256([]byte("contents"))
+	metahash := hex.EncodeToString(hash[:])
+	cases := []struct {
+		name     string
+		manifest string
+		entries  []manifestEntry
+		valid    bool
+	}{
+		{
+			name:     "empty directory",
+			manifest: MANIFEST_HEADER,
+			entries:  []manifestEntry{},
+			valid:    true,
+		},
+		{
+			name:     "paths with spaces",
+			manifest: MANIFEST_HEADER + metahash + " 8 a file.txt\n" + metahash + " 0 sub/b\n",
+			entries:  []manifestEntry{{Path: "a file.txt", Size: 8, Metahash: hash[:]}, {Path: "sub/b", Size: 0, Metahash: hash[:]}},
+			valid:    true,
+		},
+		{name: "missing header", manifest: metahash + " 8 file\n"},
+		{name: "missing field", manifest: MANIFEST_HEADER + metahash + " 8\n"},
+		{name: "short metahash", manifest: MANIFEST_HEADER + metahash[:10] + " 8 file\n"},
+		{name: "metahash not in hex", manifest: MANIFEST_HEADER + strings.Repeat("zz", sha256.Size) + " 8 file\n"},
+		{name: "negative size", manifest: MANIFEST_HEADER + metahash + " -1 file\n"},
+		{name: "escaping path", manifest: MANIFEST_HEADER + metahash + " 8 ../file\n"},
+		{name: "absolute path", manifest: MANIFEST_HEADER + metahash + " 8 /file\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entries, err := parseManifest([]byte(c.manifest))
+			if (err == nil) != c.valid {
+				t.Fatalf("got error %v, want valid %v", err, c.valid)
+			}
+			if c.valid && !reflect.DeepEqual(entries, c.entries) {
+				t.Fatalf("got entries %v, want %v", entries, c.entries)
+			}
+		})
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	hash := sha256.Sum256([]byte("contents"))
+	entries := []manifestEntry{{Path: "z", Size: 1, Metahash: hash[:]}, {Path: "a/b c", Size: 2, Metahash: hash[:]}}
+	manifest := encodeManifest(entries)
+	if !bytes.Equal(manifest, encodeManifest([]manifestEntry{entries[1], entries[0]})) {
+		t.Fatal("manifest depends on the order of its entries")
+	}
+	parsed, err := parseManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, entries) {
+		t.Fatalf("got entries %v, want %v", parsed, entries)
+	}
+}
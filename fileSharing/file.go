@@ -1,6 +1,11 @@
 package filesharing
 
-import "fmt"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
 
 const (
 	CREATED     = -2
@@ -11,15 +16,20 @@ const (
 
 //File is the base struct for file exchange
 type File struct {
-	Name   string
-	meta   *Metadata
-	status int
+	Name    string
+	meta    *Metadata
+	status  int
+	partial *partialFile
 }
 
 //NewIndexedFile used to obtain new file from local source
 func NewIndexedFile(fileName string) (*File, error) {
+	return newIndexedFileIn(fileDirectory, fileName)
+}
+
+func newIndexedFileIn(directory, fileName string) (*File, error) {
 	file := &File{Name: fileName}
-	meta, err := createMetadata(fileName)
+	meta, err := createMetadata(directory, fileName)
 	if err != nil {
 		return nil, err
 	}
@@ -34,10 +44,11 @@ func NewIndexedFile(fileName string) (*File, error) {
 //NewIncomingFile used to obtain an empty file struct
 func NewIncomingFile(fileName string, metaHash []byte) *File {
 	partialMeta := &Metadata{
+		directory:   downloadDirectory,
 		fileName:    fileName,
 		metahash:    metaHash,
 		metaFile:    nil,
-		chunkMap:    make(map[string][]byte),
+		chunkIndex:  make(map[string]uint64),
 		totalChunks: 0,
 	}
 	file := &File{
@@ -58,21 +69,101 @@ func (f *File) GetChunkMapByIndex() []uint64 {
 	return f.meta.getChunkMapByIndex()
 }
 
-//AddMetafile to a file after creation
+//AddMetafile to a file after creation. Must be called with the file lock held for writing once the file is in indexedFiles.
 func (f *File) AddMetafile(metafile []byte) {
 	f.meta.metaFile = metafile
 	f.status = DOWNLOADING
 }
 
-//AddChunk adds individual chunks to the file's meta
-func (f *File) AddChunk(chunk []byte) {
-	f.meta.addChunk(chunk)
+//GetChunk reads a chunk the file holds from disk: from the file itself once complete, from its part file while downloading
+func (f *File) GetChunk(chunkHash []byte) ([]byte, bool) {
+	if f.status == INDEXED {
+		return f.meta.readChunk(f.meta.directory+f.Name, chunkHash)
+	}
+	return f.meta.readChunk(partPath(f.meta.directory, f.Name), chunkHash)
+}
+
+//newResumedFile reopens a download interrupted by a restart from its state sidecar, keeping only the chunks on disk that match
+//the metafile. It also returns the holders known when the download started.
+func newResumedFile(directory, stateFile string) (*File, map[string][]uint64, error) {
+	partial, header, err := openPartial(directory, stateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := NewIncomingFile(header.Name, header.Metahash)
+	file.meta.directory = directory
+	file.AddMetafile(header.Metafile)
+	file.partial = partial
+	//A chunk appearing several times is written at each of its indices in turn, it is only held once all of them made it to disk
+	indices := make(map[string][]uint64)
+	order := []string{}
+	for i := 0; i < len(header.Metafile); i += sha256.Size {
+		hash := string(header.Metafile[i : i+sha256.Size])
+		if _, ok := indices[hash]; !ok {
+			order = append(order, hash)
+		}
+		indices[hash] = append(indices[hash], uint64(i/sha256.Size+1))
+	}
+	for _, hash := range order {
+		held := true
+		for _, index := range indices[hash] {
+			if !partial.has(index) {
+				held = false
+				continue
+			}
+			chunk, err := partial.readChunk(index)
+			sum := sha256.Sum256(chunk)
+			if err != nil || !bytes.Equal(sum[:], []byte(hash)) {
+				partial.mark(index, false)
+				held = false
+			}
+		}
+		if held {
+			file.meta.addChunk([]byte(hash), indices[hash][0])
+		}
+	}
+	return file, header.Holders, nil
 }
 
-func (f *File) saveFile() {
+//startPartial creates the part file the chunks of a download are written to as they arrive, along with the state to resume it from
+func (f *File) startPartial(holders map[string][]uint64) error {
+	header := partialHeader{Name: f.Name, Metahash: f.meta.metahash, Metafile: f.meta.metaFile, Holders: holders}
+	partial, err := createPartial(f.meta.directory, header)
+	if err != nil {
+		return err
+	}
+	f.partial = partial
+	return nil
+}
+
+//storeChunk writes a downloaded chunk at the given 1-based indices of the part file, and records it as held once written at all of them
+func (f *File) storeChunk(indices []uint64, chunk []byte) error {
+	if f.partial == nil {
+		return errors.New("download has no part file")
+	}
+	for _, index := range indices {
+		if err := f.partial.writeChunk(index, chunk); err != nil {
+			return err
+		}
+	}
+	hashedChunk := sha256.Sum256(chunk)
+	f.meta.addChunk(hashedChunk[:], indices[0])
+	return nil
+}
+
+//saveFile moves a completed download from its part file to its final name
+func (f *File) saveFile() error {
+	if f.partial == nil {
+		return errors.New("download has no part file")
+	}
+	err := f.partial.finish(f.meta.directory, f.Name)
+	f.partial = nil
+	if err != nil {
+		return err
+	}
 	f.meta.computeSize()
 	fmt.Println("RECONSTRUCTED file", f.Name)
-	f.meta.writeFileBytesToDisk()
+	return nil
 }
 
 //GetTotalChunks total amount of chunks available
@@ -80,6 +171,11 @@ func (f *File) GetTotalChunks() int {
 	return f.meta.getTotalChunks()
 }
 
+//GetChunkCount total amount of chunks the file is made of
+func (f *File) GetChunkCount() int {
+	return f.meta.getChunkCount()
+}
+
 func (f *File) GetSize() int64 {
 	return f.meta.getSize()
 }
@@ -4,25 +4,36 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"os"
 	"sync"
 	"time"
 
 	core "github.com/ksei/Peerster/Core"
 )
 
+//dataWaiter waits for the reply to a data request sent to peer, or to any peer if it is empty
+type dataWaiter struct {
+	peer    string
+	channel chan *core.DataReply
+}
+
 //FileHandler is a structure used for handling file requests/replies within a gossiper instance
 type FileHandler struct {
 	ctx                            *core.Context
 	fileLocker                     sync.RWMutex
 	indexedFiles                   map[string]*File
-	ongoingFileRequests            map[string][]string
+	downloadWaiters                map[string][]func(bool)
 	requestLocker                  sync.RWMutex
-	bytesRequested                 map[string]chan *[]byte
+	bytesRequested                 map[string][]dataWaiter
 	DownloadProgress               map[string]int
 	terminateOngoingSearchRequests chan bool
 	searchLocker                   sync.RWMutex
+	directories                    map[string]*Directory
 	searchMatches                  map[string](map[string][]string)
+	chunkHolders                   map[string](map[string][]uint64)
 	searchMatchFound               chan bool
 	requestCache                   map[string]string
 	ongoingSearch                  bool
@@ -33,20 +44,96 @@ func NewFileHandler(cntx *core.Context) *FileHandler {
 	fh := &FileHandler{
 		ctx:                            cntx,
 		indexedFiles:                   make(map[string]*File),
-		ongoingFileRequests:            make(map[string][]string),
-		bytesRequested:                 make(map[string]chan *[]byte),
+		downloadWaiters:                make(map[string][]func(bool)),
+		bytesRequested:                 make(map[string][]dataWaiter),
 		DownloadProgress:               make(map[string]int),
 		terminateOngoingSearchRequests: make(chan bool, 10),
+		directories:                    make(map[string]*Directory),
 		searchMatches:                  make(map[string]map[string][]string),
+		chunkHolders:                   make(map[string]map[string][]uint64),
 		searchMatchFound:               make(chan bool, 10),
 		requestCache:                   make(map[string]string),
 		ongoingSearch:                  false,
 	}
+	fh.registerPacketKinds()
 	return fh
 }
 
-//IndexFile creates internal instance of a given file
+func (fH *FileHandler) registerPacketKinds() {
+	kinds := []core.PacketKind{
+		{
+			Type:    core.DATA_REQUEST,
+			Name:    "DataRequest",
+			Present: func(packet *core.GossipPacket) bool { return packet.DataRequest != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				return validateRouted(packet.DataRequest.Origin, packet.DataRequest.Destination, packet.DataRequest.HashValue)
+			},
+			Handle: func(packet core.GossipPacket, sender string) { fH.HandleDataRequest(packet) },
+		},
+		{
+			Type:    core.DATA_REPLY,
+			Name:    "DataReply",
+			Present: func(packet *core.GossipPacket) bool { return packet.DataReply != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				return validateRouted(packet.DataReply.Origin, packet.DataReply.Destination, packet.DataReply.HashValue)
+			},
+			Handle: func(packet core.GossipPacket, sender string) { fH.HandleDataReply(packet) },
+		},
+		{
+			Type:    core.SEARCH_REQUEST,
+			Name:    "SearchRequest",
+			Present: func(packet *core.GossipPacket) bool { return packet.SearchRequest != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.SearchRequest.Origin) == 0 || len(packet.SearchRequest.Keywords) == 0 {
+					return errors.New("missing origin or keywords")
+				}
+				if packet.SearchRequest.Budget == 0 {
+					return errors.New("exhausted budget")
+				}
+				return nil
+			},
+			Handle: fH.HandleSearchRequest,
+		},
+		{
+			Type:    core.SEARCH_REPLY,
+			Name:    "SearchReply",
+			Present: func(packet *core.GossipPacket) bool { return packet.SearchReply != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.SearchReply.Origin) == 0 || len(packet.SearchReply.Destination) == 0 {
+					return errors.New("missing origin or destination")
+				}
+				for _, result := range packet.SearchReply.Results {
+					if result == nil || len(result.MetafileHash) != sha256.Size {
+						return errors.New("malformed search result")
+					}
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { fH.HandleSearchReply(packet) },
+		},
+	}
+	for _, kind := range kinds {
+		if err := fH.ctx.Registry.Register(kind); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func validateRouted(origin, destination string, hashValue []byte) error {
+	if len(origin) == 0 || len(destination) == 0 {
+		return errors.New("missing origin or destination")
+	}
+	if len(hashValue) != sha256.Size {
+		return errors.New("hash value is not a SHA-256 digest")
+	}
+	return nil
+}
+
+//IndexFile creates internal instance of a given file, or of a whole directory
 func (fH *FileHandler) IndexFile(fileName string) (int64, []byte) {
+	if info, err := os.Stat(fileDirectory + fileName); err == nil && info.IsDir() {
+		return fH.IndexDirectory(fileName)
+	}
 	file, err := NewIndexedFile(fileName)
 	if err != nil {
 		fmt.Println("Could not index file: ", err)
@@ -64,52 +151,34 @@ func (fH *FileHandler) addToFiles(file *File) {
 	fH.indexedFiles[hex.EncodeToString(metahash)] = file
 }
 
-//ProcessDataRequest handles incoming file requests from the gossiper
+//ProcessDataRequest handles incoming file requests from the gossiper. Chunks are served to any peer, since swarm downloads
+//fetch the metafile from one holder and the chunks from all of them.
 func (fH *FileHandler) ProcessDataRequest(dataRequest *core.DataRequest) {
 	hashValue := hex.EncodeToString(dataRequest.HashValue)
+	dataReply := &core.DataReply{
+		Destination: dataRequest.Origin,
+		HopLimit:    fH.ctx.GetHopLimit(),
+		HashValue:   dataRequest.HashValue,
+	}
 	fH.fileLocker.RLock()
 	defer fH.fileLocker.RUnlock()
-	file, ok := fH.indexedFiles[hashValue]
-
-	if ok && file.status >= 0 {
-		dataReply := &core.DataReply{
-			Destination: dataRequest.Origin,
-			HopLimit:    fH.ctx.GetHopLimit(),
-			HashValue:   file.meta.metahash,
-			Data:        file.meta.metaFile,
-		}
-		fH.ongoingFileRequests[dataRequest.Origin] = append(fH.ongoingFileRequests[dataRequest.Origin], hex.EncodeToString(file.meta.getMetaHash()))
+	if directory, ok := fH.directories[hashValue]; ok {
+		dataReply.Data = directory.manifest
 		fH.sendDataReply(dataReply)
 		return
 	}
-
-	ongoingFilesWithPeer, ok := fH.ongoingFileRequests[dataRequest.Origin]
-
-	if ok {
-		for _, file := range ongoingFilesWithPeer {
-			f := fH.indexedFiles[file]
-			chunk, ok := f.meta.GetChunkByHash(dataRequest.HashValue)
-			if ok {
-				dataReply := &core.DataReply{
-					Destination: dataRequest.Origin,
-					HopLimit:    fH.ctx.GetHopLimit(),
-					HashValue:   dataRequest.HashValue,
-					Data:        chunk,
-				}
-				fH.sendDataReply(dataReply)
-				return
-			}
-		}
+	if file, ok := fH.indexedFiles[hashValue]; ok && file.status >= 0 {
+		dataReply.Data = file.meta.metaFile
+		fH.sendDataReply(dataReply)
+		return
 	}
-
-	dataReply := &core.DataReply{
-		Destination: dataRequest.Origin,
-		HopLimit:    fH.ctx.GetHopLimit(),
-		HashValue:   dataRequest.HashValue,
-		Data:        nil,
+	for _, file := range fH.indexedFiles {
+		if chunk, ok := file.GetChunk(dataRequest.HashValue); ok {
+			dataReply.Data = chunk
+			break
+		}
 	}
 	fH.sendDataReply(dataReply)
-
 }
 
 //ProcessDataReply processes data replies from gossiper, mapping them to the corresponding destinations
@@ -119,130 +188,193 @@ func (fH *FileHandler) ProcessDataReply(dataReply *core.DataReply) {
 	}
 	fH.requestLocker.RLock()
 	defer fH.requestLocker.RUnlock()
-	awaitingChannel, ok := fH.bytesRequested[hex.EncodeToString(dataReply.HashValue)]
-	if ok {
-		awaitingChannel <- &dataReply.Data
+	//Downloads sharing a chunk each wait for it on their own channel
+	for _, waiter := range fH.bytesRequested[hex.EncodeToString(dataReply.HashValue)] {
+		if len(waiter.peer) > 0 && waiter.peer != dataReply.Origin {
+			continue
+		}
+		select {
+		case waiter.channel <- dataReply:
+		default:
+		}
 	}
 }
 
-//InitiateFileRequest starts an outgoing file request to a given destination using a known metahash and filename
+//awaitData registers a channel receiving the replies from peer, or from any peer if it is empty, carrying the data of the given hash
+func (fH *FileHandler) awaitData(hash, peer string) chan *core.DataReply {
+	channel := make(chan *core.DataReply, 1)
+	fH.requestLocker.Lock()
+	defer fH.requestLocker.Unlock()
+	fH.bytesRequested[hash] = append(fH.bytesRequested[hash], dataWaiter{peer: peer, channel: channel})
+	return channel
+}
+
+//stopAwaiting unregisters a channel returned by awaitData
+func (fH *FileHandler) stopAwaiting(hash string, channel chan *core.DataReply) {
+	fH.requestLocker.Lock()
+	defer fH.requestLocker.Unlock()
+	waiters := fH.bytesRequested[hash]
+	for i, waiter := range waiters {
+		if waiter.channel == channel {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(fH.bytesRequested, hash)
+		return
+	}
+	fH.bytesRequested[hash] = waiters
+}
+
+//InitiateFileRequest starts downloading a file or a directory with a known metahash, from the given destination,
+//or else from every peer the last search found holding chunks of it
 func (fH *FileHandler) InitiateFileRequest(dest *string, fileName string, metahash []byte) {
-	var destination string
+	metahashString := hex.EncodeToString(metahash)
+	var complete []string
+	var partial map[string][]uint64
 	if dest == nil {
-		var ok bool
-		fH.searchLocker.RLock()
-		destinations, ok := fH.searchMatches[fileName][hex.EncodeToString(metahash)]
-		fH.searchLocker.RUnlock()
-		if !ok {
+		complete, partial = fH.getHolders(fileName, metahashString)
+		if len(complete) == 0 && len(partial) == 0 {
 			fmt.Println("Match not found in search results...")
 			return
 		}
-		destination = destinations[0]
 	} else {
-		destination = *dest
-	}
-	dataRequest := &core.DataRequest{
-		Destination: destination,
-		HopLimit:    fH.ctx.GetHopLimit(),
-		HashValue:   metahash,
+		complete = []string{*dest}
 	}
+	fH.requestFile(fileName, metahash, complete, partial, nil)
+}
 
+//requestFile downloads a file from the peers holding all of it and those holding part of it, and calls done, if not nil, with the outcome.
+//A file already indexed or being downloaded is not requested again, done is then called once the download under way ends.
+//A download that failed is picked up again from the chunks it left on disk.
+func (fH *FileHandler) requestFile(fileName string, metahash []byte, complete []string, partial map[string][]uint64, done func(bool)) {
 	metahashString := hex.EncodeToString(metahash)
 	fH.fileLocker.Lock()
+	if file, ok := fH.indexedFiles[metahashString]; ok && file.status != INCOMPLETE {
+		if file.status == INDEXED {
+			fH.fileLocker.Unlock()
+			fmt.Println("File", file.Name, "is already indexed")
+			if done != nil {
+				go done(true)
+			}
+			return
+		}
+		if done != nil {
+			fH.downloadWaiters[metahashString] = append(fH.downloadWaiters[metahashString], done)
+		}
+		fH.fileLocker.Unlock()
+		fmt.Println("File", file.Name, "is already being downloaded")
+		return
+	}
+	if done != nil {
+		fH.downloadWaiters[metahashString] = append(fH.downloadWaiters[metahashString], done)
+	}
+	if failed, ok := fH.indexedFiles[metahashString]; ok {
+		if failed.partial != nil {
+			failed.partial.close()
+		}
+		resumed, _, err := newResumedFile(failed.meta.directory, failed.Name+PART_SUFFIX+STATE_SUFFIX)
+		if err == nil {
+			fH.indexedFiles[metahashString] = resumed
+			fH.fileLocker.Unlock()
+			fmt.Println("RESUMING download of", resumed.Name, "with", len(resumed.GetChunkMapByIndex()), "of", resumed.GetChunkCount(), "chunks on disk")
+			metafile := resumed.meta.metaFile
+			go fH.startSwarm(metahashString, metafile, holderChunkMaps(complete, partial, len(metafile)/sha256.Size))
+			return
+		}
+	}
 	fH.indexedFiles[metahashString] = NewIncomingFile(fileName, metahash)
-	fmt.Println("DOWNLOADING metafile of", fH.indexedFiles[metahashString].Name, "from", destination)
 	fH.fileLocker.Unlock()
-	fH.requestLocker.Lock()
-	defer fH.requestLocker.Unlock()
-	fH.bytesRequested[metahashString] = make(chan *[]byte)
-	go fH.waitForMetafile(dataRequest, fH.bytesRequested[metahashString], destination, metahashString)
+	channel := fH.awaitData(metahashString, "")
+	go fH.waitForMetafile(complete, partial, channel, metahashString, done == nil)
+}
+
+//settleDownload calls the functions waiting for the download of a file with its outcome. Must be called with the file lock held.
+func (fH *FileHandler) settleDownload(metahash string, ok bool) {
+	for _, waiter := range fH.downloadWaiters[metahash] {
+		go waiter(ok)
+	}
+	delete(fH.downloadWaiters, metahash)
 }
 
-func (fH *FileHandler) waitForMetafile(dataRequest *core.DataRequest, channel chan *[]byte, destination, metahash string) {
-	fH.sendDataRequest(dataRequest)
-	for {
+//waitForMetafile requests the metafile from the holders in turn until one sends it, then downloads the chunks from all of them.
+//A manifest is sent instead for a directory, whose files are then downloaded one by one, unless directories are not expected.
+func (fH *FileHandler) waitForMetafile(complete []string, partial map[string][]uint64, channel chan *core.DataReply, metahash string, directoryAllowed bool) {
+	sources := append([]string{}, complete...)
+	for holder := range partial {
+		sources = append(sources, holder)
+	}
+	hashValue, _ := hex.DecodeString(metahash)
+	defer fH.stopAwaiting(metahash, channel)
+
+	next := 0
+	for len(sources) > 0 {
+		source := sources[next%len(sources)]
+		fH.fileLocker.RLock()
+		fmt.Println("DOWNLOADING metafile of", fH.indexedFiles[metahash].Name, "from", source)
+		fH.fileLocker.RUnlock()
+		fH.sendDataRequest(&core.DataRequest{Destination: source, HopLimit: fH.ctx.GetHopLimit(), HashValue: hashValue})
 		select {
-		case receivedMetafile := <-channel:
-			fH.requestLocker.Lock()
-			delete(fH.bytesRequested, metahash)
-			fH.requestLocker.Unlock()
-			if len(*receivedMetafile) > 0 {
+		case reply := <-channel:
+			if len(reply.Data) == 0 {
+				fmt.Println("File not found at peer", reply.Origin)
+				sources = removeSource(sources, reply.Origin)
+				continue
+			}
+			if isManifest(reply.Data) && directoryAllowed {
 				fH.fileLocker.RLock()
-				fH.indexedFiles[metahash].AddMetafile(*receivedMetafile)
+				dirName := fH.indexedFiles[metahash].Name
 				fH.fileLocker.RUnlock()
-				go fH.initiateDownload(destination, metahash, *receivedMetafile)
-			} else {
-				fmt.Println("File not found at peer")
+				go fH.downloadDirectory(dirName, metahash, reply.Data, sources)
+				return
 			}
+			//Readers of the file status and metafile hold the file lock, so they are written under its write lock
+			fH.fileLocker.Lock()
+			fH.indexedFiles[metahash].AddMetafile(reply.Data)
+			fH.fileLocker.Unlock()
+			go fH.startSwarm(metahash, reply.Data, holderChunkMaps(complete, partial, len(reply.Data)/sha256.Size))
 			return
 		case <-time.After(5 * time.Second):
-			fH.sendDataRequest(dataRequest)
+			next++
 		}
 	}
+	fmt.Println("File not found at peer")
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	//Nothing was written to disk yet, the next request starts over
+	delete(fH.indexedFiles, metahash)
+	fH.settleDownload(metahash, false)
 }
 
-func (fH *FileHandler) initiateDownload(destination, metahash string, metafile []byte) {
-	var chunks [][]byte
-	hashSize := 32
-	fH.fileLocker.Lock()
-	fH.DownloadProgress[metahash] = len(metafile) / hashSize
-	fH.fileLocker.Unlock()
-	for i := 0; i < len(metafile); i += hashSize {
-		chunks = append(chunks, metafile[i:i+hashSize])
+//holderChunkMaps lists the 1-based indices of the chunks each holder has, among the chunkCount chunks of a file
+func holderChunkMaps(complete []string, partial map[string][]uint64, chunkCount int) map[string][]uint64 {
+	chunkMaps := make(map[string][]uint64)
+	for holder, chunkMap := range partial {
+		chunkMaps[holder] = chunkMap
+	}
+	//Holders of the whole file are trusted with every chunk, whatever their chunk map says
+	for _, holder := range complete {
+		chunkMaps[holder] = allChunks(chunkCount)
 	}
-	go fH.DownloadChunks(chunks, destination, metahash)
+	return chunkMaps
 }
 
-//DownloadChunks starts sending requests and opens go routines for waiting replies of individual chunks
-func (fH *FileHandler) DownloadChunks(chunks [][]byte, destination, metahash string) {
-	for i, chunk := range chunks {
-		dataRequest := &core.DataRequest{
-			Destination: destination,
-			HopLimit:    fH.ctx.GetHopLimit(),
-			HashValue:   chunk,
+func removeSource(sources []string, source string) []string {
+	for i, s := range sources {
+		if s == source {
+			return append(sources[:i], sources[i+1:]...)
 		}
-		chunkHashString := hex.EncodeToString(chunk)
-		awaitingChannel := make(chan *[]byte)
-		fH.requestLocker.Lock()
-		fH.bytesRequested[chunkHashString] = awaitingChannel
-		fH.requestLocker.Unlock()
-		go fH.waitForChunk(dataRequest, chunkHashString, metahash, awaitingChannel)
-		fH.fileLocker.RLock()
-		fmt.Println("DOWNLOADING", fH.indexedFiles[metahash].Name, "chunk", i+1, "from", dataRequest.Destination)
-		if fH.indexedFiles[metahash].status != DOWNLOADING {
-			break
-		}
-		fH.fileLocker.RUnlock()
 	}
+	return sources
 }
 
-func (fH *FileHandler) waitForChunk(dataRequest *core.DataRequest, chunkHash, metahash string, channel chan *[]byte) {
-	fH.sendDataRequest(dataRequest)
-	for {
-		select {
-		case receivedChunk := <-channel:
-			fH.requestLocker.Lock()
-			delete(fH.bytesRequested, chunkHash)
-			fH.requestLocker.Unlock()
-			if len(*receivedChunk) == 0 {
-				fH.fileLocker.Lock()
-				fH.indexedFiles[metahash].status = INCOMPLETE
-				fH.fileLocker.Unlock()
-				return
-			}
-			fH.fileLocker.Lock()
-			fH.indexedFiles[metahash].AddChunk(*receivedChunk)
-			fH.DownloadProgress[metahash]--
-			if fH.DownloadProgress[metahash] == 0 {
-				fH.indexedFiles[metahash].status = INDEXED
-				fH.indexedFiles[metahash].saveFile()
-			}
-			fH.fileLocker.Unlock()
-			return
-		case <-time.After(5 * time.Second):
-			fH.sendDataRequest(dataRequest)
-		}
+func allChunks(count int) []uint64 {
+	chunkMap := make([]uint64, count)
+	for i := range chunkMap {
+		chunkMap[i] = uint64(i + 1)
 	}
+	return chunkMap
 }
 
 func validateReceivedDataReplyHash(dataReply core.DataReply) bool {
@@ -0,0 +1,47 @@
+package filesharing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+func TestDataReplyReachesEveryWaiter(t *testing.T) {
+	transport, err := core.NewChannelNetwork().NewTransport("10.0.0.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := core.CreateContextWithTransport(transport, "A", "", false, false, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fH := NewFileHandler(ctx)
+	data := []byte("chunk")
+	hash := sha256.Sum256(data)
+	chunk := hex.EncodeToString(hash[:])
+	first, second := fH.awaitData(chunk, "B"), fH.awaitData(chunk, "B")
+	other, anyPeer := fH.awaitData(chunk, "C"), fH.awaitData(chunk, "")
+
+	fH.ProcessDataReply(&core.DataReply{Origin: "B", HashValue: hash[:], Data: data})
+	for i, channel := range []chan *core.DataReply{first, second, anyPeer} {
+		select {
+		case <-channel:
+		default:
+			t.Fatalf("waiter %d did not get the reply", i)
+		}
+	}
+	select {
+	case <-other:
+		t.Fatal("reply from B reached the waiter for C")
+	default:
+	}
+
+	for _, channel := range []chan *core.DataReply{first, second, other, anyPeer} {
+		fH.stopAwaiting(chunk, channel)
+	}
+	if len(fH.bytesRequested) != 0 {
+		t.Fatalf("%d hashes still awaited", len(fH.bytesRequested))
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"io"
 	"log"
 	"os"
-	"strings"
 	"sync"
 )
 
@@ -16,28 +16,31 @@ const fileDirectory = "./_SharedFiles/"
 const downloadDirectory = "./_Downloads/"
 const chunkSize int64 = 8192
 
-//Metadata stores information on file indexing
+//Metadata stores information on file indexing. Chunk contents stay on disk, only the 1-based index of every chunk held
+//is kept, from which its offset in the file follows.
 type Metadata struct {
+	directory   string
 	fileName    string
 	fileSize    int64
 	metaFile    []byte
 	metahash    []byte
-	chunkMap    map[string][]byte
+	chunkIndex  map[string]uint64
 	totalChunks int
 	locker      sync.RWMutex
 }
 
-func createMetadata(fName string) (*Metadata, error) {
+func createMetadata(directory, fName string) (*Metadata, error) {
 	if len(fName) == 0 {
 		return nil, errors.New("File name could not be resolved: empty file name recieved")
 	}
 	metadata := &Metadata{
+		directory:   directory,
 		fileName:    fName,
-		chunkMap:    make(map[string][]byte),
+		chunkIndex:  make(map[string]uint64),
 		totalChunks: 0,
 	}
 
-	fileInfo, err := os.Stat(fileDirectory + fName)
+	fileInfo, err := os.Stat(directory + fName)
 	if err != nil {
 		return nil, errors.New("File name could not be resolved: file not found in directory")
 	}
@@ -47,7 +50,7 @@ func createMetadata(fName string) (*Metadata, error) {
 }
 
 func (metadata *Metadata) evaluateForFile() error {
-	f, err := os.Open(fileDirectory + metadata.fileName)
+	f, err := os.Open(metadata.directory + metadata.fileName)
 	if err != nil {
 		return err
 	}
@@ -61,13 +64,14 @@ func (metadata *Metadata) evaluateForFile() error {
 	chunkCount := 0
 	remainingBytes := metadata.fileSize
 	reader := bufio.NewReader(f)
+	buffer := make([]byte, chunkSize)
 	for remainingBytes > 0 {
 		bufferLength := chunkSize
 		if bufferLength > remainingBytes {
 			bufferLength = remainingBytes
 		}
-		chunk := make([]byte, bufferLength)
-		_, err := reader.Read(chunk)
+		chunk := buffer[:bufferLength]
+		_, err := io.ReadFull(reader, chunk)
 		if err != nil {
 			return err
 		}
@@ -75,7 +79,9 @@ func (metadata *Metadata) evaluateForFile() error {
 		hashedChunk := sha256.Sum256(chunk)
 		tmpHashedChunk := hashedChunk[:]
 		// fmt.Println("chunk:" + hex.EncodeToString(tmpHashedChunk))
-		metadata.chunkMap[hex.EncodeToString(tmpHashedChunk)] = chunk
+		if _, ok := metadata.chunkIndex[hex.EncodeToString(tmpHashedChunk)]; !ok {
+			metadata.chunkIndex[hex.EncodeToString(tmpHashedChunk)] = uint64(chunkCount + 1)
+		}
 		metadata.metaFile = append(metadata.metaFile, tmpHashedChunk...)
 		remainingBytes -= bufferLength
 		chunkCount++
@@ -94,83 +100,88 @@ func (metadata *Metadata) getMetaHash() []byte {
 	return metadata.metahash
 }
 
-func (metadata *Metadata) GetChunkByHash(chunkHash []byte) ([]byte, bool) {
+//hasChunk tells whether the chunk with the given hash is held
+func (metadata *Metadata) hasChunk(chunkHash []byte) bool {
 	metadata.locker.RLock()
 	defer metadata.locker.RUnlock()
-	resp, ok := metadata.chunkMap[hex.EncodeToString(chunkHash)]
-	return resp, ok
+	_, ok := metadata.chunkIndex[hex.EncodeToString(chunkHash)]
+	return ok
 }
 
-func (metadata *Metadata) validateHash(hashVal []byte) int {
+//readChunk reads a held chunk from the file at path, at the offset of its index. A chunk that no longer matches its hash,
+//because the file changed on disk, is not returned.
+func (metadata *Metadata) readChunk(path string, chunkHash []byte) ([]byte, bool) {
 	metadata.locker.RLock()
-	defer metadata.locker.RUnlock()
-	if bytes.Equal(metadata.metahash, hashVal) {
-		return 0
+	index, ok := metadata.chunkIndex[hex.EncodeToString(chunkHash)]
+	metadata.locker.RUnlock()
+	if !ok {
+		return nil, false
 	}
-	if _, ok := metadata.chunkMap[hex.EncodeToString(hashVal)]; ok {
-		return 1
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	chunk, err := readChunkAt(f, index)
+	if err != nil {
+		return nil, false
 	}
-	return 0
-}
-
-func (metadata *Metadata) addChunk(chunk []byte) {
-	metadata.locker.Lock()
-	defer metadata.locker.Unlock()
-	metadata.totalChunks++
 	hashedChunk := sha256.Sum256(chunk)
-	tmpHashedChunk := hashedChunk[:]
-	metadata.chunkMap[hex.EncodeToString(tmpHashedChunk)] = chunk
+	if !bytes.Equal(hashedChunk[:], chunkHash) {
+		return nil, false
+	}
+	return chunk, true
 }
 
-func (metadata *Metadata) reconstructFileBytes() []byte {
-	fileBytes := []byte{}
-	hashSize := 32
-	metadata.locker.RLock()
-	defer metadata.locker.RUnlock()
-	for i := 0; i < len(metadata.metaFile); i += hashSize {
-		fileBytes = append(fileBytes, metadata.chunkMap[hex.EncodeToString(metadata.metaFile[i:i+hashSize])]...)
+//readChunkAt reads the chunk at a 1-based index. The last chunk of a file may be shorter than the others.
+func readChunkAt(reader io.ReaderAt, index uint64) ([]byte, error) {
+	chunk := make([]byte, chunkSize)
+	n, err := reader.ReadAt(chunk, int64(index-1)*chunkSize)
+	if err != nil && (err != io.EOF || n == 0) {
+		return nil, err
 	}
-	metadata.fileSize = int64(len(fileBytes))
-	return fileBytes
+	return chunk[:n], nil
 }
 
-func (metadata *Metadata) writeFileBytesToDisk() error {
-	f, err := os.Create(downloadDirectory + metadata.fileName)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err = f.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	// fmt.Println("fileBytes:" + hex.EncodeToString(metadata.reconstructFileBytes()))
-	_, err = f.Write(metadata.reconstructFileBytes())
-	if err != nil {
-		return err
+//addChunk records that the chunk with the given hash is held, at a 1-based index
+func (metadata *Metadata) addChunk(chunkHash []byte, index uint64) {
+	metadata.locker.Lock()
+	defer metadata.locker.Unlock()
+	if _, ok := metadata.chunkIndex[hex.EncodeToString(chunkHash)]; ok {
+		return
 	}
-	return nil
+	metadata.totalChunks++
+	metadata.chunkIndex[hex.EncodeToString(chunkHash)] = index
 }
 
+//computeSize takes the size of the file from disk, once it is complete
 func (metadata *Metadata) computeSize() {
-	totalChunks := len(metadata.metaFile)
-	size := int64((totalChunks/32 - 1) * int(chunkSize))
-	size += int64(len(metadata.chunkMap[hex.EncodeToString(metadata.metaFile[(totalChunks/32-1)*32:])]))
-	metadata.fileSize = size
-	// fmt.Println(size)
+	fileInfo, err := os.Stat(metadata.directory + metadata.fileName)
+	if err != nil {
+		return
+	}
+	metadata.fileSize = fileInfo.Size()
 }
 
 func (metadata *Metadata) getChunkMapByIndex() []uint64 {
 	metadata.locker.RLock()
 	defer metadata.locker.RUnlock()
 	indices := []uint64{}
-	metafileString := hex.EncodeToString(metadata.metaFile)
-	for chunkHash := range metadata.chunkMap {
-		indices = append(indices, uint64(strings.Index(metafileString, chunkHash)/32)+1)
+	for i := 0; i+sha256.Size <= len(metadata.metaFile); i += sha256.Size {
+		if _, ok := metadata.chunkIndex[hex.EncodeToString(metadata.metaFile[i:i+sha256.Size])]; ok {
+			indices = append(indices, uint64(i/sha256.Size)+1)
+		}
 	}
 	return indices
 }
 
+//getChunkCount is the number of chunks the whole file is made of, known once the metafile is
+func (metadata *Metadata) getChunkCount() int {
+	metadata.locker.RLock()
+	defer metadata.locker.RUnlock()
+	return len(metadata.metaFile) / sha256.Size
+}
+
 func (metadata *Metadata) getTotalChunks() int {
 	metadata.locker.RLock()
 	defer metadata.locker.RUnlock()
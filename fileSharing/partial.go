@@ -0,0 +1,162 @@
+package filesharing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PART_SUFFIX  = ".part"
+	STATE_SUFFIX = ".state"
+)
+
+//partialHeader describes a download in its state sidecar: the file, and the chunks each known holder has
+type partialHeader struct {
+	Name     string
+	Metahash []byte
+	Metafile []byte
+	Holders  map[string][]uint64
+}
+
+//partialFile is a download in progress on disk. Chunks are written at their offset in a sparse part file, and the state sidecar
+//holds a length prefixed JSON header followed by one bit per chunk, set only once the chunk is safely on disk.
+type partialFile struct {
+	part         *os.File
+	state        *os.File
+	bitmap       []byte
+	bitmapOffset int64
+}
+
+func partPath(directory, fileName string) string {
+	return directory + fileName + PART_SUFFIX
+}
+
+func statePath(directory, fileName string) string {
+	return partPath(directory, fileName) + STATE_SUFFIX
+}
+
+//createPartial starts the on-disk state of a download, replacing that of any earlier download of the same name
+func createPartial(directory string, header partialHeader) (*partialFile, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(partPath(directory, header.Name)), 0755); err != nil {
+		return nil, err
+	}
+	part, err := os.Create(partPath(directory, header.Name))
+	if err != nil {
+		return nil, err
+	}
+	state, err := os.Create(statePath(directory, header.Name))
+	if err != nil {
+		part.Close()
+		return nil, err
+	}
+	partial := &partialFile{
+		part:         part,
+		state:        state,
+		bitmap:       make([]byte, (len(header.Metafile)/sha256.Size+7)/8),
+		bitmapOffset: int64(4 + len(encoded)),
+	}
+	contents := make([]byte, 4, int(partial.bitmapOffset)+len(partial.bitmap))
+	binary.BigEndian.PutUint32(contents, uint32(len(encoded)))
+	contents = append(append(contents, encoded...), partial.bitmap...)
+	if _, err = state.Write(contents); err == nil {
+		err = state.Sync()
+	}
+	if err != nil {
+		partial.close()
+		return nil, err
+	}
+	return partial, nil
+}
+
+//openPartial reopens the on-disk state of an interrupted download from its state sidecar
+func openPartial(directory, stateFile string) (*partialFile, *partialHeader, error) {
+	contents, err := os.ReadFile(directory + stateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(contents) < 4 {
+		return nil, nil, errors.New("truncated state file")
+	}
+	headerLength := int(binary.BigEndian.Uint32(contents))
+	if len(contents) < 4+headerLength {
+		return nil, nil, errors.New("truncated state file")
+	}
+	header := &partialHeader{}
+	if err = json.Unmarshal(contents[4:4+headerLength], header); err != nil {
+		return nil, nil, err
+	}
+	bitmap := contents[4+headerLength:]
+	if len(header.Metafile)%sha256.Size != 0 || len(bitmap) != (len(header.Metafile)/sha256.Size+7)/8 {
+		return nil, nil, errors.New("state file does not match its metafile")
+	}
+	metahash := sha256.Sum256(header.Metafile)
+	if !bytes.Equal(metahash[:], header.Metahash) {
+		return nil, nil, errors.New("state file does not match its metahash")
+	}
+	part, err := os.OpenFile(partPath(directory, header.Name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := os.OpenFile(directory+stateFile, os.O_RDWR, 0644)
+	if err != nil {
+		part.Close()
+		return nil, nil, err
+	}
+	return &partialFile{part: part, state: state, bitmap: bitmap, bitmapOffset: int64(4 + headerLength)}, header, nil
+}
+
+//has tells whether the chunk at a 1-based index was written
+func (partial *partialFile) has(index uint64) bool {
+	return partial.bitmap[(index-1)/8]&(1<<((index-1)%8)) != 0
+}
+
+//mark sets or clears the bit of the chunk at a 1-based index
+func (partial *partialFile) mark(index uint64, written bool) error {
+	position := (index - 1) / 8
+	if written {
+		partial.bitmap[position] |= 1 << ((index - 1) % 8)
+	} else {
+		partial.bitmap[position] &^= 1 << ((index - 1) % 8)
+	}
+	_, err := partial.state.WriteAt(partial.bitmap[position:position+1], partial.bitmapOffset+int64(position))
+	return err
+}
+
+//writeChunk writes a chunk at a 1-based index and only then marks it as written
+func (partial *partialFile) writeChunk(index uint64, chunk []byte) error {
+	if _, err := partial.part.WriteAt(chunk, int64(index-1)*chunkSize); err != nil {
+		return err
+	}
+	if err := partial.part.Sync(); err != nil {
+		return err
+	}
+	return partial.mark(index, true)
+}
+
+//readChunk reads back the chunk at a 1-based index
+func (partial *partialFile) readChunk(index uint64) ([]byte, error) {
+	return readChunkAt(partial.part, index)
+}
+
+//finish moves the completed part file to its final name and drops the state sidecar
+func (partial *partialFile) finish(directory, fileName string) error {
+	partial.close()
+	if err := os.Rename(partPath(directory, fileName), directory+fileName); err != nil {
+		return err
+	}
+	return os.Remove(statePath(directory, fileName))
+}
+
+func (partial *partialFile) close() {
+	partial.part.Close()
+	partial.state.Close()
+}
@@ -0,0 +1,171 @@
+package filesharing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	FILES_SNAPSHOT       = "files"
+	DIRECTORIES_SNAPSHOT = "directories"
+)
+
+//indexedFileEntry records where an indexed file lives on disk. Chunks are not snapshotted, they are re-read from the file itself.
+type indexedFileEntry struct {
+	Name      string
+	Directory string
+}
+
+//Save snapshots the list of fully indexed files and of shared directories keyed by hex metahash
+func (fH *FileHandler) Save(store *core.Store) error {
+	fH.fileLocker.RLock()
+	defer fH.fileLocker.RUnlock()
+	snapshot := make(map[string]indexedFileEntry)
+	for metahash, file := range fH.indexedFiles {
+		if file.status != INDEXED {
+			continue
+		}
+		snapshot[metahash] = indexedFileEntry{Name: file.Name, Directory: file.meta.directory}
+	}
+	if err := store.Put(FILES_SNAPSHOT, snapshot); err != nil {
+		return err
+	}
+	directories := make(map[string]indexedFileEntry)
+	for metahash, directory := range fH.directories {
+		directories[metahash] = indexedFileEntry{Name: directory.Name, Directory: directory.directory}
+	}
+	return store.Put(DIRECTORIES_SNAPSHOT, directories)
+}
+
+//Restore re-indexes the files saved by a previous run, skipping those that changed or disappeared since
+func (fH *FileHandler) Restore(store *core.Store) error {
+	snapshot := make(map[string]indexedFileEntry)
+	found, err := store.Get(FILES_SNAPSHOT, &snapshot)
+	if err != nil || !found {
+		return err
+	}
+	for metahash, entry := range snapshot {
+		expected, err := hex.DecodeString(metahash)
+		if err != nil {
+			return err
+		}
+		file, err := newIndexedFileIn(entry.Directory, entry.Name)
+		if err != nil {
+			fmt.Println("Could not restore file", entry.Name, ":", err)
+			continue
+		}
+		if !bytes.Equal(file.GetMetaHash(), expected) {
+			fmt.Println("Could not restore file", entry.Name, ": contents changed since last run")
+			continue
+		}
+		fH.addToFiles(file)
+	}
+	return fH.restoreDirectories(store)
+}
+
+//restoreDirectories re-indexes the directories shared by a previous run whose contents did not change since
+func (fH *FileHandler) restoreDirectories(store *core.Store) error {
+	snapshot := make(map[string]indexedFileEntry)
+	found, err := store.Get(DIRECTORIES_SNAPSHOT, &snapshot)
+	if err != nil || !found {
+		return err
+	}
+	for metahash, entry := range snapshot {
+		directory, files, err := newDirectoryIn(entry.Directory, entry.Name)
+		if err != nil {
+			fmt.Println("Could not restore directory", entry.Name, ":", err)
+			continue
+		}
+		if hex.EncodeToString(directory.GetMetaHash()) != metahash {
+			fmt.Println("Could not restore directory", entry.Name, ": contents changed since last run")
+			continue
+		}
+		for _, file := range files {
+			fH.addToFiles(file)
+		}
+		fH.addToDirectories(directory)
+	}
+	return nil
+}
+
+//ResumeDownloads picks up the downloads a previous run left unfinished in the download directory. Chunks on disk are checked
+//against the metafile before being kept, and the missing ones are fetched from the holders known when the download started.
+//Directory downloads are resumed once their files are, so that they wait for the files under way rather than request them again.
+func (fH *FileHandler) ResumeDownloads() {
+	stateFiles := []string{}
+	directoryStates := []string{}
+	filepath.WalkDir(downloadDirectory, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(downloadDirectory, filePath)
+		if err != nil {
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(filePath, PART_SUFFIX+STATE_SUFFIX):
+			stateFiles = append(stateFiles, filepath.ToSlash(relative))
+		case strings.HasSuffix(filePath, MANIFEST_STATE_SUFFIX):
+			directoryStates = append(directoryStates, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	for _, stateFile := range stateFiles {
+		file, holders, err := newResumedFile(downloadDirectory, stateFile)
+		if err != nil {
+			fmt.Println("Could not resume download", stateFile, ":", err)
+			continue
+		}
+		metahash := hex.EncodeToString(file.GetMetaHash())
+		fH.fileLocker.Lock()
+		if _, ok := fH.indexedFiles[metahash]; ok {
+			fH.fileLocker.Unlock()
+			file.partial.close()
+			continue
+		}
+		fH.indexedFiles[metahash] = file
+		fH.fileLocker.Unlock()
+		fmt.Println("RESUMING download of", file.Name, "with", len(file.GetChunkMapByIndex()), "of", file.GetChunkCount(), "chunks on disk")
+		go fH.resumeSwarm(metahash, file.meta.metaFile, holders)
+	}
+	for _, stateFile := range directoryStates {
+		state, err := loadDirectoryState(stateFile)
+		if err != nil {
+			fmt.Println("Could not resume download", stateFile, ":", err)
+			continue
+		}
+		fmt.Println("RESUMING download of directory", state.Name)
+		go fH.downloadDirectory(state.Name, state.Metahash, state.Manifest, state.Holders)
+	}
+}
+
+//resumeSwarm waits for a route to one of the holders of a resumed download before fetching its missing chunks
+func (fH *FileHandler) resumeSwarm(metahash string, metafile []byte, holders map[string][]uint64) {
+	for len(holders) > 0 {
+		reachable := false
+		for holder := range holders {
+			if found, _ := fH.ctx.RetrieveDestinationRoute(holder); found == 1 {
+				reachable = true
+				break
+			}
+		}
+		if reachable {
+			break
+		}
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-timer.C:
+		case <-fH.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+	fH.startSwarm(metahash, metafile, holders)
+}
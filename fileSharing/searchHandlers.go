@@ -65,6 +65,7 @@ func (fH *FileHandler) LaunchSearch(keywordString *string, budgetReceived *uint6
 	fH.searchLocker.Lock()
 	fH.ongoingSearch = true
 	fH.searchMatches = make(map[string]map[string][]string)
+	fH.chunkHolders = make(map[string]map[string][]uint64)
 	fH.searchLocker.Unlock()
 	if budgetReceived != nil {
 		go fH.forwardSearchRequest(fH.ctx.Address.String(), searchRequest, *budgetReceived)
@@ -134,6 +135,9 @@ func (fH *FileHandler) forwardSearchRequest(sender string, searchRequest *core.S
 		}
 	}
 	totalPeers := len(peerList)
+	if totalPeers == 0 {
+		return
+	}
 	if int(totalBudget) < totalPeers {
 		searchRequest.Budget = 1
 		for _, peer := range core.RandomPeers(int(totalBudget), peerList) {
@@ -170,12 +174,12 @@ func (fH *FileHandler) performLocalSearch(keywords []string) ([]*core.SearchResu
 				break
 			}
 		}
-		if match {
+		if match && file.GetChunkCount() > 0 {
 			searchResult := &core.SearchResult{
 				FileName:     file.Name,
 				MetafileHash: file.GetMetaHash(),
 				ChunkMap:     file.GetChunkMapByIndex(),
-				ChunkCount:   uint64(file.GetTotalChunks()),
+				ChunkCount:   uint64(file.GetChunkCount()),
 			}
 			results = append(results, searchResult)
 		}
@@ -212,6 +216,7 @@ func (fH *FileHandler) handleSearchReply(searchReply *core.SearchReply) {
 func (fH *FileHandler) processSearchReply(searchReply *core.SearchReply) {
 
 	for _, result := range searchReply.Results {
+		fH.registerChunkMap(result, searchReply.Origin)
 		if isMatch(result) && !fH.isRegistered(result, searchReply.Origin) {
 			fH.registerSearchMatch(result, searchReply.Origin)
 			fmt.Println("FOUND match", result.FileName, "at", searchReply.Origin, "metafile="+hex.EncodeToString(result.MetafileHash), "chunks="+getChunkMapString(result.ChunkMap))
@@ -254,6 +259,43 @@ func (fH *FileHandler) registerSearchMatch(searchResult *core.SearchResult, orig
 	fH.searchMatches[searchResult.FileName][hex.EncodeToString(searchResult.MetafileHash)] = append(fH.searchMatches[searchResult.FileName][hex.EncodeToString(searchResult.MetafileHash)], origin)
 }
 
+//registerChunkMap records which chunks of a file the origin of a search result holds, whether it holds all of them or not
+func (fH *FileHandler) registerChunkMap(searchResult *core.SearchResult, origin string) {
+	if len(searchResult.ChunkMap) == 0 {
+		return
+	}
+	fH.searchLocker.Lock()
+	defer fH.searchLocker.Unlock()
+	metahash := hex.EncodeToString(searchResult.MetafileHash)
+	if _, ok := fH.chunkHolders[metahash]; !ok {
+		fH.chunkHolders[metahash] = make(map[string][]uint64)
+	}
+	fH.chunkHolders[metahash][origin] = searchResult.ChunkMap
+}
+
+//getHolders returns the peers found holding a whole file, and the chunk maps of those holding only part of it
+func (fH *FileHandler) getHolders(fileName, metahash string) ([]string, map[string][]uint64) {
+	fH.searchLocker.RLock()
+	defer fH.searchLocker.RUnlock()
+	complete := append([]string{}, fH.searchMatches[fileName][metahash]...)
+	partial := make(map[string][]uint64)
+	for origin, chunkMap := range fH.chunkHolders[metahash] {
+		if !containsOrigin(complete, origin) {
+			partial[origin] = chunkMap
+		}
+	}
+	return complete, partial
+}
+
+func containsOrigin(origins []string, origin string) bool {
+	for _, o := range origins {
+		if strings.Compare(o, origin) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func getChunkMapString(chunkMap []uint64) string {
 	res := strconv.FormatUint(chunkMap[0], 10)
 	for i := 1; i < len(chunkMap); i++ {
@@ -0,0 +1,289 @@
+package filesharing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	MAX_INFLIGHT_PER_PEER = 4
+	CHUNK_TIMEOUT         = 5 * time.Second
+	MAX_PEER_FAILURES     = 3
+)
+
+//swarmPeer is a peer a download fetches chunks from, with how it has been answering so far
+type swarmPeer struct {
+	name     string
+	inFlight int
+	failures int
+	rtt      time.Duration
+}
+
+//limit is the number of requests a peer may have in flight. It halves with every request the peer let time out in a row.
+func (peer *swarmPeer) limit() int {
+	limit := MAX_INFLIGHT_PER_PEER >> uint(peer.failures)
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+//preferredTo tells whether a request should rather go to peer than to other: fewer recent timeouts first, then less load, then faster replies
+func (peer *swarmPeer) preferredTo(other *swarmPeer) bool {
+	if peer.failures != other.failures {
+		return peer.failures < other.failures
+	}
+	if peer.inFlight != other.inFlight {
+		return peer.inFlight < other.inFlight
+	}
+	return peer.rtt < other.rtt
+}
+
+//swarmDownload fetches the chunks of a file from every peer known to hold them, rarest chunks first.
+//Chunks are keyed by hex hash, a chunk appearing several times in the file is fetched once.
+type swarmDownload struct {
+	fH          *FileHandler
+	metahash    string
+	name        string
+	indices     map[string][]uint64
+	swarmLocker sync.Mutex
+	holders     map[string]map[string]bool
+	peers       map[string]*swarmPeer
+	missing     map[string]bool
+	inFlight    map[string]string
+	finished    bool
+}
+
+//startSwarm downloads the chunks listed in a metafile from the given holders, each with the 1-based indices of the chunks it holds
+func (fH *FileHandler) startSwarm(metahash string, metafile []byte, chunkMaps map[string][]uint64) {
+	download := &swarmDownload{
+		fH:       fH,
+		metahash: metahash,
+		indices:  make(map[string][]uint64),
+		holders:  make(map[string]map[string]bool),
+		peers:    make(map[string]*swarmPeer),
+		missing:  make(map[string]bool),
+		inFlight: make(map[string]string),
+	}
+	byIndex := make(map[uint64]string)
+	for i := 0; i+sha256.Size <= len(metafile); i += sha256.Size {
+		chunk := hex.EncodeToString(metafile[i : i+sha256.Size])
+		index := uint64(i/sha256.Size + 1)
+		byIndex[index] = chunk
+		download.indices[chunk] = append(download.indices[chunk], index)
+		download.holders[chunk] = make(map[string]bool)
+		download.missing[chunk] = true
+	}
+
+	fH.fileLocker.Lock()
+	file := fH.indexedFiles[metahash]
+	download.name = file.Name
+	progress := 0
+	for chunk, indices := range download.indices {
+		hashValue, _ := hex.DecodeString(chunk)
+		if file.meta.hasChunk(hashValue) {
+			//Resumed from disk
+			delete(download.missing, chunk)
+			continue
+		}
+		progress += len(indices)
+	}
+	fH.DownloadProgress[metahash] = progress
+	if file.partial == nil {
+		if err := file.startPartial(chunkMaps); err != nil {
+			fH.fileLocker.Unlock()
+			download.swarmLocker.Lock()
+			defer download.swarmLocker.Unlock()
+			download.abort(err.Error())
+			return
+		}
+	}
+	fH.fileLocker.Unlock()
+
+	for peer, chunkMap := range chunkMaps {
+		download.peers[peer] = &swarmPeer{name: peer}
+		for _, index := range chunkMap {
+			if chunk, ok := byIndex[index]; ok {
+				download.holders[chunk][peer] = true
+			}
+		}
+	}
+
+	download.swarmLocker.Lock()
+	defer download.swarmLocker.Unlock()
+	download.schedule()
+	download.checkFinished()
+}
+
+//schedule sends as many chunk requests as the peers have room for. Must be called with the lock held.
+func (download *swarmDownload) schedule() {
+	for {
+		chunk, peer := download.next()
+		if peer == nil {
+			return
+		}
+		delete(download.missing, chunk)
+		download.inFlight[chunk] = peer.name
+		peer.inFlight++
+		go download.fetch(chunk, peer.name)
+	}
+}
+
+//next picks the rarest missing chunk that a holder has room for, along with the holder to request it from
+func (download *swarmDownload) next() (string, *swarmPeer) {
+	var bestChunk string
+	var bestPeer *swarmPeer
+	bestRarity := 0
+	for chunk := range download.missing {
+		rarity := 0
+		var candidate *swarmPeer
+		for name := range download.holders[chunk] {
+			peer, ok := download.peers[name]
+			if !ok {
+				continue
+			}
+			rarity++
+			if peer.inFlight < peer.limit() && (candidate == nil || peer.preferredTo(candidate)) {
+				candidate = peer
+			}
+		}
+		if candidate == nil {
+			continue
+		}
+		if bestPeer == nil || rarity < bestRarity || (rarity == bestRarity && download.indices[chunk][0] < download.indices[bestChunk][0]) {
+			bestChunk, bestPeer, bestRarity = chunk, candidate, rarity
+		}
+	}
+	return bestChunk, bestPeer
+}
+
+//fetch requests a chunk from a peer and waits for the reply for at most CHUNK_TIMEOUT
+func (download *swarmDownload) fetch(chunk, peer string) {
+	fH := download.fH
+	hashValue, _ := hex.DecodeString(chunk)
+	channel := fH.awaitData(chunk, peer)
+
+	fmt.Println("DOWNLOADING", download.name, "chunk", download.indices[chunk][0], "from", peer)
+	started := time.Now()
+	fH.sendDataRequest(&core.DataRequest{Destination: peer, HopLimit: fH.ctx.GetHopLimit(), HashValue: hashValue})
+	var reply *core.DataReply
+	select {
+	case reply = <-channel:
+	case <-time.After(CHUNK_TIMEOUT):
+	case <-fH.ctx.Done():
+	}
+
+	fH.stopAwaiting(chunk, channel)
+	download.settle(chunk, peer, reply, time.Since(started))
+}
+
+//settle accounts for the outcome of a chunk request, a nil reply meaning it timed out, and schedules the next requests
+func (download *swarmDownload) settle(chunk, name string, reply *core.DataReply, elapsed time.Duration) {
+	download.swarmLocker.Lock()
+	defer download.swarmLocker.Unlock()
+	delete(download.inFlight, chunk)
+	peer := download.peers[name]
+	if peer != nil {
+		peer.inFlight--
+	}
+	if download.finished {
+		return
+	}
+	select {
+	case <-download.fH.ctx.Done():
+		download.abort("gossiper stopped")
+		return
+	default:
+	}
+	switch {
+	case reply != nil && len(reply.Data) > 0:
+		if peer != nil {
+			peer.failures = 0
+			if peer.rtt == 0 {
+				peer.rtt = elapsed
+			} else {
+				peer.rtt = (7*peer.rtt + elapsed) / 8
+			}
+		}
+		if err := download.store(chunk, reply.Data); err != nil {
+			download.abort(err.Error())
+			return
+		}
+	case reply != nil:
+		//The peer does not hold the chunk after all
+		delete(download.holders[chunk], name)
+		download.missing[chunk] = true
+	default:
+		download.missing[chunk] = true
+		if peer != nil {
+			peer.failures++
+			//Once the last peer is dropped the download fails, to be resumed from disk when requested again or at the next start
+			if peer.failures >= MAX_PEER_FAILURES {
+				fmt.Println("DROPPING", name, "from download of", download.name, "after", peer.failures, "timeouts")
+				delete(download.peers, name)
+			}
+		}
+	}
+	download.schedule()
+	download.checkFinished()
+}
+
+func (download *swarmDownload) store(chunk string, data []byte) error {
+	fH := download.fH
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	if err := fH.indexedFiles[download.metahash].storeChunk(download.indices[chunk], data); err != nil {
+		return err
+	}
+	fH.DownloadProgress[download.metahash] -= len(download.indices[chunk])
+	return nil
+}
+
+//checkFinished completes the download once every chunk arrived, and gives up when the chunks left have no holder. Must be called with the lock held.
+func (download *swarmDownload) checkFinished() {
+	if download.finished || len(download.inFlight) > 0 {
+		return
+	}
+	if len(download.missing) > 0 {
+		//Nothing in flight and nothing could be scheduled: no peer left holds the missing chunks
+		for chunk := range download.missing {
+			download.abort(fmt.Sprint("no peer holds chunk ", download.indices[chunk][0]))
+			return
+		}
+	}
+	download.finished = true
+	fH := download.fH
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	file := fH.indexedFiles[download.metahash]
+	if err := file.saveFile(); err != nil {
+		fmt.Println("DOWNLOAD FAILED of", download.name, ":", err)
+		file.status = INCOMPLETE
+		fH.settleDownload(download.metahash, false)
+		return
+	}
+	file.status = INDEXED
+	fH.settleDownload(download.metahash, true)
+}
+
+//abort gives up on the download. Its state stays on disk, so that it is resumed at the next start or when requested again.
+//Must be called with the lock held.
+func (download *swarmDownload) abort(reason string) {
+	download.finished = true
+	fmt.Println("DOWNLOAD FAILED of", download.name, ":", reason)
+	fH := download.fH
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	file := fH.indexedFiles[download.metahash]
+	file.status = INCOMPLETE
+	if file.partial != nil {
+		file.partial.close()
+		file.partial = nil
+	}
+	fH.settleDownload(download.metahash, false)
+}
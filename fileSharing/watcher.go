@@ -0,0 +1,266 @@
+package filesharing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_WATCH_DEBOUNCE = 2 * time.Second
+
+//fileStamp tells whether a file changed on disk since it was last seen
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+//pendingChange is a file seen changing, waiting to stay unchanged for the debounce delay before being indexed
+type pendingChange struct {
+	stamp fileStamp
+	since time.Time
+}
+
+//Watcher polls the shared folder, indexing new files and reindexing modified ones once they stopped changing for the debounce delay,
+//and retiring deleted ones. Shared directories are kept in line with the files below them.
+type Watcher struct {
+	fH              *FileHandler
+	debounce        time.Duration
+	watchLocker     sync.Mutex
+	indexed         map[string]fileStamp
+	hashes          map[string]string
+	changed         map[string]pendingChange
+	indexedHandlers []func(name string, size int64, metahash []byte)
+}
+
+//NewWatcher creates a watcher of the shared folder. A non positive debounce falls back to the default.
+func NewWatcher(fH *FileHandler, debounce time.Duration) *Watcher {
+	if debounce <= 0 {
+		debounce = DEFAULT_WATCH_DEBOUNCE
+	}
+	return &Watcher{
+		fH:       fH,
+		debounce: debounce,
+		indexed:  make(map[string]fileStamp),
+		hashes:   make(map[string]string),
+		changed:  make(map[string]pendingChange),
+	}
+}
+
+//OnIndexed registers a handler called with every file or directory whose contents the watcher indexed anew
+func (watcher *Watcher) OnIndexed(handler func(name string, size int64, metahash []byte)) {
+	watcher.watchLocker.Lock()
+	defer watcher.watchLocker.Unlock()
+	watcher.indexedHandlers = append(watcher.indexedHandlers, handler)
+}
+
+//Start scans the shared folder every interval until the context is stopped
+func (watcher *Watcher) Start(interval time.Duration) {
+	watcher.scan(time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			watcher.scan(now)
+		case <-watcher.fH.ctx.Done():
+			return
+		}
+	}
+}
+
+func (watcher *Watcher) scan(now time.Time) {
+	current := listFiles(fileDirectory)
+	ready := []string{}
+	deleted := []string{}
+	watcher.watchLocker.Lock()
+	for name, stamp := range current {
+		if indexed, ok := watcher.indexed[name]; ok && indexed == stamp {
+			delete(watcher.changed, name)
+			continue
+		}
+		pending, ok := watcher.changed[name]
+		if !ok || pending.stamp != stamp {
+			watcher.changed[name] = pendingChange{stamp: stamp, since: now}
+			continue
+		}
+		if now.Sub(pending.since) >= watcher.debounce {
+			delete(watcher.changed, name)
+			ready = append(ready, name)
+		}
+	}
+	for name := range watcher.changed {
+		if _, ok := current[name]; !ok {
+			delete(watcher.changed, name)
+		}
+	}
+	for name := range watcher.indexed {
+		if _, ok := current[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	for _, name := range deleted {
+		//Files with the same contents share one index entry, those left are indexed again once it is retired
+		for other, hash := range watcher.hashes {
+			if hash == watcher.hashes[name] && other != name {
+				delete(watcher.indexed, other)
+			}
+		}
+		delete(watcher.indexed, name)
+		delete(watcher.hashes, name)
+	}
+	watcher.watchLocker.Unlock()
+
+	touched := []string{}
+	for _, name := range ready {
+		if watcher.reindex(name, current[name]) {
+			touched = append(touched, name)
+		}
+	}
+	for _, name := range deleted {
+		watcher.fH.retireFile(fileDirectory, name)
+		fmt.Println("RETIRED file", name)
+		touched = append(touched, name)
+	}
+	for _, directory := range watcher.fH.sharedDirectoriesOf(touched) {
+		if size, metahash, changed := watcher.fH.refreshDirectory(directory); changed && metahash != nil {
+			fmt.Println("REINDEXED directory", directory, "metafile="+hex.EncodeToString(metahash))
+			watcher.notify(directory, size, metahash)
+		}
+	}
+}
+
+//reindex indexes a file that stopped changing and reports whether its contents differ from those indexed before
+func (watcher *Watcher) reindex(name string, stamp fileStamp) bool {
+	file, err := newIndexedFileIn(fileDirectory, name)
+	if err != nil {
+		fmt.Println("Could not index file", name, ":", err)
+		return false
+	}
+	watcher.watchLocker.Lock()
+	watcher.indexed[name] = stamp
+	watcher.hashes[name] = hex.EncodeToString(file.GetMetaHash())
+	watcher.watchLocker.Unlock()
+	if !watcher.fH.replaceFile(file) {
+		return false
+	}
+	fmt.Println("INDEXED file", name, "metafile="+hex.EncodeToString(file.GetMetaHash()))
+	watcher.notify(name, file.GetSize(), file.GetMetaHash())
+	return true
+}
+
+func (watcher *Watcher) notify(name string, size int64, metahash []byte) {
+	watcher.watchLocker.Lock()
+	handlers := watcher.indexedHandlers
+	watcher.watchLocker.Unlock()
+	for _, handler := range handlers {
+		go handler(name, size, metahash)
+	}
+}
+
+//listFiles stamps every regular file below a directory, by slash separated path relative to it
+func listFiles(directory string) map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	filepath.WalkDir(directory, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if relative, err := filepath.Rel(directory, filePath); err == nil {
+			files[filepath.ToSlash(relative)] = fileStamp{size: info.Size(), modTime: info.ModTime().UnixNano()}
+		}
+		return nil
+	})
+	return files
+}
+
+//replaceFile indexes a file in place of the earlier versions of the same file, and reports whether its contents are new
+func (fH *FileHandler) replaceFile(file *File) bool {
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	metahash := hex.EncodeToString(file.GetMetaHash())
+	if existing, ok := fH.indexedFiles[metahash]; ok && existing.Name == file.Name && existing.meta.directory == file.meta.directory {
+		return false
+	}
+	for hash, existing := range fH.indexedFiles {
+		if existing.Name == file.Name && existing.meta.directory == file.meta.directory {
+			delete(fH.indexedFiles, hash)
+		}
+	}
+	fH.indexedFiles[metahash] = file
+	return true
+}
+
+//retireFile stops sharing a file that was deleted from a directory
+func (fH *FileHandler) retireFile(directory, name string) {
+	fH.fileLocker.Lock()
+	defer fH.fileLocker.Unlock()
+	for hash, existing := range fH.indexedFiles {
+		if existing.Name == name && existing.meta.directory == directory {
+			delete(fH.indexedFiles, hash)
+		}
+	}
+}
+
+//sharedDirectoriesOf returns the directories shared from the shared folder that contain any of the given files
+func (fH *FileHandler) sharedDirectoriesOf(names []string) []string {
+	fH.fileLocker.RLock()
+	defer fH.fileLocker.RUnlock()
+	directories := []string{}
+	for _, directory := range fH.directories {
+		if directory.directory != fileDirectory {
+			continue
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, directory.Name+"/") {
+				directories = append(directories, directory.Name)
+				break
+			}
+		}
+	}
+	return directories
+}
+
+//refreshDirectory indexes a shared directory again and reports whether its manifest changed. A directory that
+//disappeared is retired, which is reported as a change with no metahash.
+func (fH *FileHandler) refreshDirectory(dirName string) (int64, []byte, bool) {
+	fH.fileLocker.RLock()
+	oldHash := ""
+	for hash, candidate := range fH.directories {
+		if candidate.Name == dirName && candidate.directory == fileDirectory {
+			oldHash = hash
+		}
+	}
+	fH.fileLocker.RUnlock()
+	if len(oldHash) == 0 {
+		return 0, nil, false
+	}
+	directory, _, err := newDirectoryIn(fileDirectory, dirName)
+	if os.IsNotExist(err) {
+		fH.fileLocker.Lock()
+		delete(fH.directories, oldHash)
+		fH.fileLocker.Unlock()
+		fmt.Println("RETIRED directory", dirName)
+		return 0, nil, true
+	}
+	if err != nil {
+		fmt.Println("Could not index directory", dirName, ":", err)
+		return 0, nil, false
+	}
+	metahash := hex.EncodeToString(directory.GetMetaHash())
+	if metahash == oldHash {
+		return 0, nil, false
+	}
+	fH.fileLocker.Lock()
+	delete(fH.directories, oldHash)
+	fH.directories[metahash] = directory
+	fH.fileLocker.Unlock()
+	return directory.GetSize(), directory.GetMetaHash(), true
+}
@@ -1,6 +1,7 @@
 package gossiper
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -9,7 +10,9 @@ import (
 
 	"github.com/dedis/protobuf"
 	core "github.com/ksei/Peerster/Core"
+	discovery "github.com/ksei/Peerster/Discovery"
 	mng "github.com/ksei/Peerster/Mongering"
+	rt "github.com/ksei/Peerster/Routing"
 	"github.com/ksei/Peerster/SecretSharing"
 	tlc "github.com/ksei/Peerster/TLC"
 	fh "github.com/ksei/Peerster/fileSharing"
@@ -17,6 +20,31 @@ import (
 )
 
 const localAddress = "127.0.0.1"
+const clientBufferSize = 65536
+
+//Options groups optional gossiper settings
+type Options struct {
+	EncryptPrivate bool
+	DataDir        string
+	RouteExpiry    int
+	PeerSuspect    int
+	PeerDead       int
+	PeerExchange   int
+	SyncBatch      int
+	Strategy       string
+	Fanout         int
+	Decay          float64
+	AckTimeout     int
+	Retention      int
+	OrderDelivery  int
+	Mailbox        bool
+	MailboxExpiry  int
+	MailboxSize    int
+	KeyDir         string
+	Watch          int
+	WatchDebounce  int
+	WatchPublish   bool
+}
 
 //Gossiper basic instance
 type Gossiper struct {
@@ -26,43 +54,151 @@ type Gossiper struct {
 	fileHandler           *fh.FileHandler
 	mongerer              *mng.Mongerer
 	messageHandler        *mh.MessageHandler
+	router                *rt.Router
 	tlcHandler            *tlc.TLCHandler
 	shamirHandler         *SecretSharing.SSHandler
+	discoverer            *discovery.Discoverer
+	watcher               *fh.Watcher
+	clientServer          *net.UDPConn
+	persistents           []core.Persistent
 }
 
 //NewGossiper method
-func NewGossiper(address, name, UIp string, useSimpleMode, hw3ex2, hw3ex3 bool, antiEntropy, routing, totalPeers, stubbornTimeout, hopLimit int) (*Gossiper, *core.Context) {
+func NewGossiper(address, name, UIp string, useSimpleMode, hw3ex2, hw3ex3 bool, antiEntropy, routing, totalPeers, stubbornTimeout, hopLimit int, options Options) (*Gossiper, *core.Context) {
+	transport, err := core.NewUDPTransport(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gossiper, ctx, err := NewGossiperWithTransport(transport, name, UIp, useSimpleMode, hw3ex2, hw3ex3, antiEntropy, routing, totalPeers, stubbornTimeout, hopLimit, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return gossiper, ctx
+}
+
+//NewGossiperWithTransport creates a gossiper exchanging peer packets over the given transport. Client messages are read from the
+//UI port if one is given, a gossiper without one only takes those passed to HandleClientMessage, so that several can run in one process.
+func NewGossiperWithTransport(transport core.Transport, name, UIp string, useSimpleMode, hw3ex2, hw3ex3 bool, antiEntropy, routing, totalPeers, stubbornTimeout, hopLimit int, options Options) (*Gossiper, *core.Context, error) {
 	gossiper := &Gossiper{
 		clientIncomingChannel: make(chan core.Message, 50),
 		peerIncomingChannel:   make(chan core.InternalPacket, 50),
 	}
-	gossiper.ctx = core.CreateContext(address, name, UIp, useSimpleMode, hw3ex2, hw3ex3, uint32(hopLimit))
+	ctx, err := core.CreateContextWithTransport(transport, name, UIp, useSimpleMode, hw3ex2, hw3ex3, uint32(hopLimit))
+	if err != nil {
+		return nil, nil, err
+	}
+	gossiper.ctx = ctx
+	if len(options.KeyDir) > 0 {
+		if err := gossiper.ctx.LoadKeys(options.KeyDir); err != nil {
+			return nil, nil, err
+		}
+	}
+	strategy, err := mng.NewStrategy(options.Strategy, options.Fanout, options.Decay)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(UIp) > 0 {
+		udpAddress, err := net.ResolveUDPAddr("udp4", localAddress+":"+UIp)
+		if err != nil {
+			return nil, nil, err
+		}
+		if gossiper.clientServer, err = net.ListenUDP("udp4", udpAddress); err != nil {
+			return nil, nil, err
+		}
+	}
 	gossiper.fileHandler = fh.NewFileHandler(gossiper.ctx)
-	gossiper.mongerer = mng.NewMongerer(gossiper.ctx, antiEntropy)
-	gossiper.messageHandler = mh.NewMessageHandler(gossiper.mongerer)
+	gossiper.mongerer = mng.NewMongerer(gossiper.ctx, options.SyncBatch, strategy, time.Duration(options.AckTimeout)*time.Second)
+	gossiper.messageHandler = mh.NewMessageHandler(gossiper.mongerer, options.EncryptPrivate, time.Duration(options.OrderDelivery)*time.Second)
+	if options.Mailbox {
+		gossiper.messageHandler.EnableMailbox(time.Duration(options.MailboxExpiry)*time.Second, options.MailboxSize)
+	}
+	gossiper.router = rt.NewRouter(gossiper.ctx)
+	gossiper.router.OnReachable(gossiper.messageHandler.OriginReachable)
 	gossiper.tlcHandler = tlc.NewTLCHandler(gossiper.mongerer, totalPeers, stubbornTimeout)
 	gossiper.shamirHandler = SecretSharing.NewSSHandler(gossiper.ctx)
-	go gossiper.ListenToClients()
-	go gossiper.ListenToPeers()
-	go gossiper.startRouting(routing)
-	go gossiper.waitForIncomingClientMessage()
-	go gossiper.waitForIncomingPeerMessage()
-	return gossiper, gossiper.ctx
+	if !useSimpleMode {
+		gossiper.discoverer = discovery.NewDiscoverer(gossiper.ctx, options.PeerExchange)
+	}
+	if len(options.DataDir) > 0 {
+		if err := gossiper.restoreState(options.DataDir); err != nil {
+			gossiper.closeClients()
+			return nil, nil, err
+		}
+	}
+	if options.Watch > 0 {
+		gossiper.watcher = fh.NewWatcher(gossiper.fileHandler, time.Duration(options.WatchDebounce)*time.Second)
+		if options.WatchPublish && gossiper.ctx.RunningHw3Ex2() {
+			gossiper.watcher.OnIndexed(gossiper.publishFile)
+		}
+	}
+	routeExpiry := options.RouteExpiry
+	if routeExpiry == 0 {
+		routeExpiry = core.ROUTE_EXPIRY_FACTOR * routing
+	}
+	if routeExpiry > 0 {
+		gossiper.ctx.Routes.SetExpiry(time.Duration(routeExpiry) * time.Second)
+	}
+	if options.Retention > 0 {
+		gossiper.ctx.VectorClock.SetRetention(time.Duration(options.Retention) * time.Second)
+	}
+	peerSuspect, peerDead := core.PEER_SUSPECT_TIMEOUT, core.PEER_DEAD_TIMEOUT
+	if options.PeerSuspect > 0 {
+		peerSuspect = time.Duration(options.PeerSuspect) * time.Second
+	}
+	if options.PeerDead > 0 {
+		peerDead = time.Duration(options.PeerDead) * time.Second
+	}
+	gossiper.ctx.PeerManager.SetTimeouts(peerSuspect, peerDead)
+	gossiper.start(antiEntropy, routing, routeExpiry, peerSuspect, options)
+	return gossiper, gossiper.ctx, nil
 }
 
-//ListenToClients method
-func (g *Gossiper) ListenToClients() {
-	udpAddress, err := net.ResolveUDPAddr("udp4", localAddress+":"+g.ctx.UIport)
-	clientServer, err := net.ListenUDP("udp4", udpAddress)
-	if err != nil {
-		log.Fatal("Error: ", err)
+//start runs the background work of a fully built gossiper, every loop returns once the context is stopped by Close
+func (g *Gossiper) start(antiEntropy, routing, routeExpiry int, peerSuspect time.Duration, options Options) {
+	if g.persistents != nil {
+		go g.takeSnapshots()
+		g.messageHandler.ResumeDelivery()
 	}
+	g.fileHandler.ResumeDownloads()
+	if g.watcher != nil {
+		go g.watcher.Start(time.Duration(options.Watch) * time.Second)
+	}
+	if routeExpiry > 0 {
+		go g.expireRoutes(time.Duration(routeExpiry) * time.Second)
+	}
+	if options.Retention > 0 {
+		go g.pruneMessages(time.Duration(options.Retention) * time.Second)
+	}
+	if !g.ctx.SimpleMode {
+		//Simple mode has no periodic traffic to tell silent peers from dead ones
+		go g.monitorPeers(peerSuspect / 2)
+		go g.discoverer.Start()
+	}
+	if g.clientServer != nil {
+		go g.ListenToClients()
+	}
+	go g.ListenToPeers()
+	go g.mongerer.StartAntiEntropy(antiEntropy)
+	go g.router.Start(routing)
+	go g.waitForIncomingClientMessage()
+	go g.waitForIncomingPeerMessage()
+}
 
+//ListenToClients method
+func (g *Gossiper) ListenToClients() {
 	for {
-		buf := make([]byte, 1024)
-		n, _, err := clientServer.ReadFromUDP(buf)
+		buf := make([]byte, clientBufferSize)
+		n, _, err := g.clientServer.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("Error while reading: ", err)
+			continue
+		}
+		if n == len(buf) {
+			log.Println("Dropping client message: exceeds", clientBufferSize, "bytes")
+			continue
 		}
 		go g.handleResponse(buf, n, "CLIENT")
 		buf = nil
@@ -70,17 +206,21 @@ func (g *Gossiper) ListenToClients() {
 }
 
 func (g *Gossiper) waitForIncomingClientMessage() {
-	for cMessage := range g.clientIncomingChannel {
+	for {
+		var cMessage core.Message
+		select {
+		case cMessage = <-g.clientIncomingChannel:
+		case <-g.ctx.Done():
+			return
+		}
 		contentType := cMessage.GetType(g.ctx.SimpleMode)
 		switch contentType {
 		case core.SIMPLE_MESSAGE:
-			simpleMessage := &core.SimpleMessage{OriginalName: g.ctx.Name, Contents: cMessage.Text}
-			go g.ctx.ForwardToPeers(*simpleMessage)
+			go g.messageHandler.SendSimpleMessage(cMessage.Text)
 		case core.FILE_INDEXING:
 			fileSize, metahash := g.fileHandler.IndexFile(*cMessage.File)
 			if fileSize != -1 && g.ctx.RunningHw3Ex2() {
-				packet := core.GossipPacket{TLCMessage: g.tlcHandler.NewTLCFromTxPublish(*cMessage.File, fileSize, metahash)}
-				go g.tlcHandler.HandleTLCMessage(packet, g.ctx.Address.String())
+				g.publishFile(*cMessage.File, fileSize, metahash)
 			}
 		case core.DATA_REQUEST:
 			go g.fileHandler.InitiateFileRequest(cMessage.Destination, *cMessage.File, []byte(*cMessage.Request))
@@ -94,36 +234,179 @@ func (g *Gossiper) waitForIncomingClientMessage() {
 			go g.shamirHandler.HandlePasswordDelete(*cMessage.MasterKey, *cMessage.AccountURL, *cMessage.DeleteUser)
 		case core.PRIVATE_MESSAGE:
 			fmt.Println("CLIENT MESSAGE", cMessage.Text, "dest", *(cMessage.Destination))
-			privateMessage := core.NewPrivateMessage(0, g.ctx.GetHopLimit(), cMessage.Text, g.ctx.Name, *cMessage.Destination)
-			go g.messageHandler.HandlePrivateMessage(core.GossipPacket{Private: privateMessage})
+			go g.messageHandler.SendPrivateMessage(cMessage.Text, *cMessage.Destination)
+		case core.CHANNEL_JOIN:
+			passphrase := ""
+			if cMessage.ChannelKey != nil {
+				passphrase = *cMessage.ChannelKey
+			}
+			go g.messageHandler.JoinChannel(*cMessage.JoinChannel, passphrase)
+		case core.CHANNEL_LEAVE:
+			go g.messageHandler.LeaveChannel(*cMessage.LeaveChannel)
 		case core.RUMOUR_MESSAGE:
-			fmt.Println("CLIENT MESSAGE", cMessage.Text)
-			rumour := core.NewRumourMessage(g.ctx.VectorClock.GetNextIDFrom(g.ctx.Name), cMessage.Text, g.ctx.Name)
-			go g.messageHandler.HandleRumourMessage(core.GossipPacket{Rumor: rumour}, g.ctx.Address.String())
+			channel := ""
+			if cMessage.Channel != nil {
+				channel = *cMessage.Channel
+				fmt.Println("CLIENT MESSAGE", cMessage.Text, "channel", channel)
+			} else {
+				fmt.Println("CLIENT MESSAGE", cMessage.Text)
+			}
+			go g.messageHandler.SendRumour(cMessage.Text, channel)
 		}
 	}
 }
 
+//publishFile names an indexed file through the TLC file-naming flow
+func (g *Gossiper) publishFile(name string, size int64, metahash []byte) {
+	packet := core.GossipPacket{TLCMessage: g.tlcHandler.NewTLCFromTxPublish(name, size, metahash)}
+	go g.tlcHandler.HandleTLCMessage(packet, g.ctx.Address.String())
+}
+
 //ListenToPeers method
 func (g *Gossiper) ListenToPeers() {
 	for {
-		buf := make([]byte, 12288)
-		n, udpAddr, err := g.ctx.GetConnection().ReadFromUDP(buf)
+		buf, sender, err := g.ctx.GetTransport().Receive()
+		if err == core.ErrTransportClosed {
+			return
+		}
 		if err != nil {
-			log.Fatal("Error: ", err)
+			log.Println("Error receiving peer packet: ", err)
+			continue
+		}
+		if !g.ctx.Registry.Limiter.Allow(sender, core.ANY_PACKET) {
+			continue
+		}
+		g.evaluateIncomingAddress(sender)
+		incomingPacket := core.GossipPacket{}
+		if err := protobuf.Decode(buf, &incomingPacket); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		select {
+		case g.peerIncomingChannel <- core.InternalPacket{Packet: incomingPacket, Sender: sender}:
+		default:
+			g.ctx.Registry.Limiter.CountQueueDrop()
+		}
+	}
+}
+
+//HandleClientMessage takes a client message as if it was received on the UI port
+func (g *Gossiper) HandleClientMessage(message core.Message) {
+	g.clientIncomingChannel <- message
+}
+
+//Close stops the background loops of the gossiper and shuts down its transport and UI port, stopping it from receiving packets
+func (g *Gossiper) Close() error {
+	g.ctx.Stop()
+	g.saveState()
+	g.closeClients()
+	return g.ctx.GetTransport().Close()
+}
+
+func (g *Gossiper) closeClients() {
+	if g.clientServer != nil {
+		g.clientServer.Close()
+	}
+}
+
+func (g *Gossiper) expireRoutes(expiry time.Duration) {
+	ticker := time.NewTicker(expiry / core.ROUTE_EXPIRY_FACTOR)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-g.ctx.Done():
+			return
+		}
+		for _, origin := range g.ctx.Routes.Expire(now) {
+			fmt.Println("ROUTE EXPIRED origin", origin)
+		}
+	}
+}
+
+//pruneMessages drops message bodies older than the retention window. The vector clock keeps track of them.
+func (g *Gossiper) pruneMessages(retention time.Duration) {
+	interval := retention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-g.ctx.Done():
+			return
+		}
+		if pruned := g.ctx.VectorClock.Prune(now); pruned > 0 {
+			fmt.Println("PRUNED", pruned, "message bodies")
+		}
+	}
+}
+
+//restoreState opens the data directory and reloads every subsystem from it, snapshots are taken periodically once the gossiper starts
+func (g *Gossiper) restoreState(dataDir string) error {
+	store, err := core.NewStore(dataDir)
+	if err != nil {
+		return err
+	}
+	g.ctx.Store = store
+	persistents := []core.Persistent{g.ctx, g.messageHandler, g.fileHandler, g.tlcHandler, g.shamirHandler}
+	for _, persistent := range persistents {
+		if err := persistent.Restore(store); err != nil {
+			return fmt.Errorf("Could not restore state from %s: %v", dataDir, err)
 		}
-		g.evaluateIncomingAddress(udpAddr)
-		go g.handleResponse(buf, n, udpAddr.String())
-		buf = nil
 	}
+	g.persistents = persistents
+	g.saveState()
+	return nil
 }
-func (g *Gossiper) evaluateIncomingAddress(address *net.UDPAddr) {
-	for _, knwonPeer := range g.ctx.GetPeers() {
-		if strings.Compare(knwonPeer, address.String()) == 0 {
+
+func (g *Gossiper) takeSnapshots() {
+	ticker := time.NewTicker(core.SNAPSHOT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.saveState()
+		case <-g.ctx.Done():
 			return
 		}
 	}
-	g.ctx.AddPeer(address.String())
+}
+
+func (g *Gossiper) saveState() {
+	for _, persistent := range g.persistents {
+		if err := persistent.Save(g.ctx.Store); err != nil {
+			log.Println("Could not save state: ", err)
+		}
+	}
+}
+
+func (g *Gossiper) evaluateIncomingAddress(address string) {
+	g.ctx.PeerManager.Heard(address)
+}
+
+//monitorPeers periodically demotes silent peers and probes quarantined ones with a status packet so they can come back
+func (g *Gossiper) monitorPeers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-g.ctx.Done():
+			return
+		}
+		for _, event := range g.ctx.PeerManager.Check(now) {
+			fmt.Println("PEER", event.Address, event.StateName())
+		}
+		for _, peer := range g.ctx.PeerManager.Quarantined() {
+			go g.mongerer.Acknowledge(peer)
+		}
+	}
 }
 
 func (g *Gossiper) handleResponse(bytes []byte, n int, sender string) error {
@@ -148,55 +431,16 @@ func (g *Gossiper) handleResponse(bytes []byte, n int, sender string) error {
 }
 
 func (g *Gossiper) waitForIncomingPeerMessage() {
-	for receivedPacket := range g.peerIncomingChannel {
-		sender := receivedPacket.Sender
-		packet := receivedPacket.Packet
-		contentType, err := packet.GetType(g.ctx.SimpleMode)
-		if err != nil {
-			log.Fatal("Error receiving peer packet: ", err)
-		}
-		switch contentType {
-		case core.SIMPLE_MESSAGE:
-			go g.messageHandler.HandleSimpleMessage(packet)
-		case core.STATUS_PACKET:
-			go g.mongerer.HandleStatusPacket(packet, sender)
-		case core.PRIVATE_MESSAGE:
-			go g.messageHandler.HandlePrivateMessage(packet)
-		case core.DATA_REQUEST:
-			go g.fileHandler.HandleDataRequest(packet)
-		case core.DATA_REPLY:
-			go g.fileHandler.HandleDataReply(packet)
-		case core.SEARCH_REQUEST:
-			go g.fileHandler.HandleSearchRequest(packet, sender)
-		case core.SEARCH_REPLY:
-			go g.fileHandler.HandleSearchReply(packet)
-		case core.TLC_MESSAGE:
-			go g.tlcHandler.HandleTLCMessage(packet, sender)
-		case core.TLC_ACK:
-			go g.tlcHandler.HandleTLCAck(packet)
-		case core.PASSWORD_INSERT:
-			go g.shamirHandler.HandlePublicShare(packet)
-		case core.PASSWORD_RETRIEVE:
-			go g.shamirHandler.HandleSearchRequest(packet, sender)
-		default:
-			go g.messageHandler.HandleRumourMessage(packet, sender)
-		}
-	}
-}
-
-func (g *Gossiper) startRouting(intervalPeriodseconds int) {
-	if g.ctx.SimpleMode {
-		return
-	}
 	for {
-		if len(g.ctx.GetPeers()) == 0 {
-			continue
+		var receivedPacket core.InternalPacket
+		select {
+		case receivedPacket = <-g.peerIncomingChannel:
+		case <-g.ctx.Done():
+			return
 		}
-		rumour := core.NewRumourMessage(g.ctx.VectorClock.GetNextIDFrom(g.ctx.Name), "", g.ctx.Name)
-		go g.messageHandler.HandleRumourMessage(core.GossipPacket{Rumor: rumour}, g.ctx.Address.String())
-		if intervalPeriodseconds == 0 {
-			break
+		err := g.ctx.Registry.Dispatch(receivedPacket.Packet, receivedPacket.Sender, g.ctx.SimpleMode)
+		if err != nil && err != core.ErrRateLimited {
+			log.Println("Dropping peer packet: ", err)
 		}
-		time.Sleep(time.Duration(intervalPeriodseconds) * time.Second)
 	}
 }
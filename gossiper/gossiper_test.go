@@ -0,0 +1,163 @@
+package gossiper
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+//testNode is a gossiper on an in-process network, with the password results its GUI would show
+type testNode struct {
+	gossiper *Gossiper
+	ctx      *core.Context
+	results  chan string
+}
+
+//startTopology starts one gossiper per name on an in-process network, each knowing the peers listed for it
+func startTopology(t *testing.T, peers map[string][]string) map[string]*testNode {
+	network := core.NewChannelNetwork()
+	nodes := make(map[string]*testNode)
+	address := func(name string) string { return fmt.Sprintf("10.0.0.%d:5000", name[0]) }
+	for name := range peers {
+		transport, err := network.NewTransport(address(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gossiper, ctx, err := NewGossiperWithTransport(transport, name, "", false, false, false, 10, 1, len(peers), 5, 10, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &testNode{gossiper: gossiper, ctx: ctx, results: make(chan string, 10)}
+		go node.watchGUI()
+		nodes[name] = node
+		t.Cleanup(func() { gossiper.Close() })
+	}
+	for name, known := range peers {
+		for _, peer := range known {
+			nodes[name].ctx.AddPeer(address(peer))
+		}
+	}
+	return nodes
+}
+
+func (node *testNode) watchGUI() {
+	for packet := range node.ctx.GUImessageChannel {
+		switch {
+		case packet.Password != nil:
+			node.results <- "password " + *packet.Password
+		case packet.PasswordOpResult != nil:
+			node.results <- *packet.PasswordOpResult
+		}
+	}
+}
+
+//await returns the next password result of the node
+func (node *testNode) await(t *testing.T) string {
+	select {
+	case result := <-node.results:
+		return result
+	case <-time.After(30 * time.Second):
+		t.Fatal("no password result from", node.ctx.Name)
+		return ""
+	}
+}
+
+//awaitRoutes waits until every node has a route to every other one
+func awaitRoutes(t *testing.T, nodes map[string]*testNode) {
+	deadline := time.Now().Add(30 * time.Second)
+	for _, node := range nodes {
+		for len(node.ctx.GetPeerOrigins()) < len(nodes)-1 {
+			if time.Now().After(deadline) {
+				t.Fatal(node.ctx.Name, "only has routes to", node.ctx.GetPeerOrigins())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+//TestSecretSharing runs the topology and scenario of shamir_test.sh in process:
+//
+//	D<---C<---B<---A
+//	|    |
+//	\/  \/
+//	G--->E--->F<---H
+func TestSecretSharing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for routes to converge over eight nodes")
+	}
+	nodes := startTopology(t, map[string][]string{
+		"A": {"B"},
+		"B": {"C"},
+		"C": {"D", "F"},
+		"D": {"E"},
+		"E": {"F"},
+		"F": {},
+		"G": {"E"},
+		"H": {"F"},
+	})
+	awaitRoutes(t, nodes)
+
+	insert := func(masterKey, account, password string) core.Message {
+		username := "tester"
+		return core.Message{MasterKey: &masterKey, AccountURL: &account, UserName: &username, NewPassword: &password}
+	}
+	retrieve := func(masterKey, account string) core.Message {
+		username := "tester"
+		return core.Message{MasterKey: &masterKey, AccountURL: &account, UserName: &username}
+	}
+
+	nodes["G"].gossiper.HandleClientMessage(insert("liug", "twitter", "mnbvcx"))
+	if result := nodes["G"].await(t); result != "Stored Successfully!" {
+		t.Fatal("G could not store its password:", result)
+	}
+	nodes["F"].gossiper.HandleClientMessage(insert("hfds", "facebook", "tzhncvb"))
+	if result := nodes["F"].await(t); result != "Stored Successfully!" {
+		t.Fatal("F could not store its password:", result)
+	}
+
+	nodes["G"].gossiper.HandleClientMessage(retrieve("liug", "twitter"))
+	if result := nodes["G"].await(t); result != "password mnbvcx" {
+		t.Fatal("G retrieved", result)
+	}
+	//Only the node that stored a password can retrieve it
+	nodes["E"].gossiper.HandleClientMessage(retrieve("liug", "twitter"))
+	if result := nodes["E"].await(t); result != "Incorrect credentials provided, please try again" {
+		t.Fatal("E retrieved", result)
+	}
+}
+
+func TestNewGossiperWithTransportReportsErrors(t *testing.T) {
+	transport, err := core.NewChannelNetwork().NewTransport("10.0.0.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewGossiperWithTransport(transport, "A", "", false, false, false, 10, 1, 2, 5, 10, Options{Strategy: "unknown"}); err == nil {
+		t.Fatal("unknown gossip strategy accepted")
+	}
+}
+
+func TestCloseStopsBackgroundLoops(t *testing.T) {
+	before := runtime.NumGoroutine()
+	transport, err := core.NewChannelNetwork().NewTransport("10.0.0.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gossiper, ctx, err := NewGossiperWithTransport(transport, "A", "", false, false, false, 1, 1, 2, 5, 10, Options{Retention: 10, Watch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.AddPeer("10.0.0.2:5000")
+	time.Sleep(100 * time.Millisecond)
+	gossiper.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left running after Close:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	// core "github.com/ksei/Peerster/Core"
 	"flag"
 	"strings"
 
+	core "github.com/ksei/Peerster/Core"
 	gsp "github.com/ksei/Peerster/gossiper"
 	webS "github.com/ksei/Peerster/webServer"
 	// fh "github.com/ksei/Peerster/fileSharing"
@@ -23,10 +23,52 @@ func main() {
 	hopLimit := flag.Int("hopLimit", 10, "Maximum number of hops specified for private messaging")
 	hw3ex2 := flag.Bool("hw3ex2", false, "Support hw3ex2 functionality")
 	hw3ex3 := flag.Bool("hw3ex3", false, "Support hw3ex3 functionality")
+	e2e := flag.Bool("e2e", false, "Encrypt outgoing private messages end-to-end")
+	routeExpiry := flag.Int("routeExpiry", 0, "Seconds after which a route that is not refreshed expires, defaults to 5 route rumour periods")
+	peerSuspect := flag.Int("peerSuspect", 30, "Seconds of silence after which a peer is suspected to be down")
+	peerDead := flag.Int("peerDead", 60, "Seconds of silence after which a peer is considered dead and quarantined, peers not given with -peers are removed once dead for as long again")
+	peerExchange := flag.Int("peerExchange", 10, "Frequency for gossiping a sample of known peers, 0 to disable")
+	syncBatch := flag.Int("syncBatch", 0, "Maximum number of missing messages streamed per anti-entropy exchange, 0 sends them one at a time")
+	strategy := flag.String("gossip", "coin", "Gossip strategy: coin, fanout, pushpull or decay")
+	fanout := flag.Int("fanout", 3, "Number of peers a new message is pushed to by the fanout and pushpull strategies")
+	decay := flag.Float64("decay", 0.5, "Factor by which the decay strategy lowers the probability of mongering on after each round")
+	ackTimeout := flag.Int("ackTimeout", 10, "Seconds a mongering session waits for the peer's status")
+	retention := flag.Int("retention", 0, "Seconds message bodies are kept for, 0 keeps them forever")
+	orderDelivery := flag.Int("orderDelivery", 0, "Seconds out of order rumours are held back to show them in order in the GUI, 0 shows them as they arrive")
+	mailbox := flag.Bool("mailbox", false, "Store undeliverable private messages with peers until their recipient is back, and hold such messages for others")
+	mailboxExpiry := flag.Int("mailboxExpiry", 86400, "Seconds a mailbox holds a message before dropping it")
+	mailboxSize := flag.Int("mailboxSize", 65536, "Bytes of messages a mailbox holds for each recipient")
+	watch := flag.Int("watch", 0, "Frequency for scanning the shared folder to index new, modified and deleted files, 0 to disable")
+	watchDebounce := flag.Int("watchDebounce", 2, "Seconds a changed file must stay unchanged before the watcher indexes it")
+	watchPublish := flag.Bool("watchPublish", false, "Publish the files indexed by the watcher through TLC, requires -hw3ex2")
+	keyDir := flag.String("keyDir", core.DEFAULT_KEY_DIRECTORY, "Directory where the gossiper keeps its keys across restarts, empty to generate new keys on every start")
+	dataDir := flag.String("dataDir", "", "Directory where node state is persisted across restarts, disabled when empty")
 
 	flag.Parse()
 
-	_, ctx := gsp.NewGossiper(*gossipAddress, *gossipName, *UIPort, *simpleMsg, *hw3ex2, *hw3ex3, *antiEntr, *rtimer, *totalPeers, *stubbornTimeout, *hopLimit)
+	options := gsp.Options{
+		EncryptPrivate: *e2e,
+		DataDir:        *dataDir,
+		RouteExpiry:    *routeExpiry,
+		PeerSuspect:    *peerSuspect,
+		PeerDead:       *peerDead,
+		PeerExchange:   *peerExchange,
+		SyncBatch:      *syncBatch,
+		Strategy:       *strategy,
+		Fanout:         *fanout,
+		Decay:          *decay,
+		AckTimeout:     *ackTimeout,
+		Retention:      *retention,
+		OrderDelivery:  *orderDelivery,
+		Mailbox:        *mailbox,
+		MailboxExpiry:  *mailboxExpiry,
+		MailboxSize:    *mailboxSize,
+		KeyDir:         *keyDir,
+		Watch:          *watch,
+		WatchDebounce:  *watchDebounce,
+		WatchPublish:   *watchPublish,
+	}
+	_, ctx := gsp.NewGossiper(*gossipAddress, *gossipName, *UIPort, *simpleMsg, *hw3ex2, *hw3ex3, *antiEntr, *rtimer, *totalPeers, *stubbornTimeout, *hopLimit, options)
 	peers := strings.Split(*peerList, ",")
 	for i := 0; i < len(peers); i++ {
 		ctx.AddPeer(peers[i])
@@ -0,0 +1,115 @@
+package messageHandling
+
+import (
+	"fmt"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	CHANNELS_SNAPSHOT = "channels"
+	MAX_CHANNEL_NAME  = 64
+)
+
+//JoinChannel shows the rumours of a channel from now on. A non empty passphrase derives the channel key,
+//encrypting what we send to the channel and decrypting what its members send.
+func (mh *MessageHandler) JoinChannel(channel, passphrase string) {
+	if len(channel) == 0 || len(channel) > MAX_CHANNEL_NAME {
+		fmt.Println("Invalid channel name", channel)
+		return
+	}
+	var key []byte
+	if len(passphrase) > 0 {
+		derived, err := core.ChannelKey(channel, passphrase)
+		if err != nil {
+			fmt.Println("Cannot derive key for channel", channel, ":", err)
+			return
+		}
+		key = derived
+	}
+	mh.channelLocker.Lock()
+	mh.channels[channel] = key
+	mh.channelLocker.Unlock()
+	fmt.Println("JOINED channel", channel)
+	mh.persist()
+}
+
+//LeaveChannel stops showing the rumours of a channel. We keep relaying them.
+func (mh *MessageHandler) LeaveChannel(channel string) {
+	mh.channelLocker.Lock()
+	delete(mh.channels, channel)
+	mh.channelLocker.Unlock()
+	fmt.Println("LEFT channel", channel)
+	mh.persist()
+}
+
+//SendRumour creates, signs and gossips a rumour from us, on the given channel unless it is empty.
+//Its ID is reserved only once the rumour can be sent, a reserved ID that is never stored would leave a gap in our messages.
+func (mh *MessageHandler) SendRumour(text, channel string) {
+	var key []byte
+	if len(channel) > 0 {
+		mh.channelLocker.RLock()
+		channelKey, member := mh.channels[channel]
+		mh.channelLocker.RUnlock()
+		if !member {
+			fmt.Println("Cannot send to channel", channel, ": not a member")
+			return
+		}
+		key = channelKey
+	}
+	//Everything that can fail happens before the ID is reserved, a reserved ID that is never stored would stall every peer waiting for it
+	var sealer *core.ChannelSealer
+	if len(key) > 0 {
+		var err error
+		if sealer, err = core.NewChannelSealer(key); err != nil {
+			fmt.Println("Cannot encrypt rumour for channel", channel, ":", err)
+			return
+		}
+	}
+	rumour := core.NewRumourMessage(mh.ctx.VectorClock.ReserveID(mh.ctx.Name), text, mh.ctx.Name)
+	rumour.Channel = channel
+	if sealer != nil {
+		sealer.Seal(rumour)
+	}
+	mh.ctx.Identity.SignRumour(rumour)
+	mh.HandleRumourMessage(core.GossipPacket{Rumor: rumour}, mh.ctx.Address.String())
+}
+
+//display returns the rumour as the GUI should show it, with channel rumours decrypted, or false if it is not for us to see
+func (mh *MessageHandler) display(rumour *core.RumourMessage) (*core.RumourMessage, bool) {
+	if len(rumour.Channel) == 0 {
+		return rumour, true
+	}
+	mh.channelLocker.RLock()
+	key, member := mh.channels[rumour.Channel]
+	mh.channelLocker.RUnlock()
+	if !member {
+		return nil, false
+	}
+	if len(rumour.Sealed) == 0 {
+		return rumour, true
+	}
+	if len(key) == 0 {
+		return nil, false
+	}
+	text, err := core.OpenChannelRumour(rumour, key)
+	if err != nil {
+		fmt.Println("Cannot decrypt rumour origin", rumour.Origin, "ID", rumour.ID, "on channel", rumour.Channel, ":", err)
+		return nil, false
+	}
+	//The stored rumour stays sealed, it is relayed as it was signed
+	shown := *rumour
+	shown.Text = text
+	return &shown, true
+}
+
+//GetChannels lists the channels we are a member of
+func (mh *MessageHandler) GetChannels() []string {
+	mh.channelLocker.RLock()
+	defer mh.channelLocker.RUnlock()
+	channels := []string{}
+	for channel := range mh.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
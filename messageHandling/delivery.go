@@ -0,0 +1,157 @@
+package messageHandling
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+//orderedDelivery hands rumours to the GUI in ID order for each origin. A rumour following a gap is held until the gap fills
+//or holdTimeout passes. The IDs still missing are then reported as a gap, and any of them showing up later is delivered marked late.
+//Packets are queued in order in the outbox and sent to the GUI without the lock held, so a slow GUI does not hold up rumour processing.
+type orderedDelivery struct {
+	ctx            *core.Context
+	deliveryLocker sync.Mutex
+	holdTimeout    time.Duration
+	nextID         map[string]uint32
+	held           map[string]map[uint32]*core.GUIPacket
+	timers         map[string]*time.Timer
+	outbox         []*core.GUIPacket
+	flushing       bool
+}
+
+func newOrderedDelivery(cntx *core.Context, holdTimeout time.Duration) *orderedDelivery {
+	return &orderedDelivery{
+		ctx:         cntx,
+		holdTimeout: holdTimeout,
+		nextID:      make(map[string]uint32),
+		held:        make(map[string]map[uint32]*core.GUIPacket),
+		timers:      make(map[string]*time.Timer),
+	}
+}
+
+//resume treats every message already in the vector clock as delivered, so restored history does not open gaps
+func (delivery *orderedDelivery) resume(status []core.PeerStatus) {
+	delivery.deliveryLocker.Lock()
+	defer delivery.deliveryLocker.Unlock()
+	for _, peerStatus := range status {
+		if peerStatus.NextID > delivery.nextID[peerStatus.Identifier] {
+			delivery.nextID[peerStatus.Identifier] = peerStatus.NextID
+		}
+	}
+}
+
+//deliver passes a newly stored rumour on to the GUI, or holds it until the rumours before it are delivered.
+//Rumours that are not visible, such as those of channels we are not a member of, only take their place in the order.
+func (delivery *orderedDelivery) deliver(origin string, id uint32, packet *core.GUIPacket, visible bool) {
+	if !visible {
+		packet = nil
+	}
+	if delivery.holdTimeout <= 0 {
+		if packet != nil {
+			delivery.ctx.GUImessageChannel <- packet
+		}
+		return
+	}
+
+	delivery.deliveryLocker.Lock()
+	delivery.order(origin, id, packet)
+	delivery.deliveryLocker.Unlock()
+	delivery.flush()
+}
+
+//order queues a rumour, or holds it until the rumours before it are queued. Must be called with the lock held.
+func (delivery *orderedDelivery) order(origin string, id uint32, packet *core.GUIPacket) {
+	next, known := delivery.nextID[origin]
+	if !known {
+		next = 1
+	}
+	switch {
+	case id < next:
+		if packet != nil {
+			packet.Late = true
+		}
+		delivery.push(packet)
+	case id == next:
+		delivery.push(packet)
+		delivery.nextID[origin] = next + 1
+		delivery.release(origin)
+	default:
+		delivery.nextID[origin] = next
+		if _, ok := delivery.held[origin]; !ok {
+			delivery.held[origin] = make(map[uint32]*core.GUIPacket)
+		}
+		delivery.held[origin][id] = packet
+		if _, waiting := delivery.timers[origin]; !waiting {
+			delivery.timers[origin] = time.AfterFunc(delivery.holdTimeout, func() { delivery.expire(origin) })
+		}
+	}
+}
+
+//release delivers the held rumours that now follow the delivered prefix. Must be called with the lock held.
+func (delivery *orderedDelivery) release(origin string) {
+	held := delivery.held[origin]
+	for packet, ok := held[delivery.nextID[origin]]; ok; packet, ok = held[delivery.nextID[origin]] {
+		delivery.push(packet)
+		delete(held, delivery.nextID[origin])
+		delivery.nextID[origin]++
+	}
+	if len(held) > 0 {
+		return
+	}
+	delete(delivery.held, origin)
+	if timer, waiting := delivery.timers[origin]; waiting {
+		timer.Stop()
+		delete(delivery.timers, origin)
+	}
+}
+
+//expire gives up on the gaps before the held rumours of origin: they are reported missing and the held rumours delivered
+func (delivery *orderedDelivery) expire(origin string) {
+	defer delivery.flush()
+	delivery.deliveryLocker.Lock()
+	defer delivery.deliveryLocker.Unlock()
+	delete(delivery.timers, origin)
+	held := delivery.held[origin]
+	ids := make([]uint32, 0, len(held))
+	for id := range held {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if next := delivery.nextID[origin]; id > next {
+			delivery.push(&core.GUIPacket{Gap: &core.MessageGap{Origin: origin, FromID: next, ToID: id - 1}})
+		}
+		delivery.push(held[id])
+		delivery.nextID[origin] = id + 1
+	}
+	delete(delivery.held, origin)
+}
+
+//push queues a packet for the GUI, hidden rumours are left out. Must be called with the lock held.
+func (delivery *orderedDelivery) push(packet *core.GUIPacket) {
+	if packet != nil {
+		delivery.outbox = append(delivery.outbox, packet)
+	}
+}
+
+//flush sends the queued packets to the GUI in order. A single caller sends at a time, the others leave their packets to it.
+func (delivery *orderedDelivery) flush() {
+	delivery.deliveryLocker.Lock()
+	defer delivery.deliveryLocker.Unlock()
+	if delivery.flushing {
+		return
+	}
+	delivery.flushing = true
+	for len(delivery.outbox) > 0 {
+		packet := delivery.outbox[0]
+		delivery.outbox = delivery.outbox[1:]
+		delivery.deliveryLocker.Unlock()
+		delivery.ctx.GUImessageChannel <- packet
+		delivery.deliveryLocker.Lock()
+	}
+	delivery.outbox = nil
+	delivery.flushing = false
+}
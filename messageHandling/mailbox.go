@@ -0,0 +1,248 @@
+package messageHandling
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	MAILBOX_REPLICAS       = 3
+	MAILBOX_SNAPSHOT       = "mailbox"
+	DEFAULT_MAILBOX_EXPIRY = 24 * time.Hour
+	DEFAULT_MAILBOX_SIZE   = 64 * 1024
+	//MAILBOX_MAX_BACKOFF bounds the wait between two deliveries of a held message
+	MAILBOX_MAX_BACKOFF = 10 * time.Minute
+)
+
+var errMailboxFull = errors.New("mailbox full")
+
+//heldMessage is a private message a mailbox holds for its recipient, with the deliveries made so far.
+//Deliveries are not saved, a restarted holder delivers its backlog again as soon as the recipient is back.
+type heldMessage struct {
+	Sealed       *core.EncryptedPrivateMessage
+	Stored       time.Time
+	deliveries   int
+	nextDelivery time.Time
+}
+
+//mailbox holds encrypted private messages for recipients that are offline, within an expiry and a size limit per recipient
+type mailbox struct {
+	mailboxLocker sync.Mutex
+	expiry        time.Duration
+	maxBytes      int
+	held          map[string][]*heldMessage
+}
+
+func newMailbox(expiry time.Duration, maxBytes int) *mailbox {
+	return &mailbox{expiry: expiry, maxBytes: maxBytes, held: make(map[string][]*heldMessage)}
+}
+
+//hold stores a message for its recipient, unless the recipient's backlog would exceed the size limit
+func (box *mailbox) hold(sealed *core.EncryptedPrivateMessage) error {
+	box.mailboxLocker.Lock()
+	defer box.mailboxLocker.Unlock()
+	box.expire(time.Now())
+	backlog := box.held[sealed.Destination]
+	size := len(sealed.Ciphertext)
+	for _, message := range backlog {
+		if message.Sealed.Origin == sealed.Origin && message.Sealed.ID == sealed.ID {
+			return nil
+		}
+		size += len(message.Sealed.Ciphertext)
+	}
+	if size > box.maxBytes {
+		return errMailboxFull
+	}
+	box.held[sealed.Destination] = append(backlog, &heldMessage{Sealed: sealed, Stored: time.Now()})
+	return nil
+}
+
+//due returns the messages held for a recipient that are due for delivery at now, and schedules their next delivery
+//with exponential backoff. They stay held until the recipient acknowledges them or they expire.
+func (box *mailbox) due(recipient string, now time.Time) []*core.EncryptedPrivateMessage {
+	box.mailboxLocker.Lock()
+	defer box.mailboxLocker.Unlock()
+	box.expire(now)
+	due := []*core.EncryptedPrivateMessage{}
+	for _, message := range box.held[recipient] {
+		if message.nextDelivery.After(now) {
+			continue
+		}
+		backoff := PRIVATE_RETRY_TIMEOUT
+		for i := 0; i < message.deliveries && backoff < MAILBOX_MAX_BACKOFF; i++ {
+			backoff *= 2
+		}
+		if backoff > MAILBOX_MAX_BACKOFF {
+			backoff = MAILBOX_MAX_BACKOFF
+		}
+		message.deliveries++
+		message.nextDelivery = now.Add(backoff)
+		due = append(due, message.Sealed)
+	}
+	return due
+}
+
+//settle forgets a held message its recipient acknowledged, and reports whether it was held
+func (box *mailbox) settle(recipient, origin string, id uint32) bool {
+	box.mailboxLocker.Lock()
+	defer box.mailboxLocker.Unlock()
+	backlog := box.held[recipient]
+	for i, message := range backlog {
+		if message.Sealed.Origin == origin && message.Sealed.ID == id {
+			if len(backlog) == 1 {
+				delete(box.held, recipient)
+			} else {
+				box.held[recipient] = append(backlog[:i:i], backlog[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+//expire drops the messages held for longer than the expiry. Must be called with the lock held.
+func (box *mailbox) expire(now time.Time) {
+	for recipient, backlog := range box.held {
+		kept := backlog[:0]
+		for _, message := range backlog {
+			if now.Sub(message.Stored) <= box.expiry {
+				kept = append(kept, message)
+			}
+		}
+		if len(kept) == 0 {
+			delete(box.held, recipient)
+		} else {
+			box.held[recipient] = kept
+		}
+	}
+}
+
+//EnableMailbox turns on store and forward: private messages that cannot be delivered are deposited with peers chosen from
+//the recipient's name, and this node holds such messages for others, up to maxBytes per recipient for at most expiry.
+//Non positive values fall back to the defaults.
+func (mh *MessageHandler) EnableMailbox(expiry time.Duration, maxBytes int) {
+	if expiry <= 0 {
+		expiry = DEFAULT_MAILBOX_EXPIRY
+	}
+	if maxBytes <= 0 {
+		maxBytes = DEFAULT_MAILBOX_SIZE
+	}
+	mh.mailbox = newMailbox(expiry, maxBytes)
+}
+
+//mailboxHolders picks the MAILBOX_REPLICAS nodes, among us and the origins we have a route to, ranking highest for the recipient
+//under rendezvous hashing. Every node with the same view of the network picks the same holders.
+func (mh *MessageHandler) mailboxHolders(recipient string) []string {
+	candidates := []string{mh.ctx.Name}
+	for _, origin := range mh.ctx.GetPeerOrigins() {
+		if origin != recipient && origin != mh.ctx.Name {
+			candidates = append(candidates, origin)
+		}
+	}
+	scores := make(map[string][]byte)
+	for _, candidate := range candidates {
+		score := sha256.Sum256([]byte(recipient + "\x00" + candidate))
+		scores[candidate] = score[:]
+	}
+	sort.Slice(candidates, func(i, j int) bool { return bytes.Compare(scores[candidates[i]], scores[candidates[j]]) > 0 })
+	if len(candidates) > MAILBOX_REPLICAS {
+		candidates = candidates[:MAILBOX_REPLICAS]
+	}
+	return candidates
+}
+
+//deposit hands a private message that could not be delivered to its recipient's mailbox holders, encrypting it if needed.
+//It returns false if the message could not be deposited anywhere.
+func (mh *MessageHandler) deposit(packet core.GossipPacket) bool {
+	if mh.mailbox == nil {
+		return false
+	}
+	sealed := packet.EncryptedPrivate
+	if sealed == nil {
+		recipientKey, found := mh.ctx.KeyRing.GetEncryptionKey(packet.Private.Destination)
+		if !found {
+			fmt.Println("Could not deposit private message to", packet.Private.Destination, ":", core.ErrUnknownEncryptionKey)
+			return false
+		}
+		var err error
+		if sealed, err = mh.ctx.Identity.SealPrivate(packet.Private, recipientKey); err != nil {
+			fmt.Println("Could not deposit private message to", packet.Private.Destination, ":", err)
+			return false
+		}
+	}
+	for _, holder := range mh.mailboxHolders(sealed.Destination) {
+		fmt.Println("MAILBOX DEPOSIT for", sealed.Destination, "ID", sealed.ID, "with", holder)
+		deposit := &core.MailboxDeposit{Origin: mh.ctx.Name, Destination: holder, HopLimit: mh.ctx.GetHopLimit(), Message: sealed}
+		go mh.HandleMailboxDeposit(core.GossipPacket{Deposit: deposit})
+	}
+	return true
+}
+
+//HandleMailboxDeposit holds a deposited message, or forgets the message a deposited acknowledgement settles,
+//if we are the holder it is addressed to, and relays it otherwise
+func (mh *MessageHandler) HandleMailboxDeposit(packet core.GossipPacket) {
+	deposit := packet.Deposit
+	found, destinationIP := mh.ctx.RetrieveDestinationRoute(deposit.Destination)
+	switch found {
+	case -1:
+		return
+	case 0:
+		if mh.mailbox == nil {
+			return
+		}
+		if deposit.Ack != nil {
+			if err := mh.ctx.KeyRing.VerifyPrivateAck(deposit.Ack); err != nil {
+				fmt.Println("REJECTED mailbox acknowledgement origin", deposit.Ack.Origin, ":", err)
+				return
+			}
+			mh.settleMailbox(deposit.Ack)
+			return
+		}
+		sealed := deposit.Message
+		if err := mh.ctx.KeyRing.VerifyEncryptedPrivate(sealed); err != nil {
+			fmt.Println("REJECTED mailbox deposit origin", sealed.Origin, ":", err)
+			return
+		}
+		if err := mh.mailbox.hold(sealed); err != nil {
+			fmt.Println("Could not hold message from", sealed.Origin, "for", sealed.Destination, ":", err)
+			return
+		}
+		fmt.Println("MAILBOX HOLDING message from", sealed.Origin, "for", sealed.Destination, "ID", sealed.ID)
+	default:
+		if deposit.HopLimit == 0 {
+			return
+		}
+		deposit.HopLimit = deposit.HopLimit - 1
+		go mh.ctx.SendPacketToPeer(core.GossipPacket{Deposit: deposit}, destinationIP)
+	}
+}
+
+//flushMailbox delivers the backlog held for a recipient whose latest rumour or route announcement just reached us.
+//The messages are held until the recipient acknowledges them to us. Route announcements arrive every few seconds,
+//so a message whose delivery was lost is only delivered again once its backoff elapsed.
+func (mh *MessageHandler) flushMailbox(recipient string) {
+	if mh.mailbox == nil {
+		return
+	}
+	for _, sealed := range mh.mailbox.due(recipient, time.Now()) {
+		fmt.Println("MAILBOX DELIVERING message from", sealed.Origin, "to", recipient, "ID", sealed.ID)
+		forward := *sealed
+		forward.HopLimit = mh.ctx.GetHopLimit()
+		forward.Holder = mh.ctx.Name
+		mh.HandleEncryptedPrivateMessage(core.GossipPacket{EncryptedPrivate: &forward})
+	}
+}
+
+//settleMailbox forgets the held message a verified acknowledgement from its recipient refers to
+func (mh *MessageHandler) settleMailbox(ack *core.PrivateAck) {
+	if mh.mailbox != nil && mh.mailbox.settle(ack.Origin, ack.Destination, ack.ID) {
+		fmt.Println("MAILBOX RELEASED message from", ack.Destination, "to", ack.Origin, "ID", ack.ID)
+	}
+}
@@ -0,0 +1,32 @@
+package messageHandling
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+func TestDueBacksOffBetweenDeliveries(t *testing.T) {
+	box := newMailbox(time.Hour, DEFAULT_MAILBOX_SIZE)
+	if err := box.hold(&core.EncryptedPrivateMessage{Origin: "A", ID: 1, Destination: "B", Ciphertext: []byte("sealed")}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if due := box.due("B", now); len(due) != 1 {
+		t.Fatalf("got %d messages due, want the held one", len(due))
+	}
+	//Announcements of the recipient keep coming, each one must not deliver the backlog again
+	if due := box.due("B", now.Add(time.Second)); len(due) != 0 {
+		t.Fatalf("got %d messages due right after a delivery, want none", len(due))
+	}
+	if due := box.due("B", now.Add(PRIVATE_RETRY_TIMEOUT)); len(due) != 1 {
+		t.Fatalf("got %d messages due after the first backoff, want the held one", len(due))
+	}
+	if due := box.due("B", now.Add(2*PRIVATE_RETRY_TIMEOUT)); len(due) != 0 {
+		t.Fatal("second backoff did not double")
+	}
+	if due := box.due("B", now.Add(3*PRIVATE_RETRY_TIMEOUT)); len(due) != 1 {
+		t.Fatalf("got %d messages due after the second backoff, want the held one", len(due))
+	}
+}
@@ -1,59 +1,210 @@
 package messageHandling
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"sync"
+	"time"
 
 	core "github.com/ksei/Peerster/Core"
 	mongering "github.com/ksei/Peerster/Mongering"
 )
 
 type MessageHandler struct {
-	ctx      *core.Context
-	mongerer *mongering.Mongerer
+	ctx            *core.Context
+	mongerer       *mongering.Mongerer
+	encryptPrivate bool
+	delivery       *orderedDelivery
+	channelLocker  sync.RWMutex
+	channels       map[string][]byte
+	privateLocker  sync.Mutex
+	nextPrivateID  uint32
+	pending        map[string]*pendingPrivate
+	seen           map[string]time.Time
+	deferredAcks   map[string][]*core.PrivateAck
+	mailbox        *mailbox
+	simpleSeen     *seenCache
 }
 
-func NewMessageHandler(mng *mongering.Mongerer) *MessageHandler {
+//NewMessageHandler creates the rumour and private message handler. With a positive holdTimeout, rumours reach the GUI
+//in ID order for each origin, out of order ones being held for up to holdTimeout.
+func NewMessageHandler(mng *mongering.Mongerer, encryptPrivate bool, holdTimeout time.Duration) *MessageHandler {
 	mh := &MessageHandler{
-		ctx:      mng.GetContext(),
-		mongerer: mng,
+		ctx:            mng.GetContext(),
+		mongerer:       mng,
+		encryptPrivate: encryptPrivate,
+		delivery:       newOrderedDelivery(mng.GetContext(), holdTimeout),
+		channels:       make(map[string][]byte),
+		pending:        make(map[string]*pendingPrivate),
+		seen:           make(map[string]time.Time),
+		deferredAcks:   make(map[string][]*core.PrivateAck),
+		simpleSeen:     newSeenCache(SIMPLE_SEEN_CACHE_SIZE),
 	}
+	mh.registerPacketKinds()
+	mng.RegisterBatchReceiver(core.RUMOUR_MESSAGE, func(packet core.GossipPacket, sender string) { mh.receiveRumour(packet.Rumor, sender) })
 	return mh
 }
 
-func (mh *MessageHandler) HandleSimpleMessage(packet core.GossipPacket) {
-	message := packet.Simple
-	fmt.Println("SIMPLE MESSAGE origin", message.OriginalName, "from", message.RelayPeerAddr, "contents", message.Contents)
-	mh.printPeers()
-	go mh.ctx.ForwardToPeers(*packet.Simple)
+func (mh *MessageHandler) registerPacketKinds() {
+	kinds := []core.PacketKind{
+		{
+			Type:       core.SIMPLE_MESSAGE,
+			Name:       "SimpleMessage",
+			SimpleMode: true,
+			Present:    func(packet *core.GossipPacket) bool { return packet.Simple != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.Simple.OriginalName) == 0 {
+					return errors.New("missing origin")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { mh.HandleSimpleMessage(packet) },
+		},
+		{
+			Type:    core.RUMOUR_MESSAGE,
+			Name:    "RumourMessage",
+			Present: func(packet *core.GossipPacket) bool { return packet.Rumor != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.Rumor.Origin) == 0 || packet.Rumor.ID == 0 {
+					return errors.New("missing origin or ID")
+				}
+				if len(packet.Rumor.Channel) > MAX_CHANNEL_NAME {
+					return errors.New("channel name too long")
+				}
+				return nil
+			},
+			Handle: mh.HandleRumourMessage,
+		},
+		{
+			Type:    core.PRIVATE_MESSAGE,
+			Name:    "PrivateMessage",
+			Present: func(packet *core.GossipPacket) bool { return packet.Private != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.Private.Origin) == 0 || len(packet.Private.Destination) == 0 {
+					return errors.New("missing origin or destination")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { mh.HandlePrivateMessage(packet) },
+		},
+		{
+			Type:    core.ENCRYPTED_PRIVATE,
+			Name:    "EncryptedPrivateMessage",
+			Present: func(packet *core.GossipPacket) bool { return packet.EncryptedPrivate != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.EncryptedPrivate.Origin) == 0 || len(packet.EncryptedPrivate.Destination) == 0 {
+					return errors.New("missing origin or destination")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { mh.HandleEncryptedPrivateMessage(packet) },
+		},
+		{
+			Type:    core.MAILBOX_DEPOSIT,
+			Name:    "MailboxDeposit",
+			Present: func(packet *core.GossipPacket) bool { return packet.Deposit != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				deposit := packet.Deposit
+				if len(deposit.Destination) == 0 || (deposit.Message == nil) == (deposit.Ack == nil) {
+					return errors.New("missing holder, or not exactly one of message and acknowledgement")
+				}
+				if deposit.Message != nil && (len(deposit.Message.Origin) == 0 || len(deposit.Message.Destination) == 0) {
+					return errors.New("missing message origin or recipient")
+				}
+				if deposit.Ack != nil && (len(deposit.Ack.Origin) == 0 || len(deposit.Ack.Destination) == 0 || deposit.Ack.ID == 0) {
+					return errors.New("missing acknowledgement origin, destination or ID")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { mh.HandleMailboxDeposit(packet) },
+		},
+		{
+			Type:    core.PRIVATE_ACK,
+			Name:    "PrivateAck",
+			Present: func(packet *core.GossipPacket) bool { return packet.PrivateAck != nil },
+			Validate: func(packet *core.GossipPacket) error {
+				if len(packet.PrivateAck.Origin) == 0 || len(packet.PrivateAck.Destination) == 0 || packet.PrivateAck.ID == 0 {
+					return errors.New("missing origin, destination or ID")
+				}
+				return nil
+			},
+			Handle: func(packet core.GossipPacket, sender string) { mh.HandlePrivateAck(packet) },
+		},
+	}
+	for _, kind := range kinds {
+		if err := mh.ctx.Registry.Register(kind); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+//ResumeDelivery considers every rumour already in the vector clock as delivered to the GUI. Called after restoring a snapshot.
+func (mh *MessageHandler) ResumeDelivery() {
+	mh.delivery.resume(mh.ctx.VectorClock.GetCurrentStatus())
 }
 
 func (mh *MessageHandler) HandleRumourMessage(packet core.GossipPacket, sender string) {
-	rumour := packet.Rumor
-	isRouteRumour := len(rumour.Text) == 0
+	isLocal := strings.Compare(sender, mh.ctx.Address.String()) == 0
+	if mh.receiveRumour(packet.Rumor, sender) {
+		go mh.mongerer.Spread(packet.Rumor, sender)
+	}
+	if !isLocal {
+		go mh.mongerer.Acknowledge(sender)
+	}
+}
+
+//receiveRumour authenticates and stores a rumour we did not have yet, returning true if it was new
+func (mh *MessageHandler) receiveRumour(rumour *core.RumourMessage, sender string) bool {
+	isLocal := strings.Compare(sender, mh.ctx.Address.String()) == 0
+	if !isLocal {
+		rumour.Hops++
+	}
 	if !mh.messageExists(*rumour) {
-		if mh.ctx.VectorClock.GetMaxIdFrom(rumour.Origin) < rumour.ID {
-			mh.ctx.UpdateDSDV(rumour.Origin, sender, isRouteRumour)
+		if !mh.mongerer.Authenticate(rumour) {
+			return false
 		}
+		//An old rumour reaching us late through anti entropy says nothing of whether its origin is online now
+		latest := rumour.ID > mh.ctx.VectorClock.GetMaxIdFrom(rumour.Origin)
+		mh.ctx.KeyRing.BindEncryptionKey(rumour.Origin, rumour.EncryptionKey)
+		mh.ctx.UpdateRouteFromMessage(rumour.Origin, sender, rumour.ID, rumour.Hops)
 		mh.ctx.VectorClock.StoreMessage(rumour)
-		mh.ctx.GUImessageChannel <- &core.GUIPacket{Rumour: rumour, Sender: sender}
-		go mh.mongerer.StartMongering(packet.Rumor, core.RandomPeer(mh.ctx, sender))
-		if strings.Compare(sender, mh.ctx.Address.String()) != 0 {
-			// fmt.Println("RUMOR origin", rumour.Origin, "from", sender, "ID", rumour.ID, "contents", rumour.Text)
+		//Route rumours of peers predating route announcements keep their place in the clock, but are not chat
+		shown, visible := mh.display(rumour)
+		mh.delivery.deliver(rumour.Origin, rumour.ID, &core.GUIPacket{Rumour: shown, Sender: sender}, visible && !rumour.IsRouteRumour())
+		if !isLocal && latest {
+			mh.OriginReachable(rumour.Origin)
 		}
+		return true
 	}
-	if strings.Compare(sender, mh.ctx.Address.String()) != 0 {
-		go mh.mongerer.Acknowledge(sender)
+	if !isLocal && mh.mongerer.Authenticate(rumour) {
+		//A copy we already have may still have travelled a shorter path
+		mh.ctx.UpdateRouteFromMessage(rumour.Origin, sender, rumour.ID, rumour.Hops)
 	}
+	return false
+}
+
+//OriginReachable sends what was waiting for origin to be reachable: deferred acknowledgements and the mailbox backlog
+func (mh *MessageHandler) OriginReachable(origin string) {
+	go mh.releaseAcks(origin)
+	go mh.flushMailbox(origin)
 }
 
 func (mh *MessageHandler) HandlePrivateMessage(packet core.GossipPacket) {
 	private := packet.Private
+	if err := mh.ctx.KeyRing.VerifyPrivate(private); err != nil {
+		fmt.Println("REJECTED private message origin", private.Origin, ":", err)
+		return
+	}
 	found, destinationIP := mh.ctx.RetrieveDestinationRoute(private.Destination)
 	switch found {
 	case -1:
 		return
 	case 0:
+		if mh.acknowledgePrivate(private.Origin, private.ID, "") {
+			return
+		}
 		mh.ctx.GUImessageChannel <- &core.GUIPacket{Private: private}
 		// fmt.Println("PRIVATE origin", private.Origin, "hop-limit", private.HopLimit, "contents", private.Text)
 	default:
@@ -65,9 +216,68 @@ func (mh *MessageHandler) HandlePrivateMessage(packet core.GossipPacket) {
 	}
 }
 
+//SendPrivateMessage originates a signed private message, sealing it end-to-end when encryption is enabled.
+//It is retried until the destination acknowledges it, and the GUI learns whether it was delivered.
+func (mh *MessageHandler) SendPrivateMessage(text, destination string) {
+	id := mh.newPrivateID()
+	private := core.NewPrivateMessage(id, mh.ctx.GetHopLimit(), text, mh.ctx.Name, destination)
+	if !mh.encryptPrivate {
+		mh.ctx.Identity.SignPrivate(private)
+		mh.track(destination, id, text, core.GossipPacket{Private: private})
+		return
+	}
+	recipientKey, found := mh.ctx.KeyRing.GetEncryptionKey(destination)
+	if !found {
+		fmt.Println("Could not send private message to", destination, ":", core.ErrUnknownEncryptionKey)
+		mh.notifyReceipt(destination, id, text, core.PRIVATE_FAILED)
+		return
+	}
+	sealed, err := mh.ctx.Identity.SealPrivate(private, recipientKey)
+	if err != nil {
+		fmt.Println("Could not encrypt private message to", destination, ":", err)
+		mh.notifyReceipt(destination, id, text, core.PRIVATE_FAILED)
+		return
+	}
+	mh.track(destination, id, text, core.GossipPacket{EncryptedPrivate: sealed})
+}
+
+//HandleEncryptedPrivateMessage opens encrypted private messages addressed to this node and relays the others unread
+func (mh *MessageHandler) HandleEncryptedPrivateMessage(packet core.GossipPacket) {
+	sealed := packet.EncryptedPrivate
+	if err := mh.ctx.KeyRing.VerifyEncryptedPrivate(sealed); err != nil {
+		fmt.Println("REJECTED encrypted private message origin", sealed.Origin, ":", err)
+		return
+	}
+	found, destinationIP := mh.ctx.RetrieveDestinationRoute(sealed.Destination)
+	switch found {
+	case -1:
+		return
+	case 0:
+		senderKey, known := mh.ctx.KeyRing.GetEncryptionKey(sealed.Origin)
+		if !known {
+			fmt.Println("Could not open private message from", sealed.Origin, ":", core.ErrUnknownEncryptionKey)
+			return
+		}
+		private, err := mh.ctx.Identity.OpenPrivate(sealed, senderKey)
+		if err != nil {
+			fmt.Println("Could not open private message from", sealed.Origin, ":", err)
+			return
+		}
+		if mh.acknowledgePrivate(private.Origin, private.ID, sealed.Holder) {
+			return
+		}
+		mh.ctx.GUImessageChannel <- &core.GUIPacket{Private: private}
+	default:
+		if sealed.HopLimit == 0 {
+			return
+		}
+		sealed.HopLimit = sealed.HopLimit - 1
+		go mh.ctx.SendPacketToPeer(core.GossipPacket{EncryptedPrivate: sealed}, destinationIP)
+	}
+}
+
 func (mh *MessageHandler) messageExists(rumour core.RumourMessage) bool {
-	_, ok := mh.ctx.VectorClock.GetStoredMessage(rumour.Origin, rumour.ID)
-	return ok
+	return mh.ctx.VectorClock.Has(rumour.Origin, rumour.ID)
 }
 
 func (mh *MessageHandler) printPeers() {
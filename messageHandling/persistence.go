@@ -0,0 +1,55 @@
+package messageHandling
+
+import (
+	"fmt"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+//Save snapshots the channel memberships and keys, and the messages our mailbox holds for others
+func (mh *MessageHandler) Save(store *core.Store) error {
+	mh.channelLocker.RLock()
+	err := store.Put(CHANNELS_SNAPSHOT, mh.channels)
+	mh.channelLocker.RUnlock()
+	if err != nil || mh.mailbox == nil {
+		return err
+	}
+	mh.mailbox.mailboxLocker.Lock()
+	defer mh.mailbox.mailboxLocker.Unlock()
+	return store.Put(MAILBOX_SNAPSHOT, mh.mailbox.held)
+}
+
+//Restore rejoins the channels saved by a previous run and takes back the messages its mailbox held
+func (mh *MessageHandler) Restore(store *core.Store) error {
+	channels := make(map[string][]byte)
+	found, err := store.Get(CHANNELS_SNAPSHOT, &channels)
+	if err != nil {
+		return err
+	}
+	if found {
+		mh.channelLocker.Lock()
+		for channel, key := range channels {
+			mh.channels[channel] = key
+		}
+		mh.channelLocker.Unlock()
+	}
+	if mh.mailbox == nil {
+		return nil
+	}
+	held := make(map[string][]*heldMessage)
+	if found, err = store.Get(MAILBOX_SNAPSHOT, &held); err != nil || !found {
+		return err
+	}
+	mh.mailbox.mailboxLocker.Lock()
+	defer mh.mailbox.mailboxLocker.Unlock()
+	for recipient, backlog := range held {
+		mh.mailbox.held[recipient] = append(mh.mailbox.held[recipient], backlog...)
+	}
+	return nil
+}
+
+func (mh *MessageHandler) persist() {
+	if err := mh.Save(mh.ctx.Store); err != nil {
+		fmt.Println("Could not persist message handler state:", err)
+	}
+}
@@ -0,0 +1,198 @@
+package messageHandling
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	PRIVATE_RETRY_TIMEOUT = 2 * time.Second
+	PRIVATE_MAX_ATTEMPTS  = 5
+	PRIVATE_SEEN_TIMEOUT  = 5 * time.Minute
+	MAX_DEFERRED_ACKS     = 64
+)
+
+//pendingPrivate is a private message we sent and that was not acknowledged yet
+type pendingPrivate struct {
+	destination string
+	id          uint32
+	text        string
+	packet      core.GossipPacket
+	hopLimit    uint32
+	attempts    int
+	stored      bool
+	timer       *time.Timer
+}
+
+//newPrivateID returns the ID of the next private message we send. IDs start at a random value,
+//so that messages sent after a restart are not mistaken for retries of earlier ones.
+func (mh *MessageHandler) newPrivateID() uint32 {
+	mh.privateLocker.Lock()
+	defer mh.privateLocker.Unlock()
+	//ID 0 marks messages from nodes that do not expect acknowledgements
+	for mh.nextPrivateID == 0 {
+		mh.nextPrivateID = rand.Uint32()
+	}
+	id := mh.nextPrivateID
+	mh.nextPrivateID++
+	return id
+}
+
+//track sends a signed or sealed private message and retransmits it with exponential backoff until it is acknowledged
+//or PRIVATE_MAX_ATTEMPTS were made. It is then deposited in the recipient's mailbox if store and forward is enabled.
+func (mh *MessageHandler) track(destination string, id uint32, text string, packet core.GossipPacket) {
+	pending := &pendingPrivate{destination: destination, id: id, text: text, packet: packet}
+	if packet.Private != nil {
+		pending.hopLimit = packet.Private.HopLimit
+	} else {
+		pending.hopLimit = packet.EncryptedPrivate.HopLimit
+	}
+	mh.privateLocker.Lock()
+	mh.pending[receiptKey(destination, id)] = pending
+	mh.privateLocker.Unlock()
+	mh.notifyReceipt(destination, id, text, core.PRIVATE_SENT)
+	mh.transmit(pending)
+}
+
+//transmit makes one more attempt at delivering a pending message and schedules the next one
+func (mh *MessageHandler) transmit(pending *pendingPrivate) {
+	mh.privateLocker.Lock()
+	if _, ok := mh.pending[receiptKey(pending.destination, pending.id)]; !ok {
+		mh.privateLocker.Unlock()
+		return
+	}
+	if pending.attempts == PRIVATE_MAX_ATTEMPTS {
+		if !pending.stored && mh.deposit(pending.packet) {
+			//Still waiting for the acknowledgement, sent once a holder delivers it
+			pending.stored = true
+			pending.timer = time.AfterFunc(mh.mailbox.expiry, func() { mh.transmit(pending) })
+			mh.privateLocker.Unlock()
+			fmt.Println("PRIVATE STORED to", pending.destination, "ID", pending.id)
+			mh.notifyReceipt(pending.destination, pending.id, pending.text, core.PRIVATE_STORED)
+			return
+		}
+		delete(mh.pending, receiptKey(pending.destination, pending.id))
+		mh.privateLocker.Unlock()
+		fmt.Println("PRIVATE FAILED to", pending.destination, "ID", pending.id, "after", pending.attempts, "attempts")
+		mh.notifyReceipt(pending.destination, pending.id, pending.text, core.PRIVATE_FAILED)
+		return
+	}
+	pending.attempts++
+	pending.timer = time.AfterFunc(PRIVATE_RETRY_TIMEOUT<<uint(pending.attempts-1), func() { mh.transmit(pending) })
+	attempt := pending.attempts
+	mh.privateLocker.Unlock()
+
+	if attempt > 1 {
+		fmt.Println("PRIVATE RETRY to", pending.destination, "ID", pending.id, "attempt", attempt)
+	}
+	//Relaying decrements the hop limit in place, every attempt starts from a fresh copy
+	if pending.packet.Private != nil {
+		private := *pending.packet.Private
+		private.HopLimit = pending.hopLimit
+		mh.HandlePrivateMessage(core.GossipPacket{Private: &private})
+		return
+	}
+	sealed := *pending.packet.EncryptedPrivate
+	sealed.HopLimit = pending.hopLimit
+	mh.HandleEncryptedPrivateMessage(core.GossipPacket{EncryptedPrivate: &sealed})
+}
+
+//HandlePrivateAck settles the pending message an acknowledgement addressed to us refers to, and relays the others
+func (mh *MessageHandler) HandlePrivateAck(packet core.GossipPacket) {
+	ack := packet.PrivateAck
+	if err := mh.ctx.KeyRing.VerifyPrivateAck(ack); err != nil {
+		fmt.Println("REJECTED private ack origin", ack.Origin, ":", err)
+		return
+	}
+	mh.settleMailbox(ack)
+	found, destinationIP := mh.ctx.RetrieveDestinationRoute(ack.Destination)
+	switch found {
+	case -1:
+		return
+	case 0:
+		mh.privateLocker.Lock()
+		pending, ok := mh.pending[receiptKey(ack.Origin, ack.ID)]
+		if ok {
+			delete(mh.pending, receiptKey(ack.Origin, ack.ID))
+			pending.timer.Stop()
+		}
+		mh.privateLocker.Unlock()
+		if !ok {
+			return
+		}
+		fmt.Println("PRIVATE DELIVERED to", ack.Origin, "ID", ack.ID)
+		mh.notifyReceipt(pending.destination, pending.id, pending.text, core.PRIVATE_DELIVERED)
+	default:
+		if ack.HopLimit == 0 {
+			return
+		}
+		ack.HopLimit = ack.HopLimit - 1
+		go mh.ctx.SendPacketToPeer(core.GossipPacket{PrivateAck: ack}, destinationIP)
+	}
+}
+
+//acknowledgePrivate confirms the delivery of a private message to its origin, and to the mailbox holder that delivered it if any,
+//and reports whether it was already delivered, in which case it is a retry whose acknowledgement got lost
+func (mh *MessageHandler) acknowledgePrivate(origin string, id uint32, holder string) bool {
+	if id == 0 {
+		return false
+	}
+	ack := &core.PrivateAck{Origin: mh.ctx.Name, ID: id, Destination: origin, HopLimit: mh.ctx.GetHopLimit()}
+	mh.ctx.Identity.SignPrivateAck(ack)
+	go mh.sendAck(ack)
+	if len(holder) > 0 && holder != origin && holder != mh.ctx.Name {
+		deposit := &core.MailboxDeposit{Origin: mh.ctx.Name, Destination: holder, HopLimit: mh.ctx.GetHopLimit(), Ack: ack}
+		go mh.HandleMailboxDeposit(core.GossipPacket{Deposit: deposit})
+	}
+
+	now := time.Now()
+	mh.privateLocker.Lock()
+	defer mh.privateLocker.Unlock()
+	for key, received := range mh.seen {
+		if now.Sub(received) > PRIVATE_SEEN_TIMEOUT {
+			delete(mh.seen, key)
+		}
+	}
+	key := receiptKey(origin, id)
+	if _, duplicate := mh.seen[key]; duplicate {
+		return true
+	}
+	mh.seen[key] = now
+	return false
+}
+
+//sendAck routes an acknowledgement we issued. Without a route to its destination yet, as when a mailbox delivers
+//to us right after we came back, it waits for the next rumour from the destination.
+func (mh *MessageHandler) sendAck(ack *core.PrivateAck) {
+	if found, _ := mh.ctx.RetrieveDestinationRoute(ack.Destination); found == -1 {
+		mh.privateLocker.Lock()
+		defer mh.privateLocker.Unlock()
+		if len(mh.deferredAcks[ack.Destination]) < MAX_DEFERRED_ACKS {
+			mh.deferredAcks[ack.Destination] = append(mh.deferredAcks[ack.Destination], ack)
+		}
+		return
+	}
+	mh.HandlePrivateAck(core.GossipPacket{PrivateAck: ack})
+}
+
+//releaseAcks sends the acknowledgements that were waiting for a route to origin
+func (mh *MessageHandler) releaseAcks(origin string) {
+	mh.privateLocker.Lock()
+	acks := mh.deferredAcks[origin]
+	delete(mh.deferredAcks, origin)
+	mh.privateLocker.Unlock()
+	for _, ack := range acks {
+		mh.HandlePrivateAck(core.GossipPacket{PrivateAck: ack})
+	}
+}
+
+func (mh *MessageHandler) notifyReceipt(destination string, id uint32, text, status string) {
+	mh.ctx.GUImessageChannel <- &core.GUIPacket{Receipt: &core.PrivateReceipt{Destination: destination, ID: id, Text: text, Status: status}}
+}
+
+func receiptKey(peer string, id uint32) string {
+	return fmt.Sprintf("%s:%d", peer, id)
+}
@@ -0,0 +1,99 @@
+package messageHandling
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	core "github.com/ksei/Peerster/Core"
+)
+
+const (
+	SIMPLE_SEEN_CACHE_SIZE = 4096
+	//LEGACY_SIMPLE_WINDOW is how long a message without a nonce is suppressed for: only the copies flooded back to us in the meantime
+	//are duplicates, the same text sent again later by a legacy peer is a new message
+	LEGACY_SIMPLE_WINDOW = 10 * time.Second
+)
+
+//seenCache remembers the last capacity simple messages, forgetting the oldest first. A message may also be remembered for a limited time only.
+type seenCache struct {
+	seenLocker sync.Mutex
+	capacity   int
+	seen       map[string]time.Time
+	order      []string
+	next       int
+}
+
+func newSeenCache(capacity int) *seenCache {
+	return &seenCache{capacity: capacity, seen: make(map[string]time.Time), order: make([]string, capacity)}
+}
+
+//add records a message, for window if it is positive and until it is evicted otherwise, and reports whether it was new
+func (cache *seenCache) add(key string, window time.Duration) bool {
+	now := time.Now()
+	expires := time.Time{}
+	if window > 0 {
+		expires = now.Add(window)
+	}
+	cache.seenLocker.Lock()
+	defer cache.seenLocker.Unlock()
+	if previous, ok := cache.seen[key]; ok {
+		if previous.IsZero() || now.Before(previous) {
+			return false
+		}
+		//Expired but still in the eviction order, it keeps its place there
+		cache.seen[key] = expires
+		return true
+	}
+	if evicted := cache.order[cache.next]; len(evicted) > 0 {
+		delete(cache.seen, evicted)
+	}
+	cache.order[cache.next] = key
+	cache.next = (cache.next + 1) % cache.capacity
+	cache.seen[key] = expires
+	return true
+}
+
+//SendSimpleMessage floods a new simple message from us
+func (mh *MessageHandler) SendSimpleMessage(text string) {
+	message := &core.SimpleMessage{OriginalName: mh.ctx.Name, Contents: text, Nonce: rand.Uint64(), HopLimit: mh.ctx.GetHopLimit()}
+	mh.simpleSeen.add(simpleKey(message))
+	mh.ctx.GUImessageChannel <- &core.GUIPacket{Simple: message, Sender: mh.ctx.Address.String()}
+	go mh.ctx.ForwardToPeers(*message)
+}
+
+func (mh *MessageHandler) HandleSimpleMessage(packet core.GossipPacket) {
+	message := packet.Simple
+	if message.Nonce == 0 && message.HopLimit == 0 {
+		//From a peer predating duplicate suppression, flooded with our own hop limit
+		message.HopLimit = mh.ctx.GetHopLimit()
+	}
+	if !mh.simpleSeen.add(simpleKey(message)) {
+		return
+	}
+	fmt.Println("SIMPLE MESSAGE origin", message.OriginalName, "from", message.RelayPeerAddr, "contents", message.Contents)
+	mh.printPeers()
+	mh.ctx.GUImessageChannel <- &core.GUIPacket{Simple: message, Sender: message.RelayPeerAddr}
+	if message.HopLimit <= 1 {
+		return
+	}
+	forward := *message
+	forward.HopLimit--
+	go mh.ctx.ForwardToPeers(forward)
+}
+
+//simpleKey identifies a simple message, along with how long to suppress its copies for.
+//Messages without a nonce are told apart by their contents, within LEGACY_SIMPLE_WINDOW only.
+func simpleKey(message *core.SimpleMessage) (string, time.Duration) {
+	nonce := message.Nonce
+	window := time.Duration(0)
+	if nonce == 0 {
+		digest := sha256.Sum256([]byte(message.OriginalName + "\x00" + message.Contents))
+		nonce = binary.LittleEndian.Uint64(digest[:8])
+		window = LEGACY_SIMPLE_WINDOW
+	}
+	return fmt.Sprintf("%s:%d", message.OriginalName, nonce), window
+}
@@ -8,7 +8,7 @@ new Vue({
         ws: null, // websocket
         newMsg: '', // Holds new messages to be sent to the server
         chatContent: '', // A running list of chat messages displayed on the screen
-        peerContent: '', // A running list of peers
+        peers: [], // A running list of peers and their liveness
         ipAddress: null, // ipAddressess of the peer
         searchKeywords : null,
         myIP: '',
@@ -22,6 +22,9 @@ new Vue({
         file: '',
         fileMetahash :'',
         showModal: false,
+        routes: [],
+        channelName: '',
+        channelKey: '',
     },
 
     created: function() {
@@ -29,6 +32,8 @@ new Vue({
         this.activeChat = 'Group';
         this.ws = new WebSocket('ws://' + window.location.host + '/ws');
         console.log('ws://' + window.location.host + '/ws')
+        this.refreshRoutes();
+        setInterval(this.refreshRoutes, 3000);
         this.ws.addEventListener('message', function(e) {
             var msg = JSON.parse(e.data);
             console.log("Hey");
@@ -41,11 +46,15 @@ new Vue({
             if(msg.message == ""){
                 return;
             }
-            self.userMessages['Group'] = self.userMessages['Group'] || []
-            self.userMessages['Group'].push({"ip":msg.ipAddr,"text":msg.message,"origin":msg.origin})
-            if (self.activeChat == 'Group'){    
+            var chat = msg.channel ? '#' + msg.channel : 'Group'
+            if(!self.origins.includes(chat)){
+                self.origins.push(chat)
+            }
+            self.userMessages[chat] = self.userMessages[chat] || []
+            self.userMessages[chat].push({"ip":msg.ipAddr,"text":msg.message,"origin":msg.origin,"late":msg.late})
+            if (self.activeChat == chat){    
                 tmpMsg =  emojione.toImage(msg.message);
-                tmpMsgChip = '<div class="chip" style="margin-left:5px">'+ '<img src="' + self.gravatarURL(msg.origin) + '">' + msg.origin + " (" + msg.ipAddr + ") "+ '</div>'
+                tmpMsgChip = '<div class="chip" style="margin-left:5px">'+ '<img src="' + self.gravatarURL(msg.origin) + '">' + msg.origin + " (" + msg.ipAddr + ") "+ (msg.late ? '<i>late</i> ' : '') + '</div>'
                 if(msg.origin == self.me){
                     self.chatContent += '<div style="float:right;clear:both;display:table;">' + tmpMsg + tmpMsgChip + '</div><br/>'
                 }
@@ -71,6 +80,25 @@ new Vue({
                 element.scrollTop = element.scrollHeight; // Auto scroll to the bottom
             }
 
+        }else if(msg.type == "PrivateStatus") {
+            var destination = msg.Destination
+            self.userMessages[destination] = self.userMessages[destination] || []
+            var sent = self.userMessages[destination].find(function(m) { return m.id == msg.id && m.origin == self.me })
+            if(sent){
+                sent.status = msg.status
+            }else{
+                self.userMessages[destination].push({"text":msg.message, "origin":self.me, "id":msg.id, "status":msg.status})
+            }
+            if(self.activeChat == destination){
+                self.chatContent = ''
+                self.renderChatBox()
+            }
+        }else if(msg.type == "MessageGap") {
+            self.userMessages['Group'] = self.userMessages['Group'] || []
+            self.userMessages['Group'].push({"gap":msg.message,"origin":msg.origin})
+            if (self.activeChat == 'Group'){
+                self.chatContent += self.gapNotice(msg.origin, msg.message)
+            }
         }else if(msg.type == "SearchMatch") {
             self.searchMatches.push(msg.filename)
             self.metahashes[msg.filename] = msg.metahash
@@ -80,12 +108,9 @@ new Vue({
                 document.getElementById('myip').textContent = '  ' + msg.ipAddr.substr(0,msg.ipAddr.length -4);
                 return
             }
-            self.peerContent += '<div class="chip">'
-            + '<img src="https://img.icons8.com/color/48/000000/online.png">' // Avatar
-                    + msg.ipAddr
-                + '</div>'
-            var element1 = document.getElementById('peer-list');
-            element1.scrollTop = element1.scrollHeight; // Auto scroll to the bottom
+            self.setPeerState(msg.ipAddr, null)
+        }else if(msg.type == "PeerState"){
+            self.setPeerState(msg.ipAddr, msg.message)
         }
 
         });
@@ -102,7 +127,17 @@ new Vue({
                             message: $('<p>').html(this.newMsg).text() // Strip out html
                         }
                     ));
+                } else if(this.isChannel(this.activeChat)){
+                    // Our own channel messages come back through the gossiper, like group messages
+                    this.ws.send(
+                        JSON.stringify({
+                            type: 'ChannelMessage',
+                            message: $('<p>').html(this.newMsg).text(), // Strip out html
+                            channel: this.activeChat.substr(1),
+                        }
+                    ));
                 } else {
+                    // Shown once the gossiper reports it sent, with its delivery status
                     this.ws.send(
                         JSON.stringify({
                             type: 'PrivateMessage',
@@ -110,12 +145,6 @@ new Vue({
                             destination: this.activeChat,
                         }
                     ));
-                    this.userMessages[this.activeChat] = this.userMessages[this.activeChat] || [];
-                    this.userMessages[this.activeChat].push({"text":this.newMsg, "origin":this.me});
-                    this.chatContent += '<div style="float:right;clear:both;display:table;">'+ emojione.toImage(this.newMsg)+ '<div class="chip" style="margin-left:5px">' +
-                    '<img src="' + this.gravatarURL(this.me) + '">' // Avatar
-                            + this.me 
-                    + '</div></div>'  + '<br/>'
                 }
 
                 this.newMsg = ''; // Reset newMsg
@@ -136,6 +165,96 @@ new Vue({
             this.ipAddress = '';
         },
 
+        joinChannel: function () {
+            if (!this.channelName) {
+                Materialize.toast('You must enter a channel name', 2000);
+                return
+            }
+            var channel = $('<p>').html(this.channelName).text().replace(/^#/, '') // Strip out html
+            this.ws.send(
+                JSON.stringify({
+                    type: 'JoinChannel',
+                    channel: channel,
+                    key: this.channelKey || '',
+                }
+            ));
+            if(!this.origins.includes('#' + channel)){
+                this.origins.push('#' + channel)
+            }
+            this.channelName = '';
+            this.channelKey = '';
+        },
+
+        leaveChannel: function () {
+            if (!this.isChannel(this.activeChat)) {
+                Materialize.toast('Open the channel you want to leave', 2000);
+                return
+            }
+            this.ws.send(
+                JSON.stringify({
+                    type: 'LeaveChannel',
+                    channel: this.activeChat.substr(1),
+                }
+            ));
+            this.origins.splice(this.origins.indexOf(this.activeChat), 1)
+            delete this.userMessages[this.activeChat]
+            this.activeChat = 'Group';
+            this.chatContent = '';
+            this.renderChatBox();
+        },
+
+        isChannel: function(chat) {
+            return chat.charAt(0) == '#'
+        },
+
+        refreshRoutes: function() {
+            var self = this;
+            $.getJSON('/routes', function(routes) {
+                self.routes = routes || [];
+                // Every node we have a route to can be messaged privately
+                self.routes.forEach(function(route) {
+                    if(!self.origins.includes(route.origin) && route.origin != self.me){
+                        self.origins.push(route.origin)
+                    }
+                });
+            });
+        },
+
+        setPeerState: function(ipAddr, state) {
+            for (var i = 0; i < this.peers.length; i++) {
+                if (this.peers[i].ipAddr == ipAddr) {
+                    if (state == 'removed') {
+                        this.peers.splice(i, 1)
+                    } else if (state != null) {
+                        this.peers[i].state = state
+                    }
+                    return
+                }
+            }
+            if (state == 'removed') {
+                return
+            }
+            this.peers.push({"ipAddr": ipAddr, "state": state || 'up'})
+            this.$nextTick(function() {
+                var element = document.getElementById('peer-list');
+                element.scrollTop = element.scrollHeight; // Auto scroll to the bottom
+            })
+        },
+
+        peerIcon: function(state) {
+            if (state == 'down') {
+                return 'https://img.icons8.com/color/48/000000/offline.png'
+            }
+            if (state == 'suspect') {
+                return 'https://img.icons8.com/color/48/000000/away.png'
+            }
+            return 'https://img.icons8.com/color/48/000000/online.png'
+        },
+
+        gapNotice: function(origin, count) {
+            return '<div style="text-align:center;clear:both;color:grey"><i>' + count + ' message(s) from ' + origin + ' missing</i></div><br/>'
+        },
+
         gravatarURL: function(email) {
             return 'http://www.gravatar.com/avatar/' + CryptoJS.MD5(email);
         },
@@ -150,10 +269,18 @@ new Vue({
         },
 
         generateMessage: function(messageTuple){
+            if(messageTuple.gap){
+                this.chatContent += this.gapNotice(messageTuple.origin, messageTuple.gap)
+                return
+            }
             message = emojione.toImage(messageTuple.text)
             messageChip = '<div class="chip" style="margin-left:5px">' + '<img src="' + this.gravatarURL(messageTuple.origin) + '">' + messageTuple.origin ;
-            if(this.activeChat == 'Group'){
+            if(this.activeChat == 'Group' || this.isChannel(this.activeChat)){
                     messageChip +=" (" + messageTuple.ip + ") "}
+            if(messageTuple.late){
+                    messageChip += '<i>late</i> '}
+            if(messageTuple.status){
+                    messageChip += ' <i>' + messageTuple.status + '</i>'}
             messageChip += '</div>'
             
             if(messageTuple.origin == this.me){
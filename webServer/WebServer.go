@@ -2,6 +2,7 @@ package webserver
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -55,9 +56,12 @@ func (webServer *WebServer) Launch(gossiperAddress string) {
 	fs := http.FileServer(http.Dir("./public"))
 	http.Handle("/", fs)
 	http.HandleFunc("/ws", webServer.handleConnections)
+	http.HandleFunc("/routes", webServer.handleRoutes)
+	http.HandleFunc("/stats", webServer.handleStats)
 	go webServer.handleIncomingPeerUpdate()
 	go webServer.handleSocketPackets()
 	go webServer.handleGossiperPackets()
+	go webServer.handlePeerEvents()
 
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -99,6 +103,56 @@ func (webServer *WebServer) handleConnections(w http.ResponseWriter, r *http.Req
 	}
 }
 
+//Serves the current routing table as JSON
+func (webServer *WebServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(webServer.ctx.Routes.Routes()); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+//trafficStats summarises dropped and rejected peer traffic for operators
+type trafficStats struct {
+	CorruptPackets      uint64            `json:"corruptPackets"`
+	ForgedSignatures    uint64            `json:"forgedSignatures"`
+	RejectedByType      map[string]uint64 `json:"rejectedByType"`
+	RateLimitedByType   map[string]uint64 `json:"rateLimitedByType"`
+	RateLimitedBySender map[string]uint64 `json:"rateLimitedBySender"`
+	QueueDrops          uint64            `json:"queueDrops"`
+	ClampedBudgets      uint64            `json:"clampedBudgets"`
+	ClampedHopLimits    uint64            `json:"clampedHopLimits"`
+}
+
+//Serves the dropped traffic counters as JSON
+func (webServer *WebServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	registry := webServer.ctx.Registry
+	limiterStats := registry.Limiter.GetStats()
+	stats := trafficStats{
+		CorruptPackets:      registry.GetCorruptPacketCount(),
+		ForgedSignatures:    webServer.ctx.KeyRing.GetForgedCount(),
+		RejectedByType:      make(map[string]uint64),
+		RateLimitedByType:   make(map[string]uint64),
+		RateLimitedBySender: limiterStats.RateLimitedBySender,
+		QueueDrops:          limiterStats.QueueDrops,
+		ClampedBudgets:      limiterStats.ClampedBudgets,
+		ClampedHopLimits:    limiterStats.ClampedHopLimits,
+	}
+	names := registry.GetKindNames()
+	names[core.ANY_PACKET] = "Any"
+	for packetType, name := range names {
+		if rejected := registry.GetRejectedCount(packetType); rejected > 0 {
+			stats.RejectedByType[name] = rejected
+		}
+		if limited := limiterStats.RateLimitedByType[packetType]; limited > 0 {
+			stats.RateLimitedByType[name] = limited
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
 //GOSSIP-PACKET HANDLING ---------------------------------------------------------
 
 //Handles GossipPackets coming from the gossiper
@@ -125,6 +179,14 @@ func (webServer *WebServer) handleGossiperPackets() {
 	}
 }
 
+//Forwards peer liveness changes to the clients through the gossiper packet loop
+func (webServer *WebServer) handlePeerEvents() {
+	for event := range webServer.ctx.PeerManager.Events {
+		peerEvent := event
+		webServer.ctx.GUImessageChannel <- &core.GUIPacket{PeerEvent: &peerEvent}
+	}
+}
+
 //Method for forwarding a core.Message packet to the gossiper
 func (webServer *WebServer) sendMessageToGossiper(message core.Message) {
 	toSend := localAddress + ":" + webServer.UIPort
@@ -161,18 +223,35 @@ func (webServer *WebServer) handleSocketPackets() {
 			go webServer.handleStorePasswordRequest(msg)
 		case "PasswordDelete":
 			go webServer.handlePasswordDelete(msg)
+		case "JoinChannel":
+			go webServer.handleJoinChannel(msg)
+		case "LeaveChannel":
+			go webServer.handleLeaveChannel(msg)
 		default:
 			go webServer.handleIncomingMessage(msg)
 		}
 	}
 }
 
-//Handles incoming messages from the web client either Rumor or Private
+//Handles incoming messages from the web client either Rumor, Channel or Private
 func (webServer *WebServer) handleIncomingMessage(msg sockPacket) {
 	message := core.Message{Text: msg.Message}
 	if strings.Compare(msg.Type, "PrivateMessage") == 0 {
 		message.Destination = &msg.Destination
 	}
+	if strings.Compare(msg.Type, "ChannelMessage") == 0 {
+		message.Channel = &msg.Channel
+	}
+	webServer.sendMessageToGossiper(message)
+}
+
+func (webServer *WebServer) handleJoinChannel(req sockPacket) {
+	message := core.Message{JoinChannel: &req.Channel, ChannelKey: &req.Key}
+	webServer.sendMessageToGossiper(message)
+}
+
+func (webServer *WebServer) handleLeaveChannel(req sockPacket) {
+	message := core.Message{LeaveChannel: &req.Channel}
 	webServer.sendMessageToGossiper(message)
 }
 
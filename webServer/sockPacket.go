@@ -3,6 +3,7 @@ package webserver
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
 
 	core "github.com/ksei/Peerster/Core"
 )
@@ -21,6 +22,11 @@ type sockPacket struct {
 	Username    string `json:"username"`
 	MasterKey   string `json:"masterKey"`
 	Password    string `json:"password"`
+	Late        bool   `json:"late"`
+	Channel     string `json:"channel"`
+	Key         string `json:"key"`
+	ID          uint32 `json:"id"`
+	Status      string `json:"status"`
 }
 
 //Creates peerPackets for sending to the client
@@ -29,6 +35,12 @@ func createPeerPacket(peer string) *sockPacket {
 	return packet
 }
 
+//Creates peerPackets announcing a peer going up, suspect or down
+func createPeerStatePacket(event core.PeerEvent) *sockPacket {
+	packet := &sockPacket{Type: "PeerState", IPAddress: event.Address, Message: event.StateName()}
+	return packet
+}
+
 //Creates Message Packets for sending to the client
 func processGUIPacket(incomingPacket core.GUIPacket) (*sockPacket, error) {
 	contentType := incomingPacket.GetType()
@@ -39,12 +51,33 @@ func processGUIPacket(incomingPacket core.GUIPacket) (*sockPacket, error) {
 		packet.IPAddress = incomingPacket.Sender
 		packet.Origin = incomingPacket.Rumour.Origin
 		packet.Message = incomingPacket.Rumour.Text
+		packet.Late = incomingPacket.Late
+		packet.Channel = incomingPacket.Rumour.Channel
+		return packet, nil
+	case core.SIMPLE_MESSAGE:
+		packet.Type = "Message"
+		packet.IPAddress = incomingPacket.Sender
+		packet.Origin = incomingPacket.Simple.OriginalName
+		packet.Message = incomingPacket.Simple.Contents
+		return packet, nil
+	case core.MESSAGE_GAP:
+		gap := incomingPacket.Gap
+		packet.Type = "MessageGap"
+		packet.Origin = gap.Origin
+		packet.Message = fmt.Sprintf("%d", gap.ToID-gap.FromID+1)
 		return packet, nil
 	case core.PRIVATE_MESSAGE:
 		packet.Type = "PrivateMessage"
 		packet.Origin = incomingPacket.Private.Origin
 		packet.Message = incomingPacket.Private.Text
 		return packet, nil
+	case core.PRIVATE_ACK:
+		packet.Type = "PrivateStatus"
+		packet.Destination = incomingPacket.Receipt.Destination
+		packet.Message = incomingPacket.Receipt.Text
+		packet.ID = incomingPacket.Receipt.ID
+		packet.Status = incomingPacket.Receipt.Status
+		return packet, nil
 	case core.SEARCH_REPLY:
 		packet.Type = "SearchMatch"
 		packet.Filename = incomingPacket.SearchResult.FileName
@@ -58,6 +91,8 @@ func processGUIPacket(incomingPacket core.GUIPacket) (*sockPacket, error) {
 		packet.Type = "PassowrdOpResult"
 		packet.Message = *incomingPacket.PasswordOpResult
 		return packet, nil
+	case core.PEER_EVENT:
+		return createPeerStatePacket(*incomingPacket.PeerEvent), nil
 	}
 	return nil, errors.New("Corrupt Packet received")
 }